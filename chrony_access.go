@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"el/brick-clock/chronyconf"
+)
+
+// AccessRule is one allow or deny directive of chrony.conf, controlling
+// which NTP clients chronyd serves. Rules apply in order; a later rule
+// for an overlapping subnet wins, and All makes it override the rules
+// for subnets inside it too. An empty Subnet means every address.
+type AccessRule struct {
+	Action string `json:"action"`
+	All    bool   `json:"all"`
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// Validate checks the action and that the subnet is an IPv4 or IPv6 CIDR.
+func (r *AccessRule) Validate() error {
+	switch r.Action {
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("action must be allow or deny, not %q", r.Action)
+	}
+	if r.Subnet != "" {
+		if _, _, err := net.ParseCIDR(r.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet %q: must be a CIDR such as 192.168.0.0/16 or 2001:db8::/32", r.Subnet)
+		}
+	}
+	return nil
+}
+
+// Directive returns the chrony.conf directive for the rule.
+func (r *AccessRule) Directive() *chronyconf.Directive {
+	var args []string
+	if r.All {
+		args = append(args, "all")
+	}
+	if r.Subnet != "" {
+		args = append(args, r.Subnet)
+	}
+	return chronyconf.NewDirective(r.Action, args...)
+}
+
+// accessRuleFromDirective reads an allow or deny directive. Subnets that
+// are not CIDRs, such as a bare address or a hostname, are kept as
+// written.
+func accessRuleFromDirective(d *chronyconf.Directive) AccessRule {
+	rule := AccessRule{Action: d.Name}
+	args := d.Args
+	if len(args) > 0 && args[0] == "all" {
+		rule.All = true
+		args = args[1:]
+	}
+	rule.Subnet = strings.Join(args, " ")
+	return rule
+}
+
+// accessRules returns the active allow and deny rules of conf, in order.
+func accessRules(conf *chronyconf.File) []AccessRule {
+	rules := []AccessRule{}
+	for _, d := range conf.Directives("allow", "deny") {
+		rules = append(rules, accessRuleFromDirective(d))
+	}
+	return rules
+}
+
+// replaceAccessRules replaces every allow and deny directive of conf with
+// rules, at the position of the first one.
+func replaceAccessRules(conf *chronyconf.File, rules []AccessRule) {
+	var ds []*chronyconf.Directive
+	for i := range rules {
+		ds = append(ds, rules[i].Directive())
+	}
+	conf.Replace(ds, "allow", "deny")
+}
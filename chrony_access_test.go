@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSetAccessRules(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Config = []byte("server time.example.com iburst\n" +
+		"allow 192.0.2.0/24\n" +
+		"# clients of the lab\n" +
+		"deny 192.0.2.1\n" +
+		"driftfile /var/lib/chrony/drift\n")
+	token := testToken(t, "clock/server_mode")
+
+	rules := `[
+		{"action": "deny", "subnet": "2001:db8:bad::/48"},
+		{"action": "allow", "subnet": "2001:db8::/32"},
+		{"action": "allow", "all": true, "subnet": "192.0.2.0/24"},
+		{"action": "deny", "subnet": "192.0.2.128/25"}
+	]`
+	code, response := request(t, app, "PUT", "/server-mode", token, `{"rules": `+rules+`}`)
+	if code != http.StatusOK || response["success"] != true || response["server_mode_enabled"] != true {
+		t.Fatalf("PUT /server-mode = %d %v", code, response)
+	}
+
+	// The rules replace the old ones where the first of them was, in order
+	want := "server time.example.com iburst\n" +
+		"deny 2001:db8:bad::/48\n" +
+		"allow 2001:db8::/32\n" +
+		"allow all 192.0.2.0/24\n" +
+		"deny 192.0.2.128/25\n" +
+		"# clients of the lab\n" +
+		"driftfile /var/lib/chrony/drift\n"
+	if string(backend.Config) != want {
+		t.Errorf("chrony.conf =\n%s\nwant\n%s", backend.Config, want)
+	}
+	wantRules := `[{"action":"deny","all":false,"subnet":"2001:db8:bad::/48"},` +
+		`{"action":"allow","all":false,"subnet":"2001:db8::/32"},` +
+		`{"action":"allow","all":true,"subnet":"192.0.2.0/24"},` +
+		`{"action":"deny","all":false,"subnet":"192.0.2.128/25"}]`
+	if got, _ := json.Marshal(response["rules"]); string(got) != wantRules {
+		t.Errorf("rules = %s, want %s", got, wantRules)
+	}
+
+	// Without an allow rule, server mode is off
+	code, response = request(t, app, "PUT", "/server-mode", token, `{"rules": [{"action": "deny", "all": true}]}`)
+	if code != http.StatusOK || response["server_mode_enabled"] != false {
+		t.Errorf("PUT /server-mode with only deny = %d %v", code, response)
+	}
+}
+
+func TestSetAccessRulesRejectsInvalidSubnets(t *testing.T) {
+	app, backend := newTestApp(t)
+	previous := "allow 192.0.2.0/24\n"
+	backend.Config = []byte(previous)
+	token := testToken(t, "clock/server_mode")
+
+	for _, rule := range []string{
+		`{"action": "allow", "subnet": "192.0.2.7"}`,
+		`{"action": "allow", "subnet": "2001:db8::7"}`,
+		`{"action": "allow", "subnet": "192.0.2.0/33"}`,
+		`{"action": "allow", "subnet": "ntp.example.com"}`,
+		`{"action": "permit", "subnet": "192.0.2.0/24"}`,
+	} {
+		body := `{"rules": [{"action": "allow", "subnet": "2001:db8::/32"}, ` + rule + `]}`
+		code, response := request(t, app, "PUT", "/server-mode", token, body)
+		details, _ := response["error"].(map[string]interface{})["details"].(map[string]interface{})
+		if code != http.StatusBadRequest || errorCode(response) != ERR_INVALID_REQUEST || details["field"] != "rules[1]" {
+			t.Errorf("rule %s: PUT /server-mode = %d %v", rule, code, response)
+		}
+	}
+	if string(backend.Config) != previous || backend.Restarts != 0 {
+		t.Errorf("invalid rules changed chrony.conf to %q or restarted chronyd", backend.Config)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"el/brick-clock/cmdmon"
+)
+
+// Activity is the typed form of "chronyc activity": how many sources are
+// in each state.
+type Activity struct {
+	Online       int `json:"online"`
+	Offline      int `json:"offline"`
+	BurstOnline  int `json:"burst_online"`
+	BurstOffline int `json:"burst_offline"`
+	Unresolved   int `json:"unresolved"`
+}
+
+// parseActivity parses "chronyc activity" output. Each line is a count
+// followed by "sources" and the state, e.g.
+// "0 sources doing burst (return to online)".
+func parseActivity(output string) (*Activity, error) {
+	a := &Activity{}
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(parts) != 3 || parts[1] != "sources" {
+			continue
+		}
+		count, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("activity %q: %v", line, err)
+		}
+		switch strings.Join(strings.Fields(parts[2]), " ") {
+		case "online":
+			a.Online = count
+		case "offline":
+			a.Offline = count
+		case "doing burst (return to online)":
+			a.BurstOnline = count
+		case "doing burst (return to offline)":
+			a.BurstOffline = count
+		case "with unknown address":
+			a.Unresolved = count
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no activity data in chronyc output")
+	}
+	return a, nil
+}
+
+// activityFromCmdmon converts a cmdmon activity reply.
+func activityFromCmdmon(r *cmdmon.Activity) *Activity {
+	return &Activity{
+		Online:       int(r.Online),
+		Offline:      int(r.Offline),
+		BurstOnline:  int(r.BurstOnline),
+		BurstOffline: int(r.BurstOffline),
+		Unresolved:   int(r.Unresolved),
+	}
+}
+
+// legacyMap renders the activity report in the v1 shape. The v1 key
+// names predate this type and are kept for existing consumers: ok_count
+// is online, failed_count offline, bogus_count and timeout_count the
+// bursts returning online and offline.
+func (a *Activity) legacyMap() map[string]string {
+	return map[string]string{
+		"ok_count":         strconv.Itoa(a.Online),
+		"failed_count":     strconv.Itoa(a.Offline),
+		"bogus_count":      strconv.Itoa(a.BurstOnline),
+		"timeout_count":    strconv.Itoa(a.BurstOffline),
+		"unresolved_count": strconv.Itoa(a.Unresolved),
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseActivity(t *testing.T) {
+	tests := []struct {
+		file string
+		want Activity
+	}{
+		{"activity.txt", Activity{Online: 4, Offline: 1, BurstOnline: 2, BurstOffline: 0, Unresolved: 3}},
+		{"activity-empty.txt", Activity{}},
+	}
+	for _, tt := range tests {
+		got, err := parseActivity(readTestdata(t, tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%s = %+v, want %+v", tt.file, *got, tt.want)
+		}
+	}
+}
+
+func TestParseActivityErrors(t *testing.T) {
+	for _, output := range []string{
+		"",
+		"506 Cannot talk to daemon\n",
+		"4 servers online\n",
+		"x sources online\n",
+	} {
+		if a, err := parseActivity(output); err == nil {
+			t.Errorf("parseActivity(%q) = %+v, want an error", output, a)
+		}
+	}
+	// Lines of states this version does not know are ignored
+	a, err := parseActivity("2 sources online\n1 sources resting\n")
+	if err != nil || a.Online != 2 {
+		t.Errorf("unknown state: %+v, %v", a, err)
+	}
+}
+
+func TestActivityLegacyMap(t *testing.T) {
+	a, err := parseActivity(readTestdata(t, "activity.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "activity.legacy.json", a.legacyMap())
+}
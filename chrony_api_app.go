@@ -2,33 +2,56 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"github.com/golang-jwt/jwt/v4"
+
+	"el/brick-clock/chronyconf"
 )
 
 const (
 	CHRONY_CONF_PATH = "/etc/chrony/chrony.conf"
 	DEFAULT_SERVERS  = "pool.ntp.org"
 	BUILD_INFO_PATH  = "/build-info.json"
+	// How long chronyd gets to answer after a restart before a
+	// configuration change is rolled back
+	RESTART_TIMEOUT  = 15 * time.Second
+	// Default directory of the chrony.conf revision history
+	CONFIG_REVISIONS_DIR = "/etc/brick/clock/revisions"
+	// Default audit log of the daemon actions
+	AUDIT_LOG_PATH = "/etc/brick/clock/audit.log"
+	// Default interval of the background status collection
+	POLL_INTERVAL = 15 * time.Second
+	// Default directory and retention of the tracking and source history
+	HISTORY_DIR       = "/var/lib/brick/clock/history"
+	HISTORY_RETENTION = 7 * 24 * time.Hour
+	// Default system clock offset, in seconds, beyond which /status/stream
+	// sends an offset_threshold event
+	OFFSET_THRESHOLD = 0.01
+	// Default number of clients, the busiest by NTP packets, with their
+	// own series in /metrics
+	CLIENT_METRICS_LIMIT = 20
 	STATUS_TRACKING    = 1
 	STATUS_SOURCES     = 2
 	STATUS_ACTIVITY    = 4
 	STATUS_CLIENTS     = 8
 	STATUS_SERVER_MODE = 16
-	STATUS_ALL         = STATUS_TRACKING | STATUS_SOURCES | STATUS_ACTIVITY | STATUS_CLIENTS | STATUS_SERVER_MODE
+	STATUS_SOURCESTATS = 32
+	STATUS_ALL         = STATUS_TRACKING | STATUS_SOURCES | STATUS_ACTIVITY | STATUS_CLIENTS | STATUS_SERVER_MODE | STATUS_SOURCESTATS
 )
 
 // Build info structure
@@ -49,11 +72,19 @@ type ServerResponse struct {
 }
 
 type SetServersRequest struct {
-	Servers []string `json:"servers"`
+	Servers []ServerConfig `json:"servers"`
 }
 
+// SetServerModeRequest either toggles server mode with Enabled, or sets
+// the ordered allow/deny rules with Rules (server mode is on when any
+// allow rule is present), and can change the hardening settings. A
+// hardening field that is omitted is left unchanged, and null removes it.
 type SetServerModeRequest struct {
-	Enabled bool `json:"enabled"`
+	Enabled *bool        `json:"enabled"`
+	Rules   []AccessRule `json:"rules"`
+	ServerHardening
+
+	set hardeningFields
 }
 
 type StatusResponse struct {
@@ -72,437 +103,296 @@ type VersionResponse struct {
 }
 
 type ServerModeResponse struct {
-	ServerModeEnabled bool `json:"server_mode_enabled"`
+	ServerModeEnabled bool         `json:"server_mode_enabled"`
+	Rules             []AccessRule `json:"rules"`
+	ServerHardening
 }
 
 type SetServerModeResponse struct {
-	Success           bool `json:"success"`
-	ServerModeEnabled bool `json:"server_mode_enabled"`
+	Success           bool         `json:"success"`
+	ServerModeEnabled bool         `json:"server_mode_enabled"`
+	Rules             []AccessRule `json:"rules"`
+	ServerHardening
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// App holds the chrony backend the handlers talk to and the collector
+// that samples it.
+type App struct {
+	backend ChronyBackend
+	// configMutex serializes read-modify-write cycles of chrony.conf.
+	// rollbackConfig is the file as it was before the current cycle, to
+	// restore when chronyd does not come back up after a restart.
+	configMutex    sync.Mutex
+	rollbackConfig []byte
+	restartTimeout time.Duration
+	// change describes the current cycle for the revision history
+	change    configChange
+	revisions *revisionStore
+	audit     *auditLog
+	history   *historyStore
+	events    *eventBroker
+	metrics   *httpMetrics
+	collector *collector
+	// wsOrigins are the browser origins, besides the API's own, that may
+	// open /ws
+	wsOrigins []string
+	// clientMetricsLimit is how many clients get their own series in
+	// /metrics; 0 exports only the totals
+	clientMetricsLimit int
 }
 
-// Cache structures for lazy loading
-type CachedData struct {
-	Data      interface{}
-	Timestamp time.Time
-	TTL       time.Duration
-	mutex     sync.RWMutex
-	fetchData func() interface{}
+// NewApp creates an App serving data from backend.
+func NewApp(backend ChronyBackend) *App {
+	a := &App{backend: backend, restartTimeout: RESTART_TIMEOUT, metrics: newHTTPMetrics(),
+		clientMetricsLimit: CLIENT_METRICS_LIMIT}
+	a.revisions, _ = openRevisionStore("")
+	a.audit, _ = openAuditLog("")
+	a.history, _ = openHistoryStore("", HISTORY_RETENTION)
+	a.events = newEventBroker(OFFSET_THRESHOLD)
+	a.collector = newCollector(a.collectSnapshot)
+	a.collector.OnSnapshot(func(snap *Snapshot) {
+		a.history.Record(snap)
+		a.events.Publish(snap)
+	})
+	return a
 }
 
-func (c *CachedData) Get() interface{} {
-	c.mutex.RLock()
-	if time.Since(c.Timestamp) < c.TTL {
-		defer c.mutex.RUnlock()
-		return c.Data
-	}
-	c.mutex.RUnlock()
-	
-	// Only refresh when actually requested and stale
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	
-	// Double-check after acquiring write lock
-	if time.Since(c.Timestamp) < c.TTL {
-		return c.Data
+// refreshStatus collects a new status snapshot, so that the next request
+// sees the effect of a change
+func (a *App) refreshStatus() {
+	a.collector.Refresh()
+}
+
+// readConfig parses chrony.conf from the backend
+func (a *App) readConfig() (*chronyconf.File, error) {
+	content, err := a.backend.ReadConfig()
+	if err != nil {
+		return nil, err
 	}
-	
-	// Refresh data here
-	c.Data = c.fetchData()
-	c.Timestamp = time.Now()
-	return c.Data
+	return chronyconf.Parse(content), nil
 }
 
-// Global cache instances
-var (
-	trackingCache  *CachedData
-	sourcesCache   *CachedData
-	activityCache  *CachedData
-	serverModeCache *CachedData
-	clientsCache   *CachedData
-	cacheInitialized bool
-	cacheMutex     sync.Mutex
-)
+// lockConfig starts a read-modify-write cycle of chrony.conf making change
+func (a *App) lockConfig(change configChange) {
+	a.configMutex.Lock()
+	a.change = change
+}
 
-// Initialize caches
-func initializeCaches() {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	
-	if cacheInitialized {
-		return
-	}
-	
-	// Initialize tracking cache (30 second TTL)
-	trackingCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	trackingCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"tracking"})
-		if err != "" {
-			return map[string]string{"error": err}
-		}
-		return parseTrackingOutput(output)
-	}
-	
-	// Initialize sources cache (30 second TTL)
-	sourcesCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	sourcesCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"sources"})
-		if err != "" {
-			return []map[string]string{}
-		}
-		return parseSourcesOutput(output)
-	}
-	
-	// Initialize activity cache (30 second TTL)
-	activityCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	activityCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"activity"})
-		if err != "" {
-			return map[string]string{"error": err}
+// unlockConfig ends the cycle started by lockConfig
+func (a *App) unlockConfig() {
+	a.rollbackConfig = nil
+	a.change = configChange{}
+	a.configMutex.Unlock()
+}
+
+// writeConfig renders conf, writes it through the backend and records it
+// as a revision. The first write of a cycle remembers the previous
+// contents for restartChrony.
+func (a *App) writeConfig(conf *chronyconf.File) error {
+	previous, err := a.backend.ReadConfig()
+	if err == nil && a.rollbackConfig == nil {
+		a.rollbackConfig = previous
+	}
+	// Record the file as found if it is not the latest revision: the
+	// first time, or after an edit outside the API. Diffs are then only
+	// of the change made here.
+	if err == nil {
+		if a.revisions.Latest() == nil {
+			a.recordRevision(previous, configChange{Action: "initial"})
+		} else {
+			a.recordRevision(previous, configChange{Action: "external", Reason: "changed outside the API"})
 		}
-		return parseActivityOutput(output)
-	}
-	
-	// Initialize server mode cache (5 second TTL)
-	serverModeCache = &CachedData{
-		TTL: 5 * time.Second,
-	}
-	serverModeCache.fetchData = func() interface{} {
-		return getServerModeStatus()
 	}
 	
-	// Initialize clients cache (30 second TTL)
-	clientsCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	clientsCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"clients"})
-		if err != "" {
-			return []map[string]string{}
-		}
-		return parseClientsOutput(output)
+	content := conf.Bytes()
+	if err := a.backend.WriteConfig(content); err != nil {
+		return err
 	}
-	
-	cacheInitialized = true
+	a.recordRevision(content, a.change)
+	return nil
 }
 
-// Invalidate all caches to force refresh
-func invalidateCaches() {
-	if !cacheInitialized {
+// recordRevision adds content to the revision history unless it is the
+// same as the latest revision
+func (a *App) recordRevision(content []byte, change configChange) {
+	if latest := a.revisions.Latest(); latest != nil && latest.Content == string(content) {
 		return
 	}
-	
-	// Invalidate tracking cache
-	if trackingCache != nil {
-		trackingCache.mutex.Lock()
-		trackingCache.Timestamp = time.Time{} // Force refresh
-		trackingCache.mutex.Unlock()
-	}
-	
-	// Invalidate sources cache
-	if sourcesCache != nil {
-		sourcesCache.mutex.Lock()
-		sourcesCache.Timestamp = time.Time{} // Force refresh
-		sourcesCache.mutex.Unlock()
-	}
-	
-	// Invalidate activity cache
-	if activityCache != nil {
-		activityCache.mutex.Lock()
-		activityCache.Timestamp = time.Time{} // Force refresh
-		activityCache.mutex.Unlock()
-	}
-	
-	// Invalidate server mode cache
-	if serverModeCache != nil {
-		serverModeCache.mutex.Lock()
-		serverModeCache.Timestamp = time.Time{} // Force refresh
-		serverModeCache.mutex.Unlock()
-	}
-	
-	// Invalidate clients cache
-	if clientsCache != nil {
-		clientsCache.mutex.Lock()
-		clientsCache.Timestamp = time.Time{} // Force refresh
-		clientsCache.mutex.Unlock()
+	_, err := a.revisions.Add(ConfigRevision{
+		Subject: change.Subject,
+		Action:  change.Action,
+		Reason:  change.Reason,
+		Content: string(content),
+	})
+	if err != nil {
+		log.Printf("Failed to record chrony.conf revision: %v", err)
 	}
 }
 
-// Helper function to run chronyc commands
-func runChronyc(args []string) (string, string) {
-	cmd := exec.Command("chronyc", args...)
-	output, err := cmd.CombinedOutput()
+// Helper to read the allow/deny directives of chrony.conf. Server mode is
+// on when any allow directive is active.
+func (a *App) getServerModeStatus() ServerModeResponse {
+	conf, err := a.readConfig()
 	if err != nil {
-		return "", err.Error()
+		return ServerModeResponse{Rules: []AccessRule{}}
+	}
+	return ServerModeResponse{
+		ServerModeEnabled: len(conf.Directives("allow")) > 0,
+		Rules:             accessRules(conf),
+		ServerHardening:   serverHardening(conf),
 	}
-	return strings.TrimSpace(string(output)), ""
 }
 
-// Helper to read/write allow directive in chrony.conf
-func getServerModeStatus() bool {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
-	if err != nil {
-		return false
+// restartChrony restarts chronyd through the backend and waits for it to
+// answer. If it does not, and chrony.conf was changed in the current
+// cycle, the previous file is restored and chronyd restarted with it. It
+// reports whether chronyd came up with the new configuration.
+func (a *App) restartChrony() bool {
+	err := a.restartAndWait()
+	if err == nil {
+		return true
 	}
+	log.Printf("Failed to restart chronyd: %v", err)
 	
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.TrimSpace(line) != "" && strings.HasPrefix(strings.TrimSpace(line), "allow") {
-			return true
-		}
+	if a.rollbackConfig == nil {
+		return false
+	}
+	log.Printf("Restoring previous chrony.conf")
+	if err := a.backend.WriteConfig(a.rollbackConfig); err != nil {
+		log.Printf("Failed to restore chrony.conf: %v", err)
+		return false
+	}
+	a.recordRevision(a.rollbackConfig, configChange{
+		Subject: a.change.Subject,
+		Action:  "rollback",
+		Reason:  "chronyd did not come up after " + a.change.Action,
+	})
+	a.rollbackConfig = nil
+	if err := a.restartAndWait(); err != nil {
+		log.Printf("Failed to restart chronyd with the previous chrony.conf: %v", err)
 	}
 	return false
 }
 
-// Helper function to robustly restart chrony service in Alpine/docker environments
-func restartChrony() bool {
-	// Kill all running chronyd processes
-	killCmd := exec.Command("pkill", "chronyd")
-	_ = killCmd.Run() // Ignore error if not running
-
-	// Start chronyd in the background
-	startCmd := exec.Command("chronyd", "-f", CHRONY_CONF_PATH)
-	err := startCmd.Start()
-	if err != nil {
-		log.Printf("Failed to start chronyd: %v", err)
-		return false
-	}
-	log.Printf("chronyd restarted with PID %d", startCmd.Process.Pid)
-	return true
+// writeRestartFailed responds that chrony.conf was changed but chronyd did
+// not come up with it, so restartChrony has restored the previous file if
+// it could. details is what the request would have returned.
+func writeRestartFailed(w http.ResponseWriter, details interface{}) {
+	writeError(w, http.StatusBadGateway, ERR_CHRONYD, "chronyd did not come up with the new chrony.conf", details)
 }
 
-func setServerModeStatus(enabled bool) bool {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
-	if err != nil {
-		return false
+// restartAndWait restarts chronyd and polls it until it answers a tracking
+// request or restartTimeout passes
+func (a *App) restartAndWait() error {
+	if err := a.backend.Restart(); err != nil {
+		return err
 	}
-	
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	found := false
-	
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.Contains(trimmed, "allow 0.0.0.0/0") {
-			found = true
-			if enabled {
-				// If the line is commented, uncomment it
-				if strings.HasPrefix(trimmed, "#") {
-					newLines = append(newLines, "allow 0.0.0.0/0")
-				} else {
-					newLines = append(newLines, line)
-				}
-			} else {
-				// If the line is not commented, comment it out
-				if !strings.HasPrefix(trimmed, "#") {
-					newLines = append(newLines, "#allow 0.0.0.0/0")
-				} else {
-					newLines = append(newLines, line)
-				}
-			}
-		} else {
-			newLines = append(newLines, line)
+	deadline := time.Now().Add(a.restartTimeout)
+	for {
+		_, err := a.backend.Tracking()
+		if err == nil {
+			return nil
 		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("chronyd not responding after %v: %v", a.restartTimeout, err)
+		}
+		time.Sleep(250 * time.Millisecond)
 	}
-	
-	// If enabling and not found, add the allow line
-	if enabled && !found {
-		newLines = append(newLines, "allow 0.0.0.0/0")
+}
+
+// setServerModeStatus writes the server mode change of req to chrony.conf
+// and restarts chronyd. It reports whether chronyd came up with the
+// change.
+func (a *App) setServerModeStatus(change configChange, req SetServerModeRequest) (bool, error) {
+	a.lockConfig(change)
+	defer a.unlockConfig()
+	conf, err := a.readConfig()
+	if err != nil {
+		return false, err
 	}
 	
-	newContent := strings.Join(newLines, "\n")
-	err = ioutil.WriteFile(CHRONY_CONF_PATH, []byte(newContent), 0644)
-	if err != nil {
-		return false
+	editServerMode(conf, req)
+	if err := a.writeConfig(conf); err != nil {
+		return false, err
 	}
 	
 	// Restart chrony to apply the configuration changes
-	return restartChrony()
+	return a.restartChrony(), nil
 }
 
-func parseSourcesOutput(output string) []map[string]string {
-	lines := strings.Split(output, "\n")
-	var sources []map[string]string
-	headerFound := false
-	
-	for _, line := range lines {
-		if !headerFound {
-			if strings.TrimSpace(line) == "===============================================================================" {
-				headerFound = true
-			}
-			continue
-		}
-		
-		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "===============================================================================" {
-			continue
-		}
-		
-		// Example line: ^* 202.118.1.130                 2   6   377    19   +625ms[ -117ms] +/-   25ms
-		parts := regexp.MustCompile(`\s+`).Split(strings.TrimSpace(line), -1)
-		if len(parts) >= 6 {
-			source := map[string]string{
-				"state":  parts[0],
-				"name":   parts[1],
-				"stratum": parts[2],
-				"poll":   parts[3],
-				"reach":  parts[4],
-				"lastrx": parts[5],
-				"raw":    line,
-			}
-			
-			// Parse offset if available (format: +625ms[ -117ms] +/-   25ms)
-			if len(parts) >= 6 {
-				offsetPart := parts[6]
-				// Extract offset value (e.g., +625ms)
-				offsetMatch := regexp.MustCompile(`^([+-]\d+ms)`).FindStringSubmatch(offsetPart)
-				if len(offsetMatch) > 1 {
-					source["offset"] = offsetMatch[1]
-				}
-				
-				// Extract delay if available
-				if len(parts) >= 8 {
-					delayPart := parts[8]
-					delayMatch := regexp.MustCompile(`^([+-]\d+ms)`).FindStringSubmatch(delayPart)
-					if len(delayMatch) > 1 {
-						source["delay"] = delayMatch[1]
-					}
-				}
-			}
-			
-			sources = append(sources, source)
-		}
+// editServerMode applies req to conf. Rules replace every allow and deny
+// directive. Otherwise enabling uncomments (or adds) "allow 0.0.0.0/0"
+// when nothing is allowed yet, and disabling comments out every allow
+// directive. The hardening settings are applied after that.
+func editServerMode(conf *chronyconf.File, req SetServerModeRequest) {
+	defer editHardening(conf, &req.ServerHardening, req.set)
+	if req.Rules != nil {
+		replaceAccessRules(conf, req.Rules)
+		return
 	}
-	return sources
-}
-
-func parseTrackingOutput(output string) map[string]string {
-	result := make(map[string]string)
-	lines := strings.Split(output, "\n")
-	
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				
-				// Map the keys to match what the frontend expects
-				switch key {
-				case "Reference ID":
-					result["ReferenceID"] = value
-				case "Stratum":
-					result["Stratum"] = value
-				case "Ref time (UTC)":
-					result["Ref time (UTC)"] = value
-				case "System time":
-					result["System time"] = value
-				case "Last offset":
-					result["Last offset"] = value
-				case "RMS offset":
-					result["RMS offset"] = value
-				case "Frequency":
-					result["Frequency"] = value
-				case "Residual freq":
-					result["Residual freq"] = value
-				case "Skew":
-					result["Skew"] = value
-				case "Root delay":
-					result["Root delay"] = value
-				case "Root dispersion":
-					result["Root dispersion"] = value
-				case "Update interval":
-					result["Update interval"] = value
-					// Also set UpdateRate for backward compatibility
-					result["UpdateRate"] = value
-				case "Leap status":
-					result["Leap status"] = value
-					// Also set LeapStatus for backward compatibility
-					result["LeapStatus"] = value
-				default:
-					result[key] = value
+	if req.Enabled == nil {
+		return
+	}
+	if *req.Enabled {
+		if len(conf.Directives("allow")) == 0 {
+			uncommented := false
+			for _, line := range conf.CommentedOut("allow") {
+				if d := line.CommentedDirective(); len(d.Args) == 1 && d.Args[0] == "0.0.0.0/0" {
+					conf.Uncomment(line)
+					uncommented = true
+					break
 				}
 			}
+			if !uncommented {
+				conf.Append(chronyconf.NewDirective("allow", "0.0.0.0/0"))
+			}
+		}
+	} else {
+		for _, d := range conf.Directives("allow") {
+			conf.CommentOut(d)
 		}
 	}
-	return result
 }
 
-func parseActivityOutput(output string) map[string]string {
-	result := make(map[string]string)
-	lines := strings.Split(output, "\n")
-	
-	for _, line := range lines {
-		if strings.Contains(line, "sources") {
-			// Parse lines like "1 sources online", "0 sources offline", etc.
-			parts := strings.Fields(line)
-			if len(parts) >= 3 {
-				count := parts[0]
-				status := parts[2]
-				switch status {
-				case "online":
-					result["ok_count"] = count
-				case "offline":
-					result["failed_count"] = count
-				case "doing burst (return to online)":
-					result["bogus_count"] = count
-				case "doing burst (return to offline)":
-					result["timeout_count"] = count
-				}
-			}
-		}
+// isDryRun reports whether the request asks for ?dry_run=true
+func isDryRun(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("dry_run")
+	if s == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry_run %q", s)
 	}
-	return result
+	return dryRun, nil
 }
 
-func parseClientsOutput(output string) []map[string]string {
-	lines := strings.Split(output, "\n")
-	var clients []map[string]string
-	headerFound := false
+// dryRunConfig responds with what edit would do to chrony.conf, without
+// writing it or touching chronyd: the proposed file, its diff against the
+// current one and the problems chronyconf validation finds in it
+func (a *App) dryRunConfig(w http.ResponseWriter, edit func(conf *chronyconf.File)) {
+	current, err := a.backend.ReadConfig()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to read chrony.conf: "+err.Error(), nil)
+		return
+	}
+	conf := chronyconf.Parse(current)
+	edit(conf)
+	proposed := conf.Bytes()
 	
-	for _, line := range lines {
-		if !headerFound {
-			if strings.TrimSpace(line) == "===============================================================================" {
-				headerFound = true
-			}
-			continue
-		}
-		
-		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "===============================================================================" {
-			continue
-		}
-		
-		// Parse client line (format may vary)
-		parts := regexp.MustCompile(`\s+`).Split(strings.TrimSpace(line), -1)
-		if len(parts) >= 2 {
-			client := map[string]string{
-				"address": parts[0],
-				"raw":     line,
-			}
-			
-			// Try to parse additional fields if available
-			if len(parts) >= 3 {
-				client["ntp_packets"] = parts[1]
-			}
-			if len(parts) >= 4 {
-				client["ntp_dropped"] = parts[2]
-			}
-			if len(parts) >= 5 {
-				client["offset"] = parts[3]
-			}
-			
-			clients = append(clients, client)
-		}
+	errs := []string{}
+	for _, e := range conf.Validate() {
+		errs = append(errs, e.Error())
+	}
+	response := map[string]interface{}{
+		"dry_run": true,
+		"valid":   len(errs) == 0,
+		"errors":  errs,
+		"diff":    chronyconf.UnifiedDiff("chrony.conf", "chrony.conf (proposed)", current, proposed),
+		"config":  string(proposed),
 	}
-	return clients
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // Helper function to load build info
@@ -570,7 +460,11 @@ func getClaimsFromRequest(r *http.Request) (map[string]interface{}, error) {
 	if !strings.HasPrefix(authHeader, "Bearer ") {
 		return nil, fmt.Errorf("missing or invalid Authorization header")
 	}
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	return parseToken(strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+// parseToken verifies an RS256 JWT and returns its claims
+func parseToken(tokenStr string) (map[string]interface{}, error) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method")
@@ -590,7 +484,7 @@ func getClaimsFromRequest(r *http.Request) (map[string]interface{}, error) {
 // API Handlers
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
@@ -609,7 +503,7 @@ func handleVersion(w http.ResponseWriter, r *http.Request) {
 
 func handleAppVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
@@ -624,381 +518,1137 @@ func handleAppVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleStatus(w http.ResponseWriter, r *http.Request) {
+func (a *App) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 
-	initializeCaches()
+	// Every section comes from the same snapshot
+	snap := a.collector.Snapshot()
+	response := statusResponse(snap, statusFlags(r), schemaV2(r))
+
+	setSnapshotAge(w, snap)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
+// statusFlags returns the sections selected by ?flags=, all by default
+func statusFlags(r *http.Request) int {
 	flags := STATUS_ALL
 	if flagStr := r.URL.Query().Get("flags"); flagStr != "" {
 		if parsed, err := strconv.Atoi(flagStr); err == nil {
 			flags = parsed
 		}
 	}
+	return flags
+}
 
-	response := make(map[string]interface{})
+// statusResponse builds the /status body: the sections of snap selected by
+// flags
+func statusResponse(snap *Snapshot, flags int, v2 bool) map[string]interface{} {
+	response := map[string]interface{}{
+		"snapshot_time":        snap.Time,
+		"snapshot_age_seconds": snap.Age().Seconds(),
+	}
 
 	if flags&STATUS_TRACKING != 0 {
-		trackingData := trackingCache.Get()
-		tracking, ok := trackingData.(map[string]string)
-		if !ok {
-			tracking = map[string]string{"error": "Failed to parse tracking data"}
-		}
-		response["tracking"] = tracking
+		addTracking(response, snap, v2)
 	}
 
 	if flags&STATUS_SOURCES != 0 {
-		sourcesData := sourcesCache.Get()
-		sources, ok := sourcesData.([]map[string]string)
-		if !ok {
-			sources = []map[string]string{}
-		}
-		response["sources"] = sources
+		addSources(response, snap, v2)
+	}
+
+	if flags&STATUS_SOURCESTATS != 0 {
+		addSourceStats(response, snap)
 	}
 
 	if flags&STATUS_ACTIVITY != 0 {
-		activityData := activityCache.Get()
-		activity, ok := activityData.(map[string]string)
-		if !ok {
-			activity = map[string]string{"error": "Failed to parse activity data"}
-		}
-		response["activity"] = activity
+		addActivity(response, snap, v2)
 	}
 
 	if flags&STATUS_CLIENTS != 0 {
-		clientsData := clientsCache.Get()
-		clients, ok := clientsData.([]map[string]string)
-		if !ok {
-			clients = []map[string]string{}
-		}
-		response["clients"] = clients
+		addClients(response, snap, v2, ClientQuery{})
 	}
 
 	if flags&STATUS_SERVER_MODE != 0 {
-		serverModeData := serverModeCache.Get()
-		enabled, ok := serverModeData.(bool)
-		if !ok {
-			enabled = false
+		response["server_mode_enabled"] = snap.ServerMode.ServerModeEnabled
+	}
+	return response
+}
+
+// setSnapshotAge sets the standard Age header to how old the status
+// snapshot behind the response is, in whole seconds
+func setSnapshotAge(w http.ResponseWriter, snap *Snapshot) {
+	w.Header().Set("Age", strconv.Itoa(int(snap.Age().Seconds())))
+}
+
+// schemaV2 reports whether the caller asked for typed responses, either
+// with ?schema=v2 or through the /v2/ routes
+func schemaV2(r *http.Request) bool {
+	return r.URL.Query().Get("schema") == "v2" || strings.HasPrefix(r.URL.Path, "/v2/")
+}
+
+// addTracking adds the tracking report to response. v1 keeps the
+// chronyc-style string map; v2 returns Tracking and reports failures in
+// tracking_error.
+func addTracking(response map[string]interface{}, snap *Snapshot, v2 bool) {
+	switch tracking := snap.Tracking.(type) {
+	case *Tracking:
+		if v2 {
+			response["tracking"] = tracking
+		} else {
+			response["tracking"] = tracking.legacyMap()
+		}
+	case error:
+		if v2 {
+			response["tracking"] = nil
+			response["tracking_error"] = tracking.Error()
+		} else {
+			response["tracking"] = map[string]string{"error": tracking.Error()}
 		}
-		response["server_mode_enabled"] = enabled
+	default:
+		response["tracking"] = map[string]string{"error": "Failed to parse tracking data"}
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// addSources adds the sources to response. v1 keeps the chronyc
+// column strings and returns an empty list on failure; v2 returns Source
+// values and reports failures in sources_error.
+func addSources(response map[string]interface{}, snap *Snapshot, v2 bool) {
+	switch sources := snap.Sources.(type) {
+	case []Source:
+		if v2 {
+			response["sources"] = sources
+			return
+		}
+		legacy := make([]map[string]string, 0, len(sources))
+		for i := range sources {
+			legacy = append(legacy, sources[i].legacyMap())
+		}
+		response["sources"] = legacy
+	case error:
+		if v2 {
+			response["sources"] = nil
+			response["sources_error"] = sources.Error()
+		} else {
+			response["sources"] = []map[string]string{}
+		}
+	default:
+		response["sources"] = []map[string]string{}
+	}
 }
 
-func handleTracking(w http.ResponseWriter, r *http.Request) {
+func (a *App) handleTracking(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
-	
-	// Initialize caches if not already done
-	initializeCaches()
-	
-	// Get tracking data from cache
-	trackingData := trackingCache.Get()
-	tracking, ok := trackingData.(map[string]string)
-	if !ok {
-		tracking = map[string]string{"error": "Failed to parse tracking data"}
+	snap := a.collector.Snapshot()
+	if err, ok := snap.Tracking.(error); ok {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get tracking: "+err.Error(), nil)
+		return
 	}
 	
-	response := map[string]interface{}{
-		"tracking": tracking,
-	}
+	response := make(map[string]interface{})
+	addTracking(response, snap, schemaV2(r))
+	
+	setSnapshotAge(w, snap)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleSources(w http.ResponseWriter, r *http.Request) {
+func (a *App) handleSources(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
-	
-	// Initialize caches if not already done
-	initializeCaches()
-	
-	// Get sources data from cache
-	sourcesData := sourcesCache.Get()
-	sources, ok := sourcesData.([]map[string]string)
-	if !ok {
-		sources = []map[string]string{}
+	snap := a.collector.Snapshot()
+	if err, ok := snap.Sources.(error); ok {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get sources: "+err.Error(), nil)
+		return
 	}
 	
-	response := map[string]interface{}{
-		"sources": sources,
-	}
+	response := make(map[string]interface{})
+	addSources(response, snap, schemaV2(r))
+	
+	setSnapshotAge(w, snap)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleActivity(w http.ResponseWriter, r *http.Request) {
+// handleSourceDetail serves /status/sources/{name}: the source's row
+// merged with its sourcestats, ntpdata and selectdata.
+func (a *App) handleSourceDetail(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
-	
-	// Initialize caches if not already done
-	initializeCaches()
-	
-	// Get activity data from cache
-	activityData := activityCache.Get()
-	activity, ok := activityData.(map[string]string)
-	if !ok {
-		activity = map[string]string{"error": "Failed to parse activity data"}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v2"), "/status/sources/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "Source name required", nil)
+		return
 	}
-	
-	response := map[string]interface{}{
-		"activity": activity,
+
+	snap := a.collector.Snapshot()
+	var source *Source
+	switch sources := snap.Sources.(type) {
+	case []Source:
+		for i := range sources {
+			if sources[i].Name == name {
+				source = &sources[i]
+				break
+			}
+		}
+	case error:
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get sources: "+sources.Error(), nil)
+		return
 	}
-	
+	if source == nil {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Source not found", nil)
+		return
+	}
+
+	detail := SourceDetail{Source: source}
+	if !schemaV2(r) {
+		detail.Source = source.legacyMap()
+	}
+
+	switch stats := snap.SourceStats.(type) {
+	case []SourceStats:
+		for i := range stats {
+			if stats[i].Name == name {
+				detail.SourceStats = &stats[i]
+				break
+			}
+		}
+	case error:
+		detail.SourceStatsError = stats.Error()
+	}
+
+	// Reference clocks are not NTP sources
+	if source.Mode != SourceModeRefclock {
+		ntpData, err := a.backend.NTPData(name)
+		if err != nil {
+			detail.NTPDataError = err.Error()
+		} else {
+			detail.NTPData = ntpData
+		}
+	}
+
+	selects, err := a.backend.SelectData()
+	if err != nil {
+		detail.SelectDataError = err.Error()
+	} else {
+		for i := range selects {
+			if selects[i].Name == name {
+				detail.SelectData = &selects[i]
+				break
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(detail)
 }
 
-func handleClients(w http.ResponseWriter, r *http.Request) {
+// addSourceStats adds the sourcestats to response. The numbers are
+// typed in both schemas; failures are reported in sourcestats_error.
+func addSourceStats(response map[string]interface{}, snap *Snapshot) {
+	switch stats := snap.SourceStats.(type) {
+	case []SourceStats:
+		response["sourcestats"] = stats
+	case error:
+		response["sourcestats"] = nil
+		response["sourcestats_error"] = stats.Error()
+	default:
+		response["sourcestats"] = nil
+		response["sourcestats_error"] = "Failed to parse sourcestats data"
+	}
+}
+
+func (a *App) handleSourceStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
-	
-	// Initialize caches if not already done
-	initializeCaches()
-	
-	// Get clients data from cache
-	clientsData := clientsCache.Get()
-	clients, ok := clientsData.([]map[string]string)
-	if !ok {
-		clients = []map[string]string{}
+	snap := a.collector.Snapshot()
+	if err, ok := snap.SourceStats.(error); ok {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get sourcestats: "+err.Error(), nil)
+		return
 	}
 	
-	response := map[string]interface{}{
-		"clients": clients,
-	}
+	response := make(map[string]interface{})
+	addSourceStats(response, snap)
+	
+	setSnapshotAge(w, snap)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// Helper to update server list in chrony.conf
-func updateChronyConfServers(servers []string) error {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
-	if err != nil {
-		return err
-	}
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if !strings.HasPrefix(trimmed, "server ") {
-			newLines = append(newLines, line)
+// addActivity adds the activity report to response. v1 keeps the
+// legacy string map; v2 returns Activity and reports failures in
+// activity_error.
+func addActivity(response map[string]interface{}, snap *Snapshot, v2 bool) {
+	switch activity := snap.Activity.(type) {
+	case *Activity:
+		if v2 {
+			response["activity"] = activity
+		} else {
+			response["activity"] = activity.legacyMap()
 		}
+	case error:
+		if v2 {
+			response["activity"] = nil
+			response["activity_error"] = activity.Error()
+		} else {
+			response["activity"] = map[string]string{"error": activity.Error()}
+		}
+	default:
+		response["activity"] = map[string]string{"error": "Failed to parse activity data"}
 	}
-	// Add new server lines
-	for _, server := range servers {
-		newLines = append(newLines, "server "+server+" iburst")
-	}
-	// Ensure there's an empty line at the end
-	newLines = append(newLines, "")
-	newContent := strings.Join(newLines, "\n")
-	return ioutil.WriteFile(CHRONY_CONF_PATH, []byte(newContent), 0644)
 }
 
-// Helper to read configured servers from chrony.conf
-func getConfiguredServers() []string {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
-	if err != nil {
-		return []string{}
+func (a *App) handleActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
 	}
-	
-	lines := strings.Split(string(content), "\n")
-	var servers []string
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, "server ") {
-			// Extract server name from "server pool.ntp.org iburst"
-			parts := strings.Fields(trimmed)
-			if len(parts) >= 2 {
-				servers = append(servers, parts[1])
-			}
-		}
+	snap := a.collector.Snapshot()
+	if err, ok := snap.Activity.(error); ok {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get activity: "+err.Error(), nil)
+		return
 	}
-	return servers
+	
+	response := make(map[string]interface{})
+	addActivity(response, snap, schemaV2(r))
+	
+	setSnapshotAge(w, snap)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func handleServers(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		_, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+// addClients adds the client table, filtered and ordered by query,
+// to response. v1 keeps string maps and returns an empty list on failure;
+// v2 returns Client values and reports failures in clients_error.
+func addClients(response map[string]interface{}, snap *Snapshot, v2 bool, query ClientQuery) {
+	switch clients := snap.Clients.(type) {
+	case []Client:
+		clients = query.Apply(clients)
+		if v2 {
+			response["clients"] = clients
 			return
 		}
-		// Return configured servers from chrony.conf, not active sources
-		configuredServers := getConfiguredServers()
-		response := map[string]interface{}{
-			"servers": configuredServers,
+		legacy := make([]map[string]string, 0, len(clients))
+		for i := range clients {
+			legacy = append(legacy, clients[i].legacyMap())
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		
-	case http.MethodPut:
-		claims, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
+		response["clients"] = legacy
+	case error:
+		if v2 {
+			response["clients"] = nil
+			response["clients_error"] = clients.Error()
+		} else {
+			response["clients"] = []map[string]string{}
+		}
+	default:
+		response["clients"] = []map[string]string{}
+	}
+}
+
+func (a *App) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	query, err := parseClientQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+		return
+	}
+	snap := a.collector.Snapshot()
+	if err, ok := snap.Clients.(error); ok {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get clients: "+err.Error(), nil)
+		return
+	}
+	
+	response := make(map[string]interface{})
+	addClients(response, snap, schemaV2(r), query)
+	
+	setSnapshotAge(w, snap)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Helper to update server list in chrony.conf. It returns the directives
+// that were replaced.
+func (a *App) updateChronyConfServers(servers []ServerConfig) ([]*chronyconf.Directive, error) {
+	conf, err := a.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	existing := replaceServers(conf, servers)
+	return existing, a.writeConfig(conf)
+}
+
+// replaceServers replaces every server, pool and peer directive of conf
+// with servers, at the position of the first one, and returns the
+// directives it replaced
+func replaceServers(conf *chronyconf.File, servers []ServerConfig) []*chronyconf.Directive {
+	var ds []*chronyconf.Directive
+	for i := range servers {
+		ds = append(ds, servers[i].Directive())
+	}
+	return conf.Replace(ds, chronyconf.SourceDirectives...)
+}
+
+// setServers writes servers to chrony.conf and applies the difference to
+// the running chronyd. It reports whether chronyd had to be restarted and
+// whether it now runs the new sources.
+func (a *App) setServers(change configChange, servers []ServerConfig) (restarted bool, success bool, err error) {
+	a.lockConfig(change)
+	defer a.unlockConfig()
+	prev, err := a.updateChronyConfServers(servers)
+	if err != nil {
+		return false, false, err
+	}
+	next := make([]*chronyconf.Directive, 0, len(servers))
+	for i := range servers {
+		next = append(next, servers[i].Directive())
+	}
+	restarted, success = a.applySourceChanges(prev, next)
+	return restarted, success, nil
+}
+
+var (
+	errServerExists   = errors.New("server already configured")
+	errServerNotFound = errors.New("server not configured")
+)
+
+// addServer adds one server, pool or peer after the configured ones, in
+// chrony.conf and in the running chronyd. A host can only be configured
+// once.
+func (a *App) addServer(change configChange, server ServerConfig) (restarted bool, success bool, err error) {
+	a.lockConfig(change)
+	defer a.unlockConfig()
+	conf, err := a.readConfig()
+	if err != nil {
+		return false, false, err
+	}
+	existing := conf.Sources()
+	for _, d := range existing {
+		if d.Host() == server.Host {
+			return false, false, errServerExists
+		}
+	}
+	d := server.Directive()
+	if len(existing) > 0 {
+		conf.InsertAfter(existing[len(existing)-1], d)
+	} else {
+		conf.Append(d)
+	}
+	if err := a.writeConfig(conf); err != nil {
+		return false, false, err
+	}
+	restarted, success = a.applySourceChanges(nil, []*chronyconf.Directive{d})
+	return restarted, success, nil
+}
+
+// removeServer removes the server, pool or peer directives for host from
+// chrony.conf and the running chronyd, and returns what was removed.
+func (a *App) removeServer(change configChange, host string) (removed []ServerConfig, restarted bool, success bool, err error) {
+	a.lockConfig(change)
+	defer a.unlockConfig()
+	conf, err := a.readConfig()
+	if err != nil {
+		return nil, false, false, err
+	}
+	var prev []*chronyconf.Directive
+	for _, d := range conf.Sources() {
+		if d.Host() == host {
+			prev = append(prev, d)
+			removed = append(removed, serverConfigFromDirective(d))
+			conf.Remove(d)
+		}
+	}
+	if len(prev) == 0 {
+		return nil, false, false, errServerNotFound
+	}
+	if err := a.writeConfig(conf); err != nil {
+		return nil, false, false, err
+	}
+	restarted, success = a.applySourceChanges(prev, nil)
+	return removed, restarted, success, nil
+}
+
+// applySourceChanges moves the running chronyd from the sources in prev to
+// those in next without restarting it: sources that are gone or whose
+// options changed are deleted, new ones are added. If that fails chronyd
+// is restarted to load chrony.conf, which must already hold next.
+func (a *App) applySourceChanges(prev, next []*chronyconf.Directive) (restarted bool, success bool) {
+	inPrev := make(map[string]bool)
+	for _, d := range prev {
+		inPrev[d.String()] = true
+	}
+	inNext := make(map[string]bool)
+	for _, d := range next {
+		inNext[d.String()] = true
+	}
+	
+	err := func() error {
+		for _, d := range prev {
+			if !inNext[d.String()] {
+				if err := a.backend.DeleteSource(d.Host()); err != nil {
+					return fmt.Errorf("delete %s: %v", d.Host(), err)
+				}
+			}
+		}
+		for _, d := range next {
+			if !inPrev[d.String()] {
+				if err := a.backend.AddSource(d); err != nil {
+					return fmt.Errorf("add %s: %v", d, err)
+				}
+			}
+		}
+		return nil
+	}()
+	if err == nil {
+		return false, true
+	}
+	
+	log.Printf("Cannot apply source changes at runtime, restarting chronyd: %v", err)
+	return true, a.restartChrony()
+}
+
+// Helper to read configured servers, pools and peers from chrony.conf
+func (a *App) getConfiguredServers() []ServerConfig {
+	conf, err := a.readConfig()
+	if err != nil {
+		return []ServerConfig{}
+	}
+	
+	servers := []ServerConfig{}
+	for _, d := range conf.Sources() {
+		if d.Host() != "" {
+			servers = append(servers, serverConfigFromDirective(d))
+		}
+	}
+	return servers
+}
+
+func (a *App) handleServers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		_, err := getClaimsFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+			return
+		}
+		// Return configured servers from chrony.conf, not active sources
+		configuredServers := a.getConfiguredServers()
+		response := map[string]interface{}{
+			"servers": configuredServers,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		
+	case http.MethodPut:
+		claims, err := getClaimsFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+			return
 		}
 		if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+			writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/servers"})
 			return
 		}
 		var req SetServersRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
 			return
 		}
-		if len(req.Servers) == 0 {
-			http.Error(w, "servers must be a non-empty list", http.StatusBadRequest)
+		if err := req.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), fieldDetails(err))
 			return
 		}
-		// Update chrony.conf with new servers
-		err = updateChronyConfServers(req.Servers)
+		dryRun, err := isDryRun(r)
 		if err != nil {
-			http.Error(w, "Failed to update chrony.conf: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
 			return
 		}
-		// Restart chrony to apply the configuration changes
-		restartSuccess := restartChrony()
-		// Invalidate caches after configuration change
-		invalidateCaches()
+		if dryRun {
+			a.dryRunConfig(w, func(conf *chronyconf.File) {
+				replaceServers(conf, req.Servers)
+			})
+			return
+		}
+		// Update chrony.conf with new servers and apply them to chronyd
+		restarted, restartSuccess, err := a.setServers(configChangeFromRequest(r, claims), req.Servers)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+			return
+		}
+		// Refresh the status after configuration change
+		a.refreshStatus()
 		response := map[string]interface{}{
 			"result": req.Servers,
+			"restarted": restarted,
+			"restart_success": restartSuccess,
+		}
+		if !restartSuccess {
+			writeRestartFailed(w, response)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		
+	case http.MethodPost:
+		claims, err := getClaimsFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+			return
+		}
+		if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
+			writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/servers"})
+			return
+		}
+		var server ServerConfig
+		if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if err := server.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+			return
+		}
+		restarted, restartSuccess, err := a.addServer(configChangeFromRequest(r, claims), server)
+		if err == errServerExists {
+			writeError(w, http.StatusConflict, ERR_CONFLICT, "Server already configured: "+server.Host, nil)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+			return
+		}
+		// Refresh the status after configuration change
+		a.refreshStatus()
+		response := map[string]interface{}{
+			"result": server,
+			"restarted": restarted,
 			"restart_success": restartSuccess,
 		}
+		if !restartSuccess {
+			writeRestartFailed(w, response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(response)
 		
 	case http.MethodDelete:
 		claims, err := getClaimsFromRequest(r)
 		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
 			return
 		}
 		if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+			writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/servers"})
+			return
+		}
+		// Remove the sources from chrony.conf, then from the running chronyd
+		a.lockConfig(configChangeFromRequest(r, claims))
+		defer a.unlockConfig()
+		if _, err := a.updateChronyConfServers(nil); err != nil {
+			writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
 			return
 		}
-		output, errStr := runChronyc([]string{"delete", "sources"})
-		// Restart chrony to apply the configuration changes
-		restartSuccess := restartChrony()
-		// Invalidate caches after configuration change
-		invalidateCaches()
+		output, err := a.backend.DeleteSources()
+		restarted := false
+		restartSuccess := true
+		if err != nil {
+			log.Printf("Cannot delete sources at runtime, restarting chronyd: %v", err)
+			// Restart chrony so it loads the source-less configuration
+			restarted = true
+			restartSuccess = a.restartChrony()
+		}
+		// Refresh the status after configuration change
+		a.refreshStatus()
 		response := map[string]interface{}{
 			"output": output,
-			"error":  errStr,
+			"restarted": restarted,
 			"restart_success": restartSuccess,
 		}
+		if !restartSuccess {
+			response["delete_error"] = err.Error()
+			writeRestartFailed(w, response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 	}
 }
 
-func handleDefaultServers(w http.ResponseWriter, r *http.Request) {
+// handleServer removes a single server, pool or peer: DELETE /servers/{host}
+func (a *App) handleServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	claims, err := getClaimsFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
+		writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/servers"})
+		return
+	}
+
+	host := strings.TrimPrefix(r.URL.Path, "/servers/")
+	if host == "" {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "Server host required", nil)
+		return
+	}
+
+	removed, restarted, restartSuccess, err := a.removeServer(configChangeFromRequest(r, claims), host)
+	if err == errServerNotFound {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Server not found", nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+		return
+	}
+
+	// Refresh the status after configuration change
+	a.refreshStatus()
+
+	response := map[string]interface{}{
+		"result": removed,
+		"restarted": restarted,
+		"restart_success": restartSuccess,
+	}
+	if !restartSuccess {
+		writeRestartFailed(w, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleConfigRevisions lists the chrony.conf revisions, newest first
+func (a *App) handleConfigRevisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	if _, err := getClaimsFromRequest(r); err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+
+	response := map[string]interface{}{
+		"revisions": a.revisions.List(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleConfigRevision serves GET /config/revisions/{id}, the revision
+// with a diff against the one before it, and POST
+// /config/revisions/{id}/revert
+func (a *App) handleConfigRevision(w http.ResponseWriter, r *http.Request) {
+	id, action, err := revisionPath(r.URL.Path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, err.Error(), nil)
+		return
+	}
+	
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		if _, err := getClaimsFromRequest(r); err != nil {
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+			return
+		}
+		rev, previous := a.revisions.Get(id)
+		if rev == nil {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Revision not found", nil)
+			return
+		}
+		oldName, oldContent := "/dev/null", ""
+		if previous != nil {
+			oldName, oldContent = fmt.Sprintf("revision %d", previous.ID), previous.Content
+		}
+		response := map[string]interface{}{
+			"revision": rev,
+			"diff":     chronyconf.UnifiedDiff(oldName, fmt.Sprintf("revision %d", rev.ID), []byte(oldContent), []byte(rev.Content)),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		
+	case action == "revert" && r.Method == http.MethodPost:
+		claims, err := getClaimsFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+			return
+		}
+		if permissionCheckEnabled && !hasPermission(claims, "clock/config") {
+			writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/config"})
+			return
+		}
+		change := configChangeFromRequest(r, claims)
+		if change.Reason == "" {
+			change.Reason = fmt.Sprintf("revert to revision %d", id)
+		}
+		a.lockConfig(change)
+		defer a.unlockConfig()
+		
+		rev, _ := a.revisions.Get(id)
+		if rev == nil {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Revision not found", nil)
+			return
+		}
+		if err := a.writeConfig(chronyconf.Parse([]byte(rev.Content))); err != nil {
+			writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+			return
+		}
+		// Any directive may have changed, so chronyd has to reload the file
+		restartSuccess := a.restartChrony()
+		a.refreshStatus()
+		
+		latest := a.revisions.Latest()
+		latest.Content = ""
+		response := map[string]interface{}{
+			"revision":        latest,
+			"restart_success": restartSuccess,
+		}
+		if !restartSuccess {
+			writeRestartFailed(w, response)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		
+	case action == "" || action == "revert":
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		
+	default:
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Not found", nil)
+	}
+}
+
+func (a *App) handleDefaultServers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	claims, err := getClaimsFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
+		writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/servers"})
 		return
 	}
 
-	// Persist default server to chrony.conf
-	err := updateChronyConfServers([]string{DEFAULT_SERVERS})
+	servers := []ServerConfig{{Type: "server", Host: DEFAULT_SERVERS, IBurst: true}}
+	dryRun, err := isDryRun(r)
 	if err != nil {
-		http.Error(w, "Failed to update chrony.conf: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+		return
+	}
+	if dryRun {
+		a.dryRunConfig(w, func(conf *chronyconf.File) {
+			replaceServers(conf, servers)
+		})
 		return
 	}
 
-	// Restart chrony to apply the configuration changes
-	restartSuccess := restartChrony()
+	// Persist default server to chrony.conf and apply it to chronyd
+	restarted, restartSuccess, err := a.setServers(configChangeFromRequest(r, claims), servers)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+		return
+	}
 
-	// Invalidate caches after configuration change
-	invalidateCaches()
+	// Refresh the status after configuration change
+	a.refreshStatus()
 
 	response := map[string]interface{}{
-		"result": []string{DEFAULT_SERVERS},
+		"result": servers,
+		"restarted": restarted,
 		"restart_success": restartSuccess,
 	}
+	if !restartSuccess {
+		writeRestartFailed(w, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleDaemon reports on the chronyd process: its PID, uptime and how
+// often the supervisor restarted it
+func (a *App) handleDaemon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	if _, err := getClaimsFromRequest(r); err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	status, err := a.backend.Daemon()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to get chronyd status: "+err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleDaemonActions lists the daemon actions with the permission each
+// needs, and the audit records of the actions run so far, newest first
+func (a *App) handleDaemonActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	if _, err := getClaimsFromRequest(r); err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	response := map[string]interface{}{
+		"actions": daemonActionPermissions,
+		"audit":   a.audit.List(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleDaemonAction runs POST /daemon/actions/{action} on chronyd and
+// records it in the audit log, whether it succeeds or not
+func (a *App) handleDaemonAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	claims, err := getClaimsFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/daemon/actions/")
+	perm, ok := daemonActionPermissions[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Unknown action: "+name, map[string]interface{}{"actions": daemonActionNames()})
+		return
+	}
+	if permissionCheckEnabled && !hasPermission(claims, perm) {
+		writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": perm})
+		return
+	}
+	// The body with the parameters is optional
+	var action DaemonAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+		return
+	}
+	action.Action = name
+	if err := action.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+		return
+	}
+	
+	record, output, err := a.runDaemonAction(configChangeFromRequest(r, claims), action)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, ERR_CHRONYD, "Failed to run "+name+": "+err.Error(), map[string]interface{}{"audit_id": record.ID})
+		return
+	}
+	
+	response := map[string]interface{}{
+		"action":   name,
+		"output":   output,
+		"audit_id": record.ID,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// runDaemonAction runs action on chronyd and records it in the audit log,
+// whether it succeeds or not
+func (a *App) runDaemonAction(change configChange, action DaemonAction) (AuditRecord, string, error) {
+	output, err := a.backend.RunAction(action)
+	record := AuditRecord{
+		Subject: change.Subject,
+		Request: action,
+		Reason:  change.Reason,
+		Success: err == nil,
+		Output:  output,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record, auditErr := a.audit.Add(record)
+	if auditErr != nil {
+		log.Printf("Failed to write audit record: %v", auditErr)
+	}
+	// Sources may have changed state
+	a.refreshStatus()
+	return record, output, err
+}
+
+// handleTrackingHistory serves the tracking history:
+// /history/tracking?from=&to=&step=
+func (a *App) handleTrackingHistory(w http.ResponseWriter, r *http.Request) {
+	a.serveHistory(w, r, "")
+}
+
+// handleSourceHistory serves the history of one source, by the name
+// /status/sources lists it under: /history/sources/{name}?from=&to=&step=
+func (a *App) handleSourceHistory(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/history/sources/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "Source name required", nil)
+		return
+	}
+	if r.Method == http.MethodGet && !a.history.HasSource(name) {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "No history for source "+name, nil)
+		return
+	}
+	a.serveHistory(w, r, name)
+}
 
+// serveHistory responds with the history of source ("" for tracking)
+// between from (default an hour ago) and to (default now)
+func (a *App) serveHistory(w http.ResponseWriter, r *http.Request, source string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now().UTC()
+	to, err := parseHistoryTime(query.Get("to"), now, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "to: "+err.Error(), map[string]string{"field": "to"})
+		return
+	}
+	from, err := parseHistoryTime(query.Get("from"), now, to.Add(-time.Hour))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "from: "+err.Error(), map[string]string{"field": "from"})
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "from must be before to", nil)
+		return
+	}
+	step, err := parseHistoryStep(query.Get("step"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), map[string]string{"field": "step"})
+		return
+	}
+	if step > 0 && to.Sub(from)/step > historyMaxPoints {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST,
+			fmt.Sprintf("step too small: at most %d points per request", historyMaxPoints), map[string]string{"field": "step"})
+		return
+	}
+	
+	points, step := a.history.Query(source, from, to, step)
+	response := map[string]interface{}{
+		"from":              from,
+		"to":                to,
+		"step_seconds":      step.Seconds(),
+		"retention_seconds": a.history.retention.Seconds(),
+		"points":            points,
+	}
+	if source != "" {
+		response["source"] = source
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleServerMode(w http.ResponseWriter, r *http.Request) {
+func (a *App) handleServerMode(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		_, err := getClaimsFromRequest(r)
 		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
 			return
 		}
 		// No permission check for GET
-		// Initialize caches if not already done
-		initializeCaches()
-		
-		// Get server mode from cache
-		serverModeData := serverModeCache.Get()
-		enabled, ok := serverModeData.(bool)
-		if !ok {
-			enabled = false
-		}
-		
-		response := ServerModeResponse{
-			ServerModeEnabled: enabled,
-		}
+		response := a.collector.Snapshot().ServerMode
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	case http.MethodPut:
 		claims, err := getClaimsFromRequest(r)
 		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
 			return
 		}
 		if permissionCheckEnabled && !hasPermission(claims, "clock/server_mode") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+			writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/server_mode"})
 			return
 		}
 		var req SetServerModeRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if err := req.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), fieldDetails(err))
+			return
+		}
+		dryRun, err := isDryRun(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+			return
+		}
+		if dryRun {
+			a.dryRunConfig(w, func(conf *chronyconf.File) {
+				editServerMode(conf, req)
+			})
 			return
 		}
 		
-		success := setServerModeStatus(req.Enabled)
-		
-		// Invalidate server mode cache after change
-		if cacheInitialized && serverModeCache != nil {
-			serverModeCache.mutex.Lock()
-			serverModeCache.Timestamp = time.Time{} // Force refresh
-			serverModeCache.mutex.Unlock()
+		success, err := a.setServerModeStatus(configChangeFromRequest(r, claims), req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ERR_CONFIG, "Failed to update chrony.conf: "+err.Error(), nil)
+			return
 		}
 		
+		// Refresh the status after configuration change
+		mode := a.collector.Refresh().ServerMode
+		
 		response := SetServerModeResponse{
 			Success:           success,
-			ServerModeEnabled: req.Enabled,
+			ServerModeEnabled: mode.ServerModeEnabled,
+			Rules:             mode.Rules,
+			ServerHardening:   mode.ServerHardening,
+		}
+		if !success {
+			writeRestartFailed(w, response)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 	}
 }
 
@@ -1048,32 +1698,159 @@ func hasPermission(claims map[string]interface{}, perm string) bool {
 //
 // claims := getClaimsFromRequest(r) // your JWT parsing logic
 // if permissionCheckEnabled && !hasPermission(claims, "clock/server-mode") {
-//     http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+//     writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: insufficient permissions", map[string]string{"permission": "clock/server-mode"})
 //     return
 // }
 // ...proceed with the action...
 
-func main() {
-	// Define routes - Hide chrony implementation details
-	publicKey = loadPublicKey("/etc/brick/clock/public.pem") // adjust path as needed
-	http.HandleFunc("/version", handleVersion)
-	http.HandleFunc("/status", handleStatus)
-	http.HandleFunc("/status/tracking", handleTracking)
-	http.HandleFunc("/status/sources", handleSources)
-	http.HandleFunc("/status/activity", handleActivity)
-	http.HandleFunc("/status/clients", handleClients)
-	http.HandleFunc("/servers", handleServers)
-	http.HandleFunc("/servers/default", handleDefaultServers)
-	http.HandleFunc("/server-mode", handleServerMode)
+// Handler returns the API routes - Hide chrony implementation details
+func (a *App) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Every route is counted in the request metrics under its pattern
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, a.metrics.instrument(pattern, handler))
+	}
+	// Streams are counted but kept out of the latency histogram
+	handleStream := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, a.metrics.instrumentStream(pattern, handler))
+	}
+	handle("/", handleNotFound)
+	handle("/version", handleVersion)
+	handle("/status", a.handleStatus)
+	handle("/status/tracking", a.handleTracking)
+	handle("/status/sources", a.handleSources)
+	handle("/status/sources/", a.handleSourceDetail)
+	handle("/status/sourcestats", a.handleSourceStats)
+	handle("/status/activity", a.handleActivity)
+	handle("/status/clients", a.handleClients)
+	handleStream("/status/stream", a.handleStatusStream)
+	handle("/v2/status", a.handleStatus)
+	handle("/v2/status/tracking", a.handleTracking)
+	handle("/v2/status/sources", a.handleSources)
+	handle("/v2/status/sources/", a.handleSourceDetail)
+	handle("/v2/status/sourcestats", a.handleSourceStats)
+	handle("/v2/status/activity", a.handleActivity)
+	handle("/v2/status/clients", a.handleClients)
+	handleStream("/v2/status/stream", a.handleStatusStream)
+	handle("/servers", a.handleServers)
+	handle("/servers/", a.handleServer)
+	handle("/servers/default", a.handleDefaultServers)
+	handle("/server-mode", a.handleServerMode)
+	handle("/config/revisions", a.handleConfigRevisions)
+	handle("/config/revisions/", a.handleConfigRevision)
+	handle("/daemon", a.handleDaemon)
+	handle("/daemon/actions", a.handleDaemonActions)
+	handle("/daemon/actions/", a.handleDaemonAction)
+	handle("/metrics", a.handleMetrics)
+	handle("/history/tracking", a.handleTrackingHistory)
+	handle("/history/sources/", a.handleSourceHistory)
+	handleStream("/ws", a.handleWebSocket)
 	
 	// Application version endpoint
-	http.HandleFunc("/app-version", handleAppVersion)
+	handle("/app-version", handleAppVersion)
 	
 	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	handle("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	return withRequestID(mux)
+}
+
+func main() {
+	publicKey = loadPublicKey("/etc/brick/clock/public.pem") // adjust path as needed
+	
+	supervisor := newChronydSupervisorFromEnv(CHRONY_CONF_PATH)
+	backend, err := newBackendFromEnv(supervisor)
+	if err != nil {
+		log.Fatalf("Failed to set up chrony backend: %v", err)
+	}
+	app := NewApp(backend)
+	
+	if supervisor != nil {
+		if err := supervisor.Start(); err != nil {
+			log.Printf("%v", err)
+		}
+		// Take chronyd down with the API
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			sig := <-signals
+			log.Printf("Received %v, stopping chronyd", sig)
+			supervisor.Stop()
+			os.Exit(0)
+		}()
+	}
+	
+	revisionsDir := CONFIG_REVISIONS_DIR
+	if dir, ok := os.LookupEnv("CONFIG_REVISIONS_DIR"); ok {
+		revisionsDir = dir
+	}
+	if revisions, err := openRevisionStore(revisionsDir); err != nil {
+		log.Printf("Keeping chrony.conf revisions in memory only: %v", err)
+	} else {
+		app.revisions = revisions
+	}
+	auditPath := AUDIT_LOG_PATH
+	if path, ok := os.LookupEnv("AUDIT_LOG_PATH"); ok {
+		auditPath = path
+	}
+	if audit, err := openAuditLog(auditPath); err != nil {
+		log.Printf("Keeping the audit log in memory only: %v", err)
+	} else {
+		app.audit = audit
+	}
+	
+	historyRetention := HISTORY_RETENTION
+	if s := os.Getenv("HISTORY_RETENTION"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			historyRetention = d
+		} else {
+			log.Printf("Invalid HISTORY_RETENTION %q, using %v", s, historyRetention)
+		}
+	}
+	historyDir := HISTORY_DIR
+	if dir, ok := os.LookupEnv("HISTORY_DIR"); ok {
+		historyDir = dir
+	}
+	if history, err := openHistoryStore(historyDir, historyRetention); err != nil {
+		log.Printf("Keeping the history in memory only: %v", err)
+		app.history, _ = openHistoryStore("", historyRetention)
+	} else {
+		app.history = history
+	}
+	
+	if s := os.Getenv("OFFSET_THRESHOLD"); s != "" {
+		if threshold, err := strconv.ParseFloat(s, 64); err == nil && threshold > 0 {
+			app.events.offsetThreshold = threshold
+		} else {
+			log.Printf("Invalid OFFSET_THRESHOLD %q, using %v", s, app.events.offsetThreshold)
+		}
+	}
+	
+	if s := os.Getenv("CLIENT_METRICS_LIMIT"); s != "" {
+		if limit, err := strconv.Atoi(s); err == nil && limit >= 0 {
+			app.clientMetricsLimit = limit
+		} else {
+			log.Printf("Invalid CLIENT_METRICS_LIMIT %q, using %d", s, app.clientMetricsLimit)
+		}
+	}
+	
+	pollInterval := POLL_INTERVAL
+	if s := os.Getenv("POLL_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			pollInterval = d
+		} else {
+			log.Printf("Invalid POLL_INTERVAL %q, using %v", s, pollInterval)
+		}
+	}
+	app.collector.Start(pollInterval)
+	
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			app.wsOrigins = append(app.wsOrigins, origin)
+		}
+	}
 	
 	port := "17003"
 	if envPort := os.Getenv("PORT"); envPort != "" {
@@ -1081,5 +1858,5 @@ func main() {
 	}
 	
 	fmt.Printf("Starting Brick Clock API server on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-} 
\ No newline at end of file
+	log.Fatal(http.ListenAndServe(":"+port, app.Handler()))
+}
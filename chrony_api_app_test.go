@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var testKey *rsa.PrivateKey
+
+func TestMain(m *testing.M) {
+	var err error
+	if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	publicKey = &testKey.PublicKey
+	permissionCheckEnabled = true
+	os.Exit(m.Run())
+}
+
+// testToken signs a token for subject "tester" granting permissions.
+func testToken(t *testing.T, permissions ...string) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"sub":         "tester",
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"permissions": permissions,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newTestApp(t *testing.T) (*App, *FakeBackend) {
+	t.Helper()
+	backend := NewFakeBackend()
+	app := NewApp(backend)
+	app.restartTimeout = 0
+	return app, backend
+}
+
+// request sends a request to app and decodes the JSON response.
+func request(t *testing.T, app *App, method, path, token, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rec, req)
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+func errorCode(response map[string]interface{}) string {
+	e, _ := response["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func TestStatus(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	code, v1 := request(t, app, "GET", "/status", "", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /status = %d", code)
+	}
+	tracking, _ := v1["tracking"].(map[string]interface{})
+	if tracking["ReferenceID"] != "CB00710A (203.0.113.10)" || tracking["Leap status"] != "Normal" {
+		t.Errorf("v1 tracking = %v", tracking)
+	}
+	sources, _ := v1["sources"].([]interface{})
+	if len(sources) != 1 {
+		t.Fatalf("v1 sources = %v", v1["sources"])
+	}
+	if s := sources[0].(map[string]interface{}); s["state"] != "^*" || s["reach"] != "377" || s["offset"] != "+625us" {
+		t.Errorf("v1 source = %v", s)
+	}
+
+	code, v2 := request(t, app, "GET", "/v2/status?flags=3", "", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /v2/status = %d", code)
+	}
+	tracking, _ = v2["tracking"].(map[string]interface{})
+	if tracking["reference_id"] != "CB00710A" || tracking["frequency_ppm"] != -1.234 {
+		t.Errorf("v2 tracking = %v", tracking)
+	}
+	if _, ok := v2["activity"]; ok {
+		t.Errorf("flags=3 included activity: %v", v2)
+	}
+	sources, _ = v2["sources"].([]interface{})
+	if len(sources) != 1 || sources[0].(map[string]interface{})["state"] != "selected" {
+		t.Errorf("v2 sources = %v", v2["sources"])
+	}
+}
+
+func TestStatusBackendError(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Errors["tracking"] = errors.New("506 Cannot talk to daemon")
+
+	code, response := request(t, app, "GET", "/v2/status", "", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /v2/status = %d", code)
+	}
+	if response["tracking"] != nil || response["tracking_error"] != "506 Cannot talk to daemon" {
+		t.Errorf("tracking = %v, tracking_error = %v", response["tracking"], response["tracking_error"])
+	}
+	if sources, _ := response["sources"].([]interface{}); len(sources) != 1 {
+		t.Errorf("sources = %v, want the other sections unaffected", response["sources"])
+	}
+
+	code, response = request(t, app, "GET", "/v2/status/tracking", "", "")
+	if code != http.StatusBadGateway || errorCode(response) != ERR_CHRONYD {
+		t.Errorf("GET /v2/status/tracking = %d %v", code, response)
+	}
+}
+
+func TestSourceDetail(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	code, response := request(t, app, "GET", "/v2/status/sources/203.0.113.10", "", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET source = %d %v", code, response)
+	}
+	ntpdata, _ := response["ntpdata"].(map[string]interface{})
+	if ntpdata["remote_address"] != "203.0.113.10" {
+		t.Errorf("ntpdata = %v", response["ntpdata"])
+	}
+	code, response = request(t, app, "GET", "/v2/status/sources/192.0.2.99", "", "")
+	if code != http.StatusNotFound || errorCode(response) != ERR_NOT_FOUND {
+		t.Errorf("GET unknown source = %d %v", code, response)
+	}
+}
+
+func TestServersAuth(t *testing.T) {
+	app, backend := newTestApp(t)
+	body := `{"servers": [{"type": "server", "host": "time.example.com", "iburst": true}]}`
+
+	code, response := request(t, app, "GET", "/servers", "", "")
+	if code != http.StatusUnauthorized || errorCode(response) != ERR_UNAUTHORIZED {
+		t.Errorf("GET /servers without a token = %d %v", code, response)
+	}
+	code, response = request(t, app, "PUT", "/servers", "not-a-token", body)
+	if code != http.StatusUnauthorized {
+		t.Errorf("PUT /servers with a bad token = %d %v", code, response)
+	}
+	code, response = request(t, app, "PUT", "/servers", testToken(t, "clock/server_mode"), body)
+	if code != http.StatusForbidden || errorCode(response) != ERR_FORBIDDEN {
+		t.Errorf("PUT /servers without clock/servers = %d %v", code, response)
+	}
+	for _, call := range backend.Calls {
+		if call == "write_config" {
+			t.Errorf("chrony.conf written by a rejected request")
+		}
+	}
+}
+
+func TestSetServers(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.SourcesReply = append(backend.SourcesReply, Source{Mode: SourceModeServer, Name: "pool.ntp.org"})
+	token := testToken(t, "clock/servers")
+
+	code, response := request(t, app, "GET", "/servers", token, "")
+	servers, _ := response["servers"].([]interface{})
+	if code != http.StatusOK || len(servers) != 1 || servers[0].(map[string]interface{})["host"] != "pool.ntp.org" {
+		t.Fatalf("GET /servers = %d %v", code, response)
+	}
+
+	code, response = request(t, app, "PUT", "/servers?reason=test", token,
+		`{"servers": [{"type": "server", "host": "time.example.com", "iburst": true}]}`)
+	if code != http.StatusOK || response["restarted"] != false || response["restart_success"] != true {
+		t.Fatalf("PUT /servers = %d %v", code, response)
+	}
+	if conf := string(backend.Config); !strings.Contains(conf, "server time.example.com iburst\n") ||
+		strings.Contains(conf, "pool.ntp.org") {
+		t.Errorf("chrony.conf = %q", conf)
+	}
+	if backend.Restarts != 0 {
+		t.Errorf("chronyd restarted %d times, want the change applied at runtime", backend.Restarts)
+	}
+	if rev := app.revisions.Latest(); rev.Subject != "tester" || rev.Action != "PUT /servers" || rev.Reason != "test" {
+		t.Errorf("revision = %+v", rev)
+	}
+
+	code, response = request(t, app, "PUT", "/servers", token, `{"servers": []}`)
+	if code != http.StatusBadRequest || errorCode(response) != ERR_INVALID_REQUEST {
+		t.Errorf("PUT /servers with no servers = %d %v", code, response)
+	}
+}
+
+func TestSetServersRestartsWhenRuntimeChangeFails(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Errors["add_source"] = errors.New("501 Not authorised")
+
+	code, response := request(t, app, "PUT", "/servers", testToken(t, "clock/servers"),
+		`{"servers": [{"type": "server", "host": "time.example.com"}]}`)
+	if code != http.StatusOK || response["restarted"] != true || response["restart_success"] != true {
+		t.Fatalf("PUT /servers = %d %v", code, response)
+	}
+	if backend.Restarts != 1 {
+		t.Errorf("chronyd restarted %d times, want 1", backend.Restarts)
+	}
+}
+
+func TestRestartFailureRestoresConfig(t *testing.T) {
+	for _, failure := range []string{"restart", "tracking"} {
+		app, backend := newTestApp(t)
+		previous := "server time.example.com iburst\ndeny all\n"
+		backend.Config = []byte(previous)
+		// Either chronyd does not start, or it does not answer in time
+		backend.Errors[failure] = errors.New("506 Cannot talk to daemon")
+
+		code, response := request(t, app, "PUT", "/server-mode?reason=open+up", testToken(t, "clock/server_mode"),
+			`{"enabled": true}`)
+		if code != http.StatusBadGateway || errorCode(response) != ERR_CHRONYD {
+			t.Errorf("%s failing: PUT /server-mode = %d %v", failure, code, response)
+		}
+		if string(backend.Config) != previous {
+			t.Errorf("%s failing: chrony.conf = %q, want the previous file restored", failure, backend.Config)
+		}
+		rollback, change := app.revisions.Get(app.revisions.Latest().ID)
+		if change == nil || change.Action != "PUT /server-mode" || !strings.Contains(change.Content, "allow") {
+			t.Fatalf("%s failing: revisions = %+v, want the change then its rollback", failure, app.revisions.List())
+		}
+		if rollback.Action != "rollback" || rollback.Subject != "tester" || rollback.Content != previous ||
+			rollback.Reason != "chronyd did not come up after PUT /server-mode" {
+			t.Errorf("%s failing: rollback revision = %+v", failure, rollback)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	app, backend := newTestApp(t)
+
+	code, response := request(t, app, "GET", "/daemon", testToken(t), "")
+	if code != http.StatusOK || response["pid"] != float64(42) || response["running"] != true {
+		t.Errorf("GET /daemon = %d %v", code, response)
+	}
+
+	backend.Errors["daemon"] = errors.New("chronyd is not supervised")
+	code, response = request(t, app, "GET", "/daemon", testToken(t), "")
+	if code != http.StatusBadGateway || errorCode(response) != ERR_CHRONYD {
+		t.Errorf("GET /daemon with a failing backend = %d %v", code, response)
+	}
+}
+
+func TestDaemonAction(t *testing.T) {
+	app, backend := newTestApp(t)
+
+	code, response := request(t, app, "POST", "/daemon/actions/burst", testToken(t, "clock/daemon/online"), "")
+	if code != http.StatusForbidden || len(backend.Actions) != 0 {
+		t.Errorf("burst without clock/daemon/burst = %d %v", code, response)
+	}
+	code, response = request(t, app, "POST", "/daemon/actions/reboot", testToken(t), "")
+	if code != http.StatusNotFound || errorCode(response) != ERR_NOT_FOUND {
+		t.Errorf("unknown action = %d %v", code, response)
+	}
+
+	code, response = request(t, app, "POST", "/daemon/actions/burst?reason=check", testToken(t, "clock/daemon/burst"),
+		`{"source": "203.0.113.10"}`)
+	if code != http.StatusOK || response["action"] != "burst" || response["output"] != "200 OK" {
+		t.Fatalf("burst = %d %v", code, response)
+	}
+	if len(backend.Actions) != 1 || backend.Actions[0].Source != "203.0.113.10" {
+		t.Errorf("actions run = %+v", backend.Actions)
+	}
+	audit := app.audit.List()
+	if len(audit) != 1 || audit[0].Subject != "tester" || audit[0].Reason != "check" || !audit[0].Success {
+		t.Errorf("audit = %+v", audit)
+	}
+
+	backend.Errors["daemon_action"] = errors.New("503 No such source")
+	code, response = request(t, app, "POST", "/daemon/actions/burst", testToken(t, "clock/daemon/burst"), "")
+	if code != http.StatusBadGateway || errorCode(response) != ERR_CHRONYD {
+		t.Errorf("failing burst = %d %v", code, response)
+	}
+	if audit := app.audit.List(); len(audit) != 2 || audit[0].Success {
+		t.Errorf("failed action not audited: %+v", audit)
+	}
+}
+
+func TestDefaultServers(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Config = []byte("server time.example.com iburst\n")
+	backend.SourcesReply = append(backend.SourcesReply, Source{Mode: SourceModeServer, Name: "time.example.com"})
+
+	code, response := request(t, app, "PUT", "/servers/default", "", "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("PUT /servers/default without a token = %d %v", code, response)
+	}
+	code, response = request(t, app, "PUT", "/servers/default", testToken(t, "clock/daemon/burst"), "")
+	if code != http.StatusForbidden || errorCode(response) != ERR_FORBIDDEN {
+		t.Errorf("PUT /servers/default without clock/servers = %d %v", code, response)
+	}
+	if rev := app.revisions.Latest(); rev != nil {
+		t.Fatalf("rejected request recorded revision %+v", rev)
+	}
+
+	code, response = request(t, app, "PUT", "/servers/default", testToken(t, "clock/servers"), "")
+	if code != http.StatusOK {
+		t.Fatalf("PUT /servers/default = %d %v", code, response)
+	}
+	if rev := app.revisions.Latest(); rev.Subject != "tester" || rev.Action != "PUT /servers/default" {
+		t.Errorf("revision = %+v", rev)
+	}
+}
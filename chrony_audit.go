@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditLogMemory is how many audit records are kept in memory for the
+// API; the log file keeps them all.
+const auditLogMemory = 1000
+
+// AuditRecord is one daemon action run through the API: who ran it (the
+// JWT subject), with which parameters, why and how it went.
+type AuditRecord struct {
+	ID      int          `json:"id"`
+	Time    time.Time    `json:"time"`
+	Subject string       `json:"subject"`
+	Request DaemonAction `json:"request"`
+	Reason  string       `json:"reason"`
+	Success bool         `json:"success"`
+	Output  string       `json:"output,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// auditLog appends audit records to a JSON-lines file, or keeps them only
+// in memory when path is empty.
+type auditLog struct {
+	path string
+	// partial is set when the file ends in an incomplete line, left by a
+	// write that was cut short, so the next record starts a new line
+	partial bool
+
+	mu      sync.Mutex
+	records []AuditRecord
+	nextID  int
+}
+
+// openAuditLog loads the newest records of the log at path, creating its
+// directory if needed. Lines that cannot be parsed are logged and skipped.
+// An empty path gives an in-memory log.
+func openAuditLog(path string) (*auditLog, error) {
+	l := &auditLog{path: path, nextID: 1}
+	if path == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping audit record %s:%d: %v", path, line, err)
+			continue
+		}
+		l.remember(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil {
+			l.partial = last[0] != '\n'
+		}
+	}
+	return l, nil
+}
+
+// Add appends rec with the next ID and the current time, and returns it.
+// The record is kept in memory even if it cannot be written to the file.
+func (l *auditLog) Add(rec AuditRecord) (AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec.ID = l.nextID
+	rec.Time = time.Now().UTC()
+	l.remember(rec)
+	msg := fmt.Sprintf("Audit #%d: %q ran %s", rec.ID, rec.Subject, rec.Request.Action)
+	if rec.Request.Source != "" {
+		msg += " on " + rec.Request.Source
+	}
+	if rec.Error != "" {
+		msg += ", failed: " + rec.Error
+	}
+	log.Print(msg)
+	if l.path == "" {
+		return rec, nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return rec, err
+	}
+	if l.partial {
+		data = append([]byte{'\n'}, data...)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		l.partial = true
+		f.Close()
+		return rec, err
+	}
+	l.partial = false
+	return rec, f.Close()
+}
+
+// remember keeps rec in memory, dropping the oldest records beyond
+// auditLogMemory. Callers hold l.mu, or own l.
+func (l *auditLog) remember(rec AuditRecord) {
+	l.records = append(l.records, rec)
+	if n := len(l.records) - auditLogMemory; n > 0 {
+		l.records = append([]AuditRecord(nil), l.records[n:]...)
+	}
+	if rec.ID >= l.nextID {
+		l.nextID = rec.ID + 1
+	}
+}
+
+// List returns the records in memory, newest first.
+func (l *auditLog) List() []AuditRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]AuditRecord, 0, len(l.records))
+	for i := len(l.records) - 1; i >= 0; i-- {
+		list = append(list, l.records[i])
+	}
+	return list
+}
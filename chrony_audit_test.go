@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogSkipsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	content := `{"id":1,"subject":"alice","request":{"action":"burst"},"success":true}` + "\n" +
+		"not json\n" +
+		"\n" +
+		`{"id":2,"subject":"bob","request":{"action":"makestep"},"success":true}` + "\n" +
+		`{"id":3,"subject":"carol","requ`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog: %v", err)
+	}
+	if records := audit.List(); len(records) != 2 || records[0].Subject != "bob" {
+		t.Fatalf("records = %+v, want bob's and alice's", records)
+	}
+	rec, err := audit.Add(AuditRecord{Subject: "dave", Request: DaemonAction{Action: "online"}, Success: true})
+	if err != nil || rec.ID != 3 {
+		t.Fatalf("Add = %+v, %v", rec, err)
+	}
+
+	// The new record must not be glued to the truncated line
+	reopened, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	records := reopened.List()
+	if len(records) != 3 || records[0].Subject != "dave" || records[0].ID != 3 {
+		t.Errorf("records after reopening = %+v", records)
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"el/brick-clock/chronyconf"
+	"el/brick-clock/cmdmon"
+)
+
+// ChronyBackend is everything the API needs from chronyd: its reports,
+// runtime source changes, its configuration file and restarting it.
+// Handlers only talk to chronyd through a backend so they can be driven
+// by FakeBackend.
+type ChronyBackend interface {
+	Tracking() (*Tracking, error)
+	Sources() ([]Source, error)
+	SourceStats() ([]SourceStats, error)
+	// NTPData returns the NTP state of the source Sources lists as name.
+	NTPData(name string) (*NTPData, error)
+	SelectData() ([]SelectData, error)
+	Activity() (*Activity, error)
+	Clients() ([]Client, error)
+
+	// AddSource adds a server, pool or peer directive to the running
+	// daemon without touching chrony.conf.
+	AddSource(d *chronyconf.Directive) error
+	// DeleteSource removes the sources of host, an address or the name a
+	// server, pool or peer directive was given, from the running daemon.
+	DeleteSource(host string) error
+	// DeleteSources removes every source from the running daemon.
+	DeleteSources() (string, error)
+	// RunAction runs an operational command such as a burst or a clock
+	// step on the running daemon, and returns its output if it has any.
+	RunAction(action DaemonAction) (string, error)
+
+	ReadConfig() ([]byte, error)
+	WriteConfig(content []byte) error
+	Restart() error
+	// Daemon describes the chronyd process.
+	Daemon() (*DaemonStatus, error)
+}
+
+// newBackendFromEnv selects the backend named by CHRONY_BACKEND
+// ("exec", the default, "cmdmon" or "fake"). The exec and cmdmon backends
+// restart chronyd through supervisor.
+func newBackendFromEnv(supervisor *chronydSupervisor) (ChronyBackend, error) {
+	switch kind := os.Getenv("CHRONY_BACKEND"); kind {
+	case "", "exec":
+		return newExecBackend(CHRONY_CONF_PATH, supervisor), nil
+	case "cmdmon":
+		addr := os.Getenv("CHRONY_CMDMON_ADDR")
+		if addr == "" {
+			addr = cmdmon.DefaultSocketPath
+		}
+		return newCmdmonBackend(CHRONY_CONF_PATH, addr, supervisor), nil
+	case "fake":
+		return NewFakeBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown CHRONY_BACKEND %q", kind)
+	}
+}
+
+// Restart restarts chronyd through the supervisor and waits for its
+// command socket.
+func (l *localChrony) Restart() error {
+	if l.supervisor == nil {
+		return errNotSupervised
+	}
+	return l.supervisor.Restart()
+}
+
+func (l *localChrony) Daemon() (*DaemonStatus, error) {
+	if l.supervisor == nil {
+		return &DaemonStatus{}, nil
+	}
+	return l.supervisor.Status(), nil
+}
+
+// execBackend runs chronyc and parses its text output.
+type execBackend struct {
+	localChrony
+}
+
+func newExecBackend(confPath string, supervisor *chronydSupervisor) *execBackend {
+	return &execBackend{newLocalChrony(confPath, supervisor)}
+}
+
+// Helper function to run chronyc commands
+func runChronyc(args []string) (string, error) {
+	cmd := exec.Command("chronyc", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (b *execBackend) Tracking() (*Tracking, error) {
+	output, err := runChronyc([]string{"tracking"})
+	if err != nil {
+		return nil, err
+	}
+	return parseTracking(output)
+}
+
+// runChronycNamed runs a chronyc report twice: with -N, which lists sources
+// by the names they were configured with, and with -n, which lists the
+// same rows by address.
+func runChronycNamed(report string) (byName, byAddr string, err error) {
+	if byName, err = runChronyc([]string{"-N", report}); err != nil {
+		return "", "", err
+	}
+	if byAddr, err = runChronyc([]string{"-n", report}); err != nil {
+		return "", "", err
+	}
+	return byName, byAddr, nil
+}
+
+func (b *execBackend) Sources() ([]Source, error) {
+	byName, byAddr, err := runChronycNamed("sources")
+	if err != nil {
+		return nil, err
+	}
+	sources, err := parseSources(byName)
+	if err != nil {
+		return nil, err
+	}
+	addrSources, err := parseSources(byAddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrSources) != len(sources) {
+		return nil, fmt.Errorf("sources changed while listing them")
+	}
+	names := make([]string, len(sources))
+	addrs := make([]string, len(sources))
+	for i := range sources {
+		if sources[i].Mode != SourceModeRefclock {
+			sources[i].Address = addrSources[i].Name
+		}
+		names[i], addrs[i] = sources[i].Name, sources[i].Address
+	}
+	uniqueSourceNames(names, addrs)
+	for i := range sources {
+		sources[i].Name = names[i]
+	}
+	return sources, nil
+}
+
+func (b *execBackend) SourceStats() ([]SourceStats, error) {
+	byName, byAddr, err := runChronycNamed("sourcestats")
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseSourceStats(byName)
+	if err != nil {
+		return nil, err
+	}
+	addrStats, err := parseSourceStats(byAddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrStats) != len(stats) {
+		return nil, fmt.Errorf("sources changed while listing sourcestats")
+	}
+	names := make([]string, len(stats))
+	addrs := make([]string, len(stats))
+	for i := range stats {
+		names[i] = stats[i].Name
+		// Reference clocks are listed by reference ID either way
+		if net.ParseIP(addrStats[i].Name) != nil {
+			addrs[i] = addrStats[i].Name
+		}
+	}
+	uniqueSourceNames(names, addrs)
+	for i := range stats {
+		stats[i].Name = names[i]
+	}
+	return stats, nil
+}
+
+// NTPData looks name up by address: chronyc would resolve a host name
+// through DNS rather than match it against the configured names.
+func (b *execBackend) NTPData(name string) (*NTPData, error) {
+	addrs, err := sourceAddresses(name)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runChronyc([]string{"ntpdata", addrs[0]})
+	if err != nil {
+		return nil, err
+	}
+	return parseNTPData(output)
+}
+
+func (b *execBackend) SelectData() ([]SelectData, error) {
+	byName, byAddr, err := runChronycNamed("selectdata")
+	if err != nil {
+		return nil, err
+	}
+	selects, err := parseSelectData(byName)
+	if err != nil {
+		return nil, err
+	}
+	addrSelects, err := parseSelectData(byAddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrSelects) != len(selects) {
+		return nil, fmt.Errorf("sources changed while listing selectdata")
+	}
+	names := make([]string, len(selects))
+	addrs := make([]string, len(selects))
+	for i := range selects {
+		names[i] = selects[i].Name
+		// Reference clocks are listed by reference ID either way
+		if net.ParseIP(addrSelects[i].Name) != nil {
+			addrs[i] = addrSelects[i].Name
+		}
+	}
+	uniqueSourceNames(names, addrs)
+	for i := range selects {
+		selects[i].Name = names[i]
+	}
+	return selects, nil
+}
+
+func (b *execBackend) Activity() (*Activity, error) {
+	output, err := runChronyc([]string{"activity"})
+	if err != nil {
+		return nil, err
+	}
+	return parseActivity(output)
+}
+
+func (b *execBackend) Clients() ([]Client, error) {
+	output, err := runChronyc([]string{"clients"})
+	if err != nil {
+		return nil, err
+	}
+	return parseClients(output)
+}
+
+func (b *execBackend) AddSource(d *chronyconf.Directive) error {
+	// "add server host options" takes the directive as written in chrony.conf
+	args := append([]string{"add", d.Name}, d.Args...)
+	output, err := exec.Command("chronyc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("chronyc add %s %s: %s", d.Name, d.Host(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (b *execBackend) DeleteSource(host string) error {
+	addrs, err := sourceAddresses(host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if _, err := runChronyc([]string{"delete", addr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceAddresses returns the addresses of the sources of host, an address
+// or the name a server, pool or peer directive gave them.
+func sourceAddresses(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	byName, byAddr, err := runChronycNamed("sources")
+	if err != nil {
+		return nil, err
+	}
+	names, err := parseSources(byName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := parseSources(byAddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != len(names) {
+		return nil, fmt.Errorf("sources changed while looking up %q", host)
+	}
+	var matches []string
+	for i := range names {
+		if names[i].Name == host && names[i].Mode != SourceModeRefclock {
+			matches = append(matches, addrs[i].Name)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no source named %q", host)
+	}
+	return matches, nil
+}
+
+// RunAction runs the chronyc command of action, once for every address of
+// its source, and returns chronyc's output.
+func (b *execBackend) RunAction(action DaemonAction) (string, error) {
+	addrs := []string{""}
+	if action.Source != "" {
+		var err error
+		if addrs, err = sourceAddresses(action.Source); err != nil {
+			return "", err
+		}
+	}
+	var outputs []string
+	for _, addr := range addrs {
+		args := action.chronycArgs(addr)
+		output, err := exec.Command("chronyc", args...).CombinedOutput()
+		if err != nil {
+			return strings.Join(outputs, "\n"), fmt.Errorf("chronyc %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+		}
+		outputs = append(outputs, strings.TrimSpace(string(output)))
+	}
+	return strings.Join(outputs, "\n"), nil
+}
+
+func (b *execBackend) DeleteSources() (string, error) {
+	// List by address so every entry can be passed back to "delete"
+	output, err := runChronyc([]string{"-n", "sources"})
+	if err != nil {
+		return "", err
+	}
+	sources, err := parseSources(output)
+	if err != nil {
+		return "", err
+	}
+	var outputs []string
+	for _, source := range sources {
+		if source.Mode == SourceModeRefclock {
+			continue
+		}
+		out, err := runChronyc([]string{"delete", source.Name})
+		if err != nil {
+			return strings.Join(outputs, "\n"), err
+		}
+		outputs = append(outputs, out)
+	}
+	return strings.Join(outputs, "\n"), nil
+}
+
+// cmdmonBackend talks to chronyd over its command socket.
+type cmdmonBackend struct {
+	localChrony
+	network string
+	address string
+
+	mu     sync.Mutex
+	client *cmdmon.Client
+}
+
+// newCmdmonBackend connects to chronyd at addr, a Unix socket path or a
+// UDP host:port.
+func newCmdmonBackend(confPath, addr string, supervisor *chronydSupervisor) *cmdmonBackend {
+	network := "unix"
+	if !strings.HasPrefix(addr, "/") {
+		network = "udp"
+	}
+	return &cmdmonBackend{
+		localChrony: newLocalChrony(confPath, supervisor),
+		network:     network,
+		address:     addr,
+	}
+}
+
+// do runs fn with a connected client. The connection is dropped when a
+// request gets no usable reply so that the next call redials (chronyd may
+// have been restarted).
+func (b *cmdmonBackend) do(fn func(c *cmdmon.Client) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == nil {
+		client, err := cmdmon.Dial(b.network, b.address)
+		if err != nil {
+			return err
+		}
+		b.client = client
+	}
+	err := fn(b.client)
+	var statusErr *cmdmon.StatusError
+	if err != nil && !errors.As(err, &statusErr) {
+		b.client.Close()
+		b.client = nil
+	}
+	return err
+}
+
+func (b *cmdmonBackend) Tracking() (*Tracking, error) {
+	var t *cmdmon.Tracking
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		t, err = c.Tracking()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trackingFromCmdmon(t), nil
+}
+
+func (b *cmdmonBackend) Sources() ([]Source, error) {
+	var sources []cmdmon.SourceData
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		sources, err = c.Sources()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Source, 0, len(sources))
+	for i := range sources {
+		result = append(result, sourceFromCmdmon(&sources[i]))
+	}
+	return result, nil
+}
+
+func (b *cmdmonBackend) SourceStats() ([]SourceStats, error) {
+	var stats []cmdmon.SourceStats
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		stats, err = c.SourceStats()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SourceStats, 0, len(stats))
+	for i := range stats {
+		result = append(result, sourceStatsFromCmdmon(&stats[i]))
+	}
+	return result, nil
+}
+
+func (b *cmdmonBackend) NTPData(name string) (*NTPData, error) {
+	var n *cmdmon.NTPData
+	err := b.do(func(c *cmdmon.Client) error {
+		ip := net.ParseIP(name)
+		if ip == nil {
+			sources, err := c.Sources()
+			if err != nil {
+				return err
+			}
+			for _, s := range sources {
+				if s.Name == name && s.Mode != cmdmon.SourceModeRefclock {
+					ip = s.IPAddr
+					break
+				}
+			}
+			if ip == nil {
+				return fmt.Errorf("no NTP source named %q", name)
+			}
+		}
+		var err error
+		n, err = c.NTPData(ip)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ntpDataFromCmdmon(n), nil
+}
+
+func (b *cmdmonBackend) SelectData() ([]SelectData, error) {
+	var selects []cmdmon.SelectData
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		selects, err = c.SelectData()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SelectData, 0, len(selects))
+	for i := range selects {
+		result = append(result, selectDataFromCmdmon(&selects[i]))
+	}
+	return result, nil
+}
+
+func (b *cmdmonBackend) Activity() (*Activity, error) {
+	var a *cmdmon.Activity
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		a, err = c.Activity()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activityFromCmdmon(a), nil
+}
+
+func (b *cmdmonBackend) Clients() ([]Client, error) {
+	var clients []cmdmon.ClientAccess
+	err := b.do(func(c *cmdmon.Client) (err error) {
+		clients, err = c.Clients()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Client, 0, len(clients))
+	for i := range clients {
+		result = append(result, clientFromCmdmon(&clients[i]))
+	}
+	return result, nil
+}
+
+func (b *cmdmonBackend) AddSource(d *chronyconf.Directive) error {
+	src, err := ntpSourceFromDirective(d)
+	if err != nil {
+		return err
+	}
+	return b.do(func(c *cmdmon.Client) error {
+		return c.AddSource(src)
+	})
+}
+
+func (b *cmdmonBackend) DeleteSource(host string) error {
+	return b.do(func(c *cmdmon.Client) error {
+		ips, err := sourceIPs(c, host)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if err := c.DeleteSource(ip); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sourceIPs returns the addresses of the sources of host, an address or
+// the name a server, pool or peer directive gave them.
+func sourceIPs(c *cmdmon.Client, host string) ([]net.IP, error) {
+	sources, err := c.Sources()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	var matches []net.IP
+	for _, s := range sources {
+		if s.Mode == cmdmon.SourceModeRefclock || s.IPAddr == nil {
+			continue
+		}
+		if s.IPAddr.Equal(ip) || s.Name == host {
+			matches = append(matches, s.IPAddr)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no source named %q", host)
+	}
+	return matches, nil
+}
+
+// RunAction sends the request of action, once for every address of its
+// source. chronyd's replies carry no output.
+func (b *cmdmonBackend) RunAction(action DaemonAction) (string, error) {
+	return "", b.do(func(c *cmdmon.Client) error {
+		ips := []net.IP{nil}
+		if action.Source != "" {
+			var err error
+			if ips, err = sourceIPs(c, action.Source); err != nil {
+				return err
+			}
+		}
+		for _, ip := range ips {
+			if err := runCmdmonAction(c, action, ip); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func runCmdmonAction(c *cmdmon.Client, action DaemonAction, ip net.IP) error {
+	switch action.Action {
+	case "burst":
+		return c.Burst(ip, action.GoodSamples, action.TotalSamples)
+	case "online":
+		return c.Online(ip)
+	case "offline":
+		return c.Offline(ip)
+	case "makestep":
+		if action.Threshold != nil {
+			return c.ModifyMakeStep(*action.Threshold, *action.Limit)
+		}
+		return c.MakeStep()
+	case "reload_sources":
+		return c.ReloadSources()
+	case "rekey":
+		return c.Rekey()
+	case "cyclelogs":
+		return c.CycleLogs()
+	case "dump":
+		return c.Dump()
+	}
+	return fmt.Errorf("unknown action %q", action.Action)
+}
+
+func (b *cmdmonBackend) DeleteSources() (string, error) {
+	var deleted []string
+	err := b.do(func(c *cmdmon.Client) error {
+		sources, err := c.Sources()
+		if err != nil {
+			return err
+		}
+		for _, s := range sources {
+			if s.Mode == cmdmon.SourceModeRefclock || s.IPAddr == nil {
+				continue
+			}
+			if err := c.DeleteSource(s.IPAddr); err != nil {
+				return err
+			}
+			deleted = append(deleted, s.IPAddr.String())
+		}
+		return nil
+	})
+	return strings.Join(deleted, "\n"), err
+}
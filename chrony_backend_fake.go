@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"el/brick-clock/chronyconf"
+)
+
+// FakeBackend is an in-memory ChronyBackend with scripted responses. It
+// backs handler tests and lets the API run without chronyd
+// (CHRONY_BACKEND=fake).
+//
+// Set the *Reply fields to what each query should return and Errors to
+// make an operation fail; Calls records every operation in order.
+type FakeBackend struct {
+	mu sync.Mutex
+
+	TrackingReply    *Tracking
+	SourcesReply     []Source
+	SourceStatsReply []SourceStats
+	NTPDataReply     map[string]*NTPData
+	SelectDataReply  []SelectData
+	ActivityReply    *Activity
+	ClientsReply     []Client
+	DeleteOutput     string
+	DaemonReply      *DaemonStatus
+
+	// Config is the in-memory chrony.conf.
+	Config []byte
+
+	// Errors maps an operation name ("tracking", "sources", "sourcestats",
+	// "ntpdata", "selectdata", "activity", "clients", "add_source",
+	// "delete_source", "delete_sources", "daemon_action", "read_config",
+	// "write_config", "restart", "daemon") to the error it should return.
+	Errors map[string]error
+
+	Calls    []string
+	Restarts int
+	// Actions records every DaemonAction that was run.
+	Actions []DaemonAction
+}
+
+var fakeLastRx int64 = 19
+
+// NewFakeBackend returns a fake with a synchronised single source and the
+// stock chrony.conf.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		TrackingReply: &Tracking{
+			ReferenceID:       "CB00710A",
+			ReferenceName:     "203.0.113.10",
+			Stratum:           3,
+			RefTime:           time.Date(2024, 3, 18, 10, 30, 45, 0, time.UTC),
+			SystemTime:        0.000012345,
+			LastOffset:        0.000023456,
+			RMSOffset:         0.000034567,
+			Frequency:         -1.234,
+			ResidualFrequency: 0.001,
+			Skew:              0.012,
+			RootDelay:         0.012345678,
+			RootDispersion:    0.000456789,
+			UpdateInterval:    64.2,
+			LeapStatus:        LeapNormal,
+		},
+		SourcesReply: []Source{{
+			Mode:           SourceModeServer,
+			State:          SourceStateSelected,
+			Name:           "203.0.113.10",
+			Stratum:        2,
+			Poll:           6,
+			PollInterval:   64,
+			Reach:          0377,
+			ReachRatio:     1,
+			LastRx:         &fakeLastRx,
+			Offset:         0.000625,
+			MeasuredOffset: -0.000117,
+			Error:          0.025,
+		}},
+		SourceStatsReply: []SourceStats{{
+			Name:          "203.0.113.10",
+			Samples:       20,
+			Runs:          11,
+			Span:          2340,
+			Frequency:     -0.004,
+			FrequencySkew: 0.016,
+			Offset:        -0.000014,
+			StdDev:        0.000018,
+		}},
+		NTPDataReply: map[string]*NTPData{
+			"203.0.113.10": {
+				RemoteAddress:  "203.0.113.10",
+				RemotePort:     123,
+				LocalAddress:   "172.17.0.2",
+				LeapStatus:     LeapNormal,
+				Version:        4,
+				Mode:           "server",
+				Stratum:        2,
+				Poll:           6,
+				Precision:      -25,
+				RootDelay:      0.000092,
+				RootDispersion: 0.000015,
+				ReferenceID:    "C0A80101",
+				RefTime:        time.Date(2024, 3, 18, 10, 30, 0, 0, time.UTC),
+				Offset:         0.000012345,
+				PeerDelay:      0.000345678,
+				PeerDispersion: 0.000001234,
+				ResponseTime:   0.000023456,
+				Tests:          "111 111 1111",
+				TxTimestamping: "kernel",
+				RxTimestamping: "kernel",
+				TotalTx:        100,
+				TotalRx:        100,
+				TotalValidRx:   100,
+			},
+		},
+		SelectDataReply: []SelectData{{
+			Name:          "203.0.113.10",
+			Status:        "*",
+			StatusName:    "selected",
+			LastSampleAgo: &fakeLastRx,
+			Score:         1,
+			LowLimit:      -0.00002,
+			HighLimit:     0.00005,
+			LeapStatus:    LeapNormal,
+		}},
+		ActivityReply: &Activity{Online: 1},
+		DaemonReply: &DaemonStatus{
+			Supervised:    true,
+			Running:       true,
+			PID:           42,
+			UptimeSeconds: 3600,
+		},
+		ClientsReply: []Client{},
+		Config: []byte("server pool.ntp.org iburst\n" +
+			"#allow 0.0.0.0/0\n" +
+			"local stratum 10\n" +
+			"driftfile /var/lib/chrony/chrony.drift\n" +
+			"logdir /var/log/chrony\n" +
+			"port 123\n"),
+		Errors: make(map[string]error),
+	}
+}
+
+// call records op and returns its scripted error. Callers hold f.mu.
+func (f *FakeBackend) call(op string) error {
+	f.Calls = append(f.Calls, op)
+	return f.Errors[op]
+}
+
+func (f *FakeBackend) Tracking() (*Tracking, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("tracking"); err != nil {
+		return nil, err
+	}
+	return f.TrackingReply, nil
+}
+
+func (f *FakeBackend) Sources() ([]Source, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("sources"); err != nil {
+		return nil, err
+	}
+	return f.SourcesReply, nil
+}
+
+func (f *FakeBackend) SourceStats() ([]SourceStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("sourcestats"); err != nil {
+		return nil, err
+	}
+	return f.SourceStatsReply, nil
+}
+
+func (f *FakeBackend) NTPData(name string) (*NTPData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ntpdata"); err != nil {
+		return nil, err
+	}
+	n, ok := f.NTPDataReply[name]
+	if !ok {
+		return nil, fmt.Errorf("no NTP source named %q", name)
+	}
+	return n, nil
+}
+
+func (f *FakeBackend) SelectData() ([]SelectData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("selectdata"); err != nil {
+		return nil, err
+	}
+	return f.SelectDataReply, nil
+}
+
+func (f *FakeBackend) Activity() (*Activity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("activity"); err != nil {
+		return nil, err
+	}
+	return f.ActivityReply, nil
+}
+
+func (f *FakeBackend) Clients() ([]Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("clients"); err != nil {
+		return nil, err
+	}
+	return f.ClientsReply, nil
+}
+
+// AddSource lists the new source as unreachable under its host name.
+func (f *FakeBackend) AddSource(d *chronyconf.Directive) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("add_source"); err != nil {
+		return err
+	}
+	mode := SourceModeServer
+	if d.Name == "peer" {
+		mode = SourceModePeer
+	}
+	f.SourcesReply = append(f.SourcesReply, Source{
+		Mode:  mode,
+		State: SourceStateUnreachable,
+		Name:  d.Host(),
+	})
+	return nil
+}
+
+func (f *FakeBackend) DeleteSource(host string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("delete_source"); err != nil {
+		return err
+	}
+	var kept []Source
+	for _, s := range f.SourcesReply {
+		if s.Name != host || s.Mode == SourceModeRefclock {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(f.SourcesReply) {
+		return fmt.Errorf("no source named %q", host)
+	}
+	f.SourcesReply = kept
+	return nil
+}
+
+func (f *FakeBackend) DeleteSources() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("delete_sources"); err != nil {
+		return "", err
+	}
+	f.SourcesReply = nil
+	f.SourceStatsReply = nil
+	f.NTPDataReply = nil
+	f.SelectDataReply = nil
+	return f.DeleteOutput, nil
+}
+
+func (f *FakeBackend) RunAction(action DaemonAction) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("daemon_action"); err != nil {
+		return "", err
+	}
+	f.Actions = append(f.Actions, action)
+	return "200 OK", nil
+}
+
+func (f *FakeBackend) ReadConfig() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("read_config"); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), f.Config...), nil
+}
+
+func (f *FakeBackend) WriteConfig(content []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("write_config"); err != nil {
+		return err
+	}
+	f.Config = append([]byte(nil), content...)
+	return nil
+}
+
+func (f *FakeBackend) Restart() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("restart"); err != nil {
+		return err
+	}
+	f.Restarts++
+	return nil
+}
+
+func (f *FakeBackend) Daemon() (*DaemonStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("daemon"); err != nil {
+		return nil, err
+	}
+	return f.DaemonReply, nil
+}
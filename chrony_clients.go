@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"el/brick-clock/cmdmon"
+)
+
+// Client is the typed form of one row of "chronyc clients": the NTP and
+// command packets chronyd has seen from an address. Intervals are the
+// average time between packets in seconds; Last is how long ago the last
+// packet arrived. Each is nil when chronyc shows "-".
+type Client struct {
+	Address            string   `json:"address"`
+	NTPPackets         uint64   `json:"ntp_packets"`
+	NTPDropped         uint64   `json:"ntp_dropped"`
+	NTPInterval        *float64 `json:"ntp_interval_seconds"`
+	NTPTimeoutInterval *float64 `json:"ntp_timeout_interval_seconds"`
+	NTPLast            *int64   `json:"ntp_last_seconds"`
+	CmdPackets         uint64   `json:"cmd_packets"`
+	CmdDropped         uint64   `json:"cmd_dropped"`
+	CmdInterval        *float64 `json:"cmd_interval_seconds"`
+	CmdLast            *int64   `json:"cmd_last_seconds"`
+
+	raw string
+}
+
+// parseClients parses "chronyc clients" output
+func parseClients(output string) ([]Client, error) {
+	clients := []Client{}
+	for _, line := range chronycTableRows(output) {
+		// Example line: 192.168.1.10                   12      0   6   -    23       0      0   -     -
+		fields := strings.Fields(line)
+		if len(fields) != 10 {
+			return nil, fmt.Errorf("unrecognised clients line %q", line)
+		}
+		c := Client{Address: fields[0], raw: line}
+		var err error
+		if c.NTPPackets, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("client %s NTP: %v", c.Address, err)
+		}
+		if c.NTPDropped, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("client %s NTP drop: %v", c.Address, err)
+		}
+		if c.NTPInterval, err = parseClientInterval(fields[3]); err != nil {
+			return nil, fmt.Errorf("client %s NTP interval: %v", c.Address, err)
+		}
+		if c.NTPTimeoutInterval, err = parseClientInterval(fields[4]); err != nil {
+			return nil, fmt.Errorf("client %s NTP IntL: %v", c.Address, err)
+		}
+		if c.NTPLast, err = parseClientLast(fields[5]); err != nil {
+			return nil, fmt.Errorf("client %s NTP last: %v", c.Address, err)
+		}
+		if c.CmdPackets, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("client %s cmd: %v", c.Address, err)
+		}
+		if c.CmdDropped, err = strconv.ParseUint(fields[7], 10, 64); err != nil {
+			return nil, fmt.Errorf("client %s cmd drop: %v", c.Address, err)
+		}
+		if c.CmdInterval, err = parseClientInterval(fields[8]); err != nil {
+			return nil, fmt.Errorf("client %s cmd interval: %v", c.Address, err)
+		}
+		if c.CmdLast, err = parseClientLast(fields[9]); err != nil {
+			return nil, fmt.Errorf("client %s cmd last: %v", c.Address, err)
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// parseClientInterval converts a log2 interval column to seconds
+func parseClientInterval(s string) (*float64, error) {
+	if s == "-" {
+		return nil, nil
+	}
+	log2, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	v := math.Ldexp(1, log2)
+	return &v, nil
+}
+
+func parseClientLast(s string) (*int64, error) {
+	if s == "-" {
+		return nil, nil
+	}
+	v, err := parseChronycInterval(s)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// chronyd reports an interval it has no rate for as this value
+const clientIntervalInvalid = 127
+
+func clientIntervalFromCmdmon(log2 int8) *float64 {
+	if log2 == clientIntervalInvalid {
+		return nil
+	}
+	v := math.Ldexp(1, int(log2))
+	return &v
+}
+
+func clientLastFromCmdmon(ago uint32) *int64 {
+	if ago == math.MaxUint32 {
+		return nil
+	}
+	v := int64(ago)
+	return &v
+}
+
+// clientFromCmdmon converts an entry of the cmdmon client access table.
+func clientFromCmdmon(r *cmdmon.ClientAccess) Client {
+	c := Client{
+		NTPPackets:         uint64(r.NTPHits),
+		NTPDropped:         uint64(r.NTPDrops),
+		NTPInterval:        clientIntervalFromCmdmon(r.NTPInterval),
+		NTPTimeoutInterval: clientIntervalFromCmdmon(r.NTPTimeoutInterval),
+		NTPLast:            clientLastFromCmdmon(r.LastNTPHitAgo),
+		CmdPackets:         uint64(r.CmdHits),
+		CmdDropped:         uint64(r.CmdDrops),
+		CmdInterval:        clientIntervalFromCmdmon(r.CmdInterval),
+		CmdLast:            clientLastFromCmdmon(r.LastCmdHitAgo),
+	}
+	if r.IPAddr != nil {
+		c.Address = r.IPAddr.String()
+	}
+	return c
+}
+
+// legacyMap renders the client in the v1 shape, with chronyc's column
+// values as strings.
+func (c *Client) legacyMap() map[string]string {
+	interval := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.Itoa(int(math.Round(math.Log2(*v))))
+	}
+	last := func(v *int64) string {
+		if v == nil {
+			return "-"
+		}
+		return formatChronycInterval(*v)
+	}
+	m := map[string]string{
+		"address":      c.Address,
+		"ntp_packets":  strconv.FormatUint(c.NTPPackets, 10),
+		"ntp_dropped":  strconv.FormatUint(c.NTPDropped, 10),
+		"ntp_interval": interval(c.NTPInterval),
+		"ntp_last":     last(c.NTPLast),
+		"cmd_packets":  strconv.FormatUint(c.CmdPackets, 10),
+		"cmd_dropped":  strconv.FormatUint(c.CmdDropped, 10),
+		"cmd_interval": interval(c.CmdInterval),
+		"cmd_last":     last(c.CmdLast),
+	}
+	if c.raw != "" {
+		m["raw"] = c.raw
+	}
+	return m
+}
+
+// clientSorts are the orders accepted by /status/clients?sort=. Counters
+// sort busiest first, ages most recent first and never-seen last.
+var clientSorts = map[string]func(a, b *Client) bool{
+	"address":     func(a, b *Client) bool { return a.Address < b.Address },
+	"ntp_packets": func(a, b *Client) bool { return a.NTPPackets > b.NTPPackets },
+	"ntp_dropped": func(a, b *Client) bool { return a.NTPDropped > b.NTPDropped },
+	"cmd_packets": func(a, b *Client) bool { return a.CmdPackets > b.CmdPackets },
+	"cmd_dropped": func(a, b *Client) bool { return a.CmdDropped > b.CmdDropped },
+	"ntp_last":    func(a, b *Client) bool { return lessAgo(a.NTPLast, b.NTPLast) },
+	"cmd_last":    func(a, b *Client) bool { return lessAgo(a.CmdLast, b.CmdLast) },
+}
+
+func lessAgo(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a != nil && b == nil
+	}
+	return *a < *b
+}
+
+// ClientQuery selects and orders the client table.
+type ClientQuery struct {
+	Sort       string
+	Limit      int
+	MinPackets uint64
+}
+
+// parseClientQuery reads ?sort=, ?limit= and ?min_packets=.
+func parseClientQuery(values url.Values) (ClientQuery, error) {
+	q := ClientQuery{Sort: values.Get("sort")}
+	if q.Sort != "" {
+		if _, ok := clientSorts[q.Sort]; !ok {
+			return q, fmt.Errorf("unknown sort %q", q.Sort)
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		q.Limit = limit
+	}
+	if s := values.Get("min_packets"); s != "" {
+		minPackets, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid min_packets %q", s)
+		}
+		q.MinPackets = minPackets
+	}
+	return q, nil
+}
+
+// Apply returns the clients with at least MinPackets NTP packets, sorted
+// and truncated to Limit (0 means no limit). clients is not modified.
+func (q ClientQuery) Apply(clients []Client) []Client {
+	result := make([]Client, 0, len(clients))
+	for _, c := range clients {
+		if c.NTPPackets >= q.MinPackets {
+			result = append(result, c)
+		}
+	}
+	if less, ok := clientSorts[q.Sort]; ok {
+		sort.SliceStable(result, func(i, j int) bool {
+			return less(&result[i], &result[j])
+		})
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result
+}
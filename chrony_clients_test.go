@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func float64p(v float64) *float64 { return &v }
+
+func TestParseClients(t *testing.T) {
+	clients, err := parseClients(readTestdata(t, "clients.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address                 string
+		ntpPackets, ntpDropped  uint64
+		ntpInterval, ntpTimeout *float64
+		ntpLast                 *int64
+		cmdPackets, cmdDropped  uint64
+		cmdInterval             *float64
+		cmdLast                 *int64
+	}{
+		{"localhost", 0, 0, nil, nil, nil, 14, 0, float64p(16), int64p(3)},
+		{"192.0.2.10", 1523, 0, float64p(64), nil, int64p(25 * 60), 0, 0, nil, nil},
+		{"2001:db8::20", 86, 12, float64p(0.25), float64p(8), int64p(10), 0, 0, nil, nil},
+		{"198.51.100.7", 4, 0, float64p(1024), nil, int64p(4 * 86400), 0, 0, nil, nil},
+		{"203.0.113.5", 0, 0, nil, nil, nil, 2, 1, nil, int64p(10 * 3600)},
+		{"ntp-client.example.com", 310, 5, float64p(32), float64p(64), int64p(1187), 0, 0, nil, nil},
+	}
+	if len(clients) != len(tests) {
+		t.Fatalf("parsed %d clients, want %d", len(clients), len(tests))
+	}
+	floatEq := func(a, b *float64) bool { return (a == nil) == (b == nil) && (a == nil || *a == *b) }
+	intEq := func(a, b *int64) bool { return (a == nil) == (b == nil) && (a == nil || *a == *b) }
+	for i, tt := range tests {
+		c := clients[i]
+		if c.Address != tt.address || c.NTPPackets != tt.ntpPackets || c.NTPDropped != tt.ntpDropped ||
+			c.CmdPackets != tt.cmdPackets || c.CmdDropped != tt.cmdDropped {
+			t.Errorf("client %d = %s ntp %d/%d cmd %d/%d, want %s ntp %d/%d cmd %d/%d", i,
+				c.Address, c.NTPPackets, c.NTPDropped, c.CmdPackets, c.CmdDropped,
+				tt.address, tt.ntpPackets, tt.ntpDropped, tt.cmdPackets, tt.cmdDropped)
+		}
+		if !floatEq(c.NTPInterval, tt.ntpInterval) || !floatEq(c.NTPTimeoutInterval, tt.ntpTimeout) ||
+			!floatEq(c.CmdInterval, tt.cmdInterval) {
+			t.Errorf("client %s intervals = %v %v %v, want %v %v %v", c.Address,
+				c.NTPInterval, c.NTPTimeoutInterval, c.CmdInterval, tt.ntpInterval, tt.ntpTimeout, tt.cmdInterval)
+		}
+		if !intEq(c.NTPLast, tt.ntpLast) || !intEq(c.CmdLast, tt.cmdLast) {
+			t.Errorf("client %s last = %v %v, want %v %v", c.Address, c.NTPLast, c.CmdLast, tt.ntpLast, tt.cmdLast)
+		}
+	}
+
+	for _, output := range []string{
+		"Hostname  NTP\n=====\n192.0.2.1 1 0 6 - 10 0 0 -\n",
+		"Hostname  NTP\n=====\n192.0.2.1 x 0 6 - 10 0 0 - -\n",
+		"Hostname  NTP\n=====\n192.0.2.1 1 0 six - 10 0 0 - -\n",
+		"Hostname  NTP\n=====\n192.0.2.1 1 0 6 - 10min 0 0 - -\n",
+	} {
+		if c, err := parseClients(output); err == nil {
+			t.Errorf("parseClients(%q) = %+v, want an error", output, c)
+		}
+	}
+}
+
+func TestClientsLegacyMap(t *testing.T) {
+	clients, err := parseClients(readTestdata(t, "clients.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := make([]map[string]string, 0, len(clients))
+	for i := range clients {
+		legacy = append(legacy, clients[i].legacyMap())
+	}
+	checkGolden(t, "clients.legacy.json", legacy)
+
+	// v1 clients compare the columns with what chronyc printed
+	columns := []string{"address", "ntp_packets", "ntp_dropped", "ntp_interval", "", "ntp_last",
+		"cmd_packets", "cmd_dropped", "cmd_interval", "cmd_last"}
+	for _, m := range legacy {
+		for i, field := range strings.Fields(m["raw"]) {
+			if columns[i] != "" && m[columns[i]] != field {
+				t.Errorf("client %s: %s %q, chronyc printed %q", m["address"], columns[i], m[columns[i]], field)
+			}
+		}
+	}
+}
+
+func TestParseClientQuery(t *testing.T) {
+	q, err := parseClientQuery(url.Values{"sort": {"ntp_dropped"}, "limit": {"5"}, "min_packets": {"10"}})
+	if err != nil || q != (ClientQuery{Sort: "ntp_dropped", Limit: 5, MinPackets: 10}) {
+		t.Errorf("parseClientQuery = %+v, %v", q, err)
+	}
+	if q, err := parseClientQuery(url.Values{}); err != nil || q != (ClientQuery{}) {
+		t.Errorf("empty query = %+v, %v", q, err)
+	}
+	for _, values := range []url.Values{
+		{"sort": {"hostname"}},
+		{"sort": {"NTP_PACKETS"}},
+		{"limit": {"-1"}},
+		{"limit": {"ten"}},
+		{"min_packets": {"-1"}},
+	} {
+		if q, err := parseClientQuery(values); err == nil {
+			t.Errorf("parseClientQuery(%v) = %+v, want an error", values, q)
+		}
+	}
+}
+
+func TestClientQueryApply(t *testing.T) {
+	clients, err := parseClients(readTestdata(t, "clients.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := func(cs []Client) []string {
+		var result []string
+		for _, c := range cs {
+			result = append(result, c.Address)
+		}
+		return result
+	}
+	tests := []struct {
+		query ClientQuery
+		want  []string
+	}{
+		{ClientQuery{}, []string{"localhost", "192.0.2.10", "2001:db8::20", "198.51.100.7", "203.0.113.5", "ntp-client.example.com"}},
+		{ClientQuery{Sort: "ntp_packets", Limit: 3}, []string{"192.0.2.10", "ntp-client.example.com", "2001:db8::20"}},
+		{ClientQuery{Sort: "ntp_dropped", Limit: 2}, []string{"2001:db8::20", "ntp-client.example.com"}},
+		{ClientQuery{Sort: "address"}, []string{"192.0.2.10", "198.51.100.7", "2001:db8::20", "203.0.113.5", "localhost", "ntp-client.example.com"}},
+		// Clients that never sent an NTP packet sort last, in table order
+		{ClientQuery{Sort: "ntp_last"}, []string{"2001:db8::20", "ntp-client.example.com", "192.0.2.10", "198.51.100.7", "localhost", "203.0.113.5"}},
+		{ClientQuery{Sort: "cmd_last"}, []string{"localhost", "203.0.113.5", "192.0.2.10", "2001:db8::20", "198.51.100.7", "ntp-client.example.com"}},
+		{ClientQuery{MinPackets: 86}, []string{"192.0.2.10", "2001:db8::20", "ntp-client.example.com"}},
+		{ClientQuery{Sort: "ntp_packets", Limit: 10, MinPackets: 1000}, []string{"192.0.2.10"}},
+	}
+	for _, tt := range tests {
+		got := addresses(tt.query.Apply(clients))
+		if len(got) != len(tt.want) {
+			t.Errorf("%+v = %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%+v = %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+	if clients[0].Address != "localhost" {
+		t.Error("Apply reordered the table it was given")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot holds every status section sampled in one collection. Each
+// chronyd section is the value the backend returned, or its error.
+type Snapshot struct {
+	Time        time.Time
+	Tracking    interface{} // *Tracking or error
+	Sources     interface{} // []Source or error
+	SourceStats interface{} // []SourceStats or error
+	Activity    interface{} // *Activity or error
+	Clients     interface{} // []Client or error
+	ServerMode  ServerModeResponse
+}
+
+// Age is how long ago the snapshot was taken.
+func (s *Snapshot) Age() time.Duration {
+	return time.Since(s.Time)
+}
+
+// collector samples the status sections in the background and publishes
+// them as one Snapshot, so that handlers never wait for chronyd.
+type collector struct {
+	collect   func() *Snapshot
+	observers []func(*Snapshot)
+
+	// mu serializes collections; snapshot is read without it
+	mu       sync.Mutex
+	snapshot atomic.Value
+}
+
+func newCollector(collect func() *Snapshot) *collector {
+	return &collector{collect: collect}
+}
+
+// OnSnapshot calls f with every new snapshot, in the order they are
+// collected. Observers must be added before Start.
+func (c *collector) OnSnapshot(f func(*Snapshot)) {
+	c.observers = append(c.observers, f)
+}
+
+// Start collects a snapshot every interval, the first one right away.
+func (c *collector) Start(interval time.Duration) {
+	log.Printf("Collecting chrony status every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.Refresh()
+			<-ticker.C
+		}
+	}()
+}
+
+// Snapshot returns the latest snapshot. Only before the first collection
+// has finished does it wait for one.
+func (c *collector) Snapshot() *Snapshot {
+	if s, ok := c.snapshot.Load().(*Snapshot); ok {
+		return s
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.snapshot.Load().(*Snapshot); ok {
+		return s
+	}
+	return c.refresh()
+}
+
+// Refresh collects and publishes a snapshot now, for changes that must be
+// visible to the next request.
+func (c *collector) Refresh() *Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refresh()
+}
+
+// refresh collects a snapshot and hands it to the observers. Callers hold
+// c.mu.
+func (c *collector) refresh() *Snapshot {
+	s := c.collect()
+	c.snapshot.Store(s)
+	for _, f := range c.observers {
+		f(s)
+	}
+	return s
+}
+
+// collectSnapshot queries every section concurrently, so that they
+// describe the same moment as closely as chronyd allows.
+func (a *App) collectSnapshot() *Snapshot {
+	s := &Snapshot{Time: time.Now().UTC()}
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	run(func() { s.Tracking = valueOrError(a.backend.Tracking()) })
+	run(func() { s.Sources = valueOrError(a.backend.Sources()) })
+	run(func() { s.SourceStats = valueOrError(a.backend.SourceStats()) })
+	run(func() { s.Activity = valueOrError(a.backend.Activity()) })
+	run(func() { s.Clients = valueOrError(a.backend.Clients()) })
+	run(func() { s.ServerMode = a.getServerModeStatus() })
+	wg.Wait()
+	return s
+}
+
+func valueOrError(v interface{}, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return v
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_CONF_BACKUPS is how many backups of chrony.conf are kept unless
+// CHRONY_CONF_BACKUPS says otherwise.
+const DEFAULT_CONF_BACKUPS = 10
+
+// backupTimeFormat names backups so that they sort by time.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// localChrony is the part shared by the backends that manage a real
+// chronyd: the config file on disk and the daemon process.
+type localChrony struct {
+	confPath string
+	// backupDir holds timestamped copies of chrony.conf, the newest
+	// backups of them.
+	backupDir string
+	backups   int
+	// supervisor owns the chronyd process, or is nil when chronyd is
+	// managed outside the API.
+	supervisor *chronydSupervisor
+}
+
+func newLocalChrony(confPath string, supervisor *chronydSupervisor) localChrony {
+	backups := DEFAULT_CONF_BACKUPS
+	if s := os.Getenv("CHRONY_CONF_BACKUPS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			backups = n
+		} else {
+			log.Printf("Ignoring invalid CHRONY_CONF_BACKUPS %q", s)
+		}
+	}
+	return localChrony{
+		confPath:   confPath,
+		backupDir:  filepath.Join(filepath.Dir(confPath), "backups"),
+		backups:    backups,
+		supervisor: supervisor,
+	}
+}
+
+func (l *localChrony) ReadConfig() ([]byte, error) {
+	return ioutil.ReadFile(l.confPath)
+}
+
+// WriteConfig replaces chrony.conf atomically: content is written to a
+// temporary file next to it, synced and renamed over it, so a crash
+// leaves either the old or the new file. The old file is backed up first.
+func (l *localChrony) WriteConfig(content []byte) error {
+	if err := l.backup(); err != nil {
+		return fmt.Errorf("failed to back up %s: %v", l.confPath, err)
+	}
+	return writeFileAtomic(l.confPath, content, 0644)
+}
+
+// backup copies the current chrony.conf into backupDir and removes the
+// oldest backups beyond the configured count.
+func (l *localChrony) backup() error {
+	if l.backups == 0 {
+		return nil
+	}
+	current, err := ioutil.ReadFile(l.confPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.backupDir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Base(l.confPath) + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := writeFileAtomic(filepath.Join(l.backupDir, name), current, 0644); err != nil {
+		return err
+	}
+
+	backups, err := l.listBackups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.backups {
+		if err := os.Remove(filepath.Join(l.backupDir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// listBackups returns the backup file names, oldest first.
+func (l *localChrony) listBackups() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.backupDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(l.confPath) + "."
+	var names []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of
+// path, syncs it and renames it to path, then syncs the directory so the
+// rename itself is durable.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Remove is a no-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
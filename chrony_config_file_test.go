@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteConfigPrunesBackups(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "chrony.conf")
+	t.Setenv("CHRONY_CONF_BACKUPS", "3")
+	l := newLocalChrony(confPath, nil)
+
+	// The first write has no file to back up
+	for i := 0; i < 6; i++ {
+		if err := l.WriteConfig([]byte(fmt.Sprintf("# version %d\n", i))); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if content, err := os.ReadFile(confPath); err != nil || string(content) != "# version 5\n" {
+		t.Fatalf("chrony.conf = %q, %v", content, err)
+	}
+	backups, err := l.listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("backups = %v, want the 3 newest", backups)
+	}
+	for i, name := range backups {
+		content, err := os.ReadFile(filepath.Join(l.backupDir, name))
+		if want := fmt.Sprintf("# version %d\n", i+2); err != nil || string(content) != want {
+			t.Errorf("backup %s = %q, %v; want %q", name, content, err, want)
+		}
+	}
+
+	// Nothing but chrony.conf and the backups is left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("config directory holds %v", entries)
+	}
+}
+
+func TestWriteConfigWithoutBackups(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CHRONY_CONF_BACKUPS", "0")
+	l := newLocalChrony(filepath.Join(dir, "chrony.conf"), nil)
+	for i := 0; i < 2; i++ {
+		if err := l.WriteConfig([]byte("server time.example.com\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(l.backupDir); !os.IsNotExist(err) {
+		t.Errorf("backup directory created with CHRONY_CONF_BACKUPS=0: %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chrony.conf")
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "new\n" || info.Mode().Perm() != 0644 {
+		t.Errorf("after writeFileAtomic: %q, mode %v", content, info.Mode())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+}
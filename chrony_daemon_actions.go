@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DaemonAction is an operational command for the running chronyd, the
+// API's version of the chronyc commands of the same names.
+type DaemonAction struct {
+	Action string `json:"action"`
+	// Source selects the sources of burst, online and offline by address
+	// or configured name; empty means all sources.
+	Source string `json:"source,omitempty"`
+	// GoodSamples and TotalSamples are the burst size, 4 and 8 by default.
+	GoodSamples  int `json:"good_samples,omitempty"`
+	TotalSamples int `json:"total_samples,omitempty"`
+	// Threshold (seconds) and Limit (clock updates, -1 for no limit)
+	// change chronyd's automatic makestep setting. Without them, makestep
+	// steps the clock now.
+	Threshold *float64 `json:"threshold,omitempty"`
+	Limit     *int     `json:"limit,omitempty"`
+}
+
+// daemonActionPermissions maps each action to the permission it needs.
+var daemonActionPermissions = map[string]string{
+	"burst":          "clock/daemon/burst",
+	"online":         "clock/daemon/online",
+	"offline":        "clock/daemon/offline",
+	"makestep":       "clock/daemon/makestep",
+	"reload_sources": "clock/daemon/reload_sources",
+	"rekey":          "clock/daemon/rekey",
+	"cyclelogs":      "clock/daemon/cyclelogs",
+	"dump":           "clock/daemon/dump",
+}
+
+// daemonActionNames returns the known actions, sorted.
+func daemonActionNames() []string {
+	names := make([]string, 0, len(daemonActionPermissions))
+	for name := range daemonActionPermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the action and its parameters, and fills in the burst
+// defaults.
+func (a *DaemonAction) Validate() error {
+	if _, ok := daemonActionPermissions[a.Action]; !ok {
+		return fmt.Errorf("unknown action %q (known: %s)", a.Action, strings.Join(daemonActionNames(), ", "))
+	}
+	switch a.Action {
+	case "burst", "online", "offline":
+	default:
+		if a.Source != "" {
+			return fmt.Errorf("%s does not take a source", a.Action)
+		}
+	}
+	if a.Source != "" && net.ParseIP(a.Source) == nil && !hostnameRegex.MatchString(a.Source) {
+		return fmt.Errorf("invalid source %q", a.Source)
+	}
+
+	if a.Action == "burst" {
+		if a.GoodSamples == 0 {
+			a.GoodSamples = 4
+		}
+		if a.TotalSamples == 0 {
+			a.TotalSamples = 8
+		}
+		if a.GoodSamples < 1 || a.TotalSamples < a.GoodSamples {
+			return fmt.Errorf("burst needs 1 <= good_samples <= total_samples")
+		}
+	} else if a.GoodSamples != 0 || a.TotalSamples != 0 {
+		return fmt.Errorf("good_samples and total_samples only apply to burst")
+	}
+
+	if a.Threshold != nil || a.Limit != nil {
+		if a.Action != "makestep" {
+			return fmt.Errorf("threshold and limit only apply to makestep")
+		}
+		if a.Threshold == nil || a.Limit == nil {
+			return fmt.Errorf("makestep needs both threshold and limit")
+		}
+		if *a.Threshold <= 0 {
+			return fmt.Errorf("threshold must be positive")
+		}
+		if *a.Limit < -1 || *a.Limit == 0 {
+			return fmt.Errorf("limit must be a positive number of clock updates, or -1 for no limit")
+		}
+	}
+	return nil
+}
+
+// chronycArgs returns the chronyc command line for the action, for the
+// sources at addr ("" for all).
+func (a *DaemonAction) chronycArgs(addr string) []string {
+	var args []string
+	switch a.Action {
+	case "burst":
+		args = []string{"burst", fmt.Sprintf("%d/%d", a.GoodSamples, a.TotalSamples)}
+	case "makestep":
+		args = []string{"makestep"}
+		if a.Threshold != nil {
+			args = append(args, fmt.Sprint(*a.Threshold), fmt.Sprint(*a.Limit))
+		}
+	case "reload_sources":
+		args = []string{"reload", "sources"}
+	default:
+		args = []string{a.Action}
+	}
+	if addr != "" {
+		args = append(args, addr)
+	}
+	return args
+}
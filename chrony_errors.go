@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes of the error envelope. They are part of the API: clients
+// switch on them, so existing codes must not change.
+const (
+	ERR_INVALID_JSON       = "invalid_json"
+	ERR_INVALID_REQUEST    = "invalid_request"
+	ERR_UNAUTHORIZED       = "unauthorized"
+	ERR_FORBIDDEN          = "forbidden"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERR_CONFLICT           = "conflict"
+	ERR_TOO_MANY_REQUESTS  = "too_many_requests"
+	// chrony.conf could not be read or written
+	ERR_CONFIG = "config_error"
+	// chronyd did not answer, rejected a command or did not come up after
+	// a restart
+	ERR_CHRONYD = "chronyd_error"
+)
+
+// requestIDHeader carries the request ID. A caller's ID is kept, so that
+// it can be followed through the logs of both sides.
+const requestIDHeader = "X-Request-ID"
+
+// APIError is the body of the error envelope. Details is optional and its
+// shape depends on the code, e.g. the permission that was missing.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// ErrorResponse is what every handler responds with on failure.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// withRequestID makes sure every request has an ID, and sets it on the
+// response before next runs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID accepts short IDs of printable ASCII, which are safe to
+// log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeError responds with the error envelope. Server-side failures are
+// logged with the request ID.
+func writeError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	id := w.Header().Get(requestIDHeader)
+	if status >= 500 {
+		log.Printf("Request %s failed: %s", id, message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: id,
+	}})
+}
+
+// fieldError is a validation error of one field of a request, named as
+// in the request, e.g. "servers[2]".
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+// fieldDetails returns the details naming the field err is about, if any.
+func fieldDetails(err error) interface{} {
+	if fe, ok := err.(*fieldError); ok {
+		return map[string]interface{}{"field": fe.Field}
+	}
+	return nil
+}
+
+// handleNotFound answers the paths no route matches.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Not found: "+r.URL.Path, nil)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBufferSize is how many events are kept for clients resuming
+	// with Last-Event-ID.
+	eventBufferSize = 1024
+	// streamKeepAlive is how often an idle stream gets a comment, so that
+	// proxies do not close it.
+	streamKeepAlive = 20 * time.Second
+	// streamRetry is the reconnection delay suggested to clients.
+	streamRetry = 5 * time.Second
+)
+
+// statusEvent is one server-sent event. A "status" event carries a
+// snapshot, rendered for each client's flags and schema; the others carry
+// the change in Data. Flag is the STATUS_* section the event belongs to.
+type statusEvent struct {
+	ID   uint64
+	Type string
+	Flag int
+	Snap *Snapshot
+	Data map[string]interface{}
+}
+
+// eventBroker turns the collected snapshots into status events: a
+// "status" event per snapshot, and change events found by comparing it to
+// the previous one. It keeps the latest events so that clients can resume.
+type eventBroker struct {
+	offsetThreshold float64
+
+	mu     sync.Mutex
+	events []statusEvent
+	nextID uint64
+	prev   *Snapshot
+	// changed is closed, and replaced, when events are added
+	changed chan struct{}
+}
+
+// newEventBroker returns a broker reporting system clock offsets beyond
+// offsetThreshold seconds. Event IDs start from the current time in
+// milliseconds, so IDs from an earlier process are never mistaken for
+// ones that can be resumed.
+func newEventBroker(offsetThreshold float64) *eventBroker {
+	return &eventBroker{
+		offsetThreshold: offsetThreshold,
+		nextID:          uint64(time.Now().UnixMilli()) * 1000,
+		changed:         make(chan struct{}),
+	}
+}
+
+// Publish adds the events of snap.
+func (b *eventBroker) Publish(snap *Snapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prev != nil {
+		for _, e := range b.changes(b.prev, snap) {
+			b.add(e)
+		}
+	}
+	b.add(statusEvent{Type: "status", Snap: snap})
+	b.prev = snap
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// add stores e with the next ID. Callers hold b.mu.
+func (b *eventBroker) add(e statusEvent) {
+	b.nextID++
+	e.ID = b.nextID
+	b.events = append(b.events, e)
+	if len(b.events) > 2*eventBufferSize {
+		b.events = append([]statusEvent(nil), b.events[len(b.events)-eventBufferSize:]...)
+	}
+}
+
+// changes compares two snapshots. Sections that failed in either one are
+// skipped.
+func (b *eventBroker) changes(prev, next *Snapshot) []statusEvent {
+	var events []statusEvent
+	change := func(typ string, flag int, data map[string]interface{}) {
+		data["time"] = next.Time
+		events = append(events, statusEvent{Type: typ, Flag: flag, Data: data})
+	}
+
+	prevTracking, ok1 := prev.Tracking.(*Tracking)
+	nextTracking, ok2 := next.Tracking.(*Tracking)
+	if ok1 && ok2 {
+		if prevTracking.LeapStatus != nextTracking.LeapStatus {
+			change("leap_status", STATUS_TRACKING, map[string]interface{}{
+				"from": prevTracking.LeapStatus,
+				"to":   nextTracking.LeapStatus,
+			})
+		}
+		was := math.Abs(prevTracking.SystemTime) > b.offsetThreshold
+		is := math.Abs(nextTracking.SystemTime) > b.offsetThreshold
+		if was != is {
+			change("offset_threshold", STATUS_TRACKING, map[string]interface{}{
+				"exceeded":            is,
+				"system_time_seconds": nextTracking.SystemTime,
+				"threshold_seconds":   b.offsetThreshold,
+			})
+		}
+	}
+
+	prevSources, ok1 := prev.Sources.([]Source)
+	nextSources, ok2 := next.Sources.([]Source)
+	if ok1 && ok2 {
+		if from, to := selectedSource(prevSources), selectedSource(nextSources); from != to {
+			change("source_selected", STATUS_SOURCES, map[string]interface{}{
+				"from": from,
+				"to":   to,
+			})
+		}
+		prevStates := make(map[string]SourceState, len(prevSources))
+		for i := range prevSources {
+			prevStates[prevSources[i].Name] = prevSources[i].State
+		}
+		for i := range nextSources {
+			s := &nextSources[i]
+			prevState, known := prevStates[s.Name]
+			// A source that was just added starts out unreachable
+			if !known {
+				continue
+			}
+			switch {
+			case prevState != SourceStateUnreachable && s.State == SourceStateUnreachable:
+				change("source_unreachable", STATUS_SOURCES, map[string]interface{}{"source": s.Name, "reach": s.Reach})
+			case prevState == SourceStateUnreachable && s.State != SourceStateUnreachable:
+				change("source_reachable", STATUS_SOURCES, map[string]interface{}{"source": s.Name, "state": s.State})
+			}
+		}
+	}
+
+	if prev.ServerMode.ServerModeEnabled != next.ServerMode.ServerModeEnabled {
+		change("server_mode", STATUS_SERVER_MODE, map[string]interface{}{
+			"server_mode_enabled": next.ServerMode.ServerModeEnabled,
+		})
+	}
+	return events
+}
+
+// selectedSource returns the name of the source chronyd synchronises to,
+// or "" if there is none.
+func selectedSource(sources []Source) string {
+	for i := range sources {
+		if sources[i].State == SourceStateSelected {
+			return sources[i].Name
+		}
+	}
+	return ""
+}
+
+// since returns the events after lastID and a channel closed when more
+// are added. ok is false when events after lastID were already dropped,
+// or lastID is unknown.
+func (b *eventBroker) since(lastID uint64) (events []statusEvent, changed chan struct{}, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	oldest := b.nextID + 1
+	if len(b.events) > 0 {
+		oldest = b.events[0].ID
+	}
+	if lastID > b.nextID || lastID+1 < oldest {
+		return nil, b.changed, false
+	}
+	for i := range b.events {
+		if b.events[i].ID > lastID {
+			events = append(events, b.events[i])
+		}
+	}
+	return events, b.changed, true
+}
+
+// latest returns the ID of the latest event.
+func (b *eventBroker) latest() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextID
+}
+
+// notify returns a channel closed when events are next added.
+func (b *eventBroker) notify() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changed
+}
+
+// handleStatusStream serves the status events as server-sent events:
+// GET /status/stream?flags=. A client that reconnects with Last-Event-ID
+// (or ?last_event_id=) gets the events it missed; otherwise it starts with
+// the current status.
+func (a *App) handleStatusStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	flags := statusFlags(r)
+	v2 := schemaV2(r)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	resume := lastEventID != ""
+	if resume {
+		var err error
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("invalid Last-Event-ID %q", lastEventID), nil)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+	var events []statusEvent
+	var changed chan struct{}
+	ok := false
+	if resume {
+		events, changed, ok = a.events.since(lastID)
+	}
+	if !ok {
+		// Start from the current status
+		snap := a.collector.Snapshot()
+		lastID = a.events.latest()
+		writeStatusEvent(w, statusEvent{ID: lastID, Type: "status", Snap: snap}, flags, v2)
+		events, changed, _ = a.events.since(lastID)
+	}
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		for _, e := range events {
+			writeStatusEvent(w, e, flags, v2)
+			lastID = e.ID
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			events = nil
+		case <-changed:
+			if events, changed, ok = a.events.since(lastID); !ok {
+				// The client fell too far behind
+				return
+			}
+		}
+	}
+}
+
+// writeStatusEvent writes e if it belongs to a section selected by flags.
+func writeStatusEvent(w http.ResponseWriter, e statusEvent, flags int, v2 bool) {
+	if e.Flag != 0 && flags&e.Flag == 0 {
+		return
+	}
+	data := e.Data
+	if e.Type == "status" {
+		data = statusResponse(e.Snap, flags, v2)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, payload)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyMaxPoints bounds a history response. Longer ranges are
+// downsampled to fit.
+const historyMaxPoints = 1000
+
+// The values kept for tracking and for each source, in the order they are
+// stored.
+var (
+	trackingHistoryFields = []string{
+		"system_time_seconds", "last_offset_seconds", "rms_offset_seconds",
+		"frequency_ppm", "residual_frequency_ppm", "skew_ppm",
+		"root_delay_seconds", "root_dispersion_seconds", "stratum", "synchronised",
+	}
+	sourceHistoryFields = []string{
+		"offset_seconds", "error_seconds", "reach_ratio", "poll_interval_seconds",
+	}
+)
+
+// historySample is the tracking report (Source empty) or one source at
+// one collection.
+type historySample struct {
+	Time   time.Time
+	Source string
+	Values []float64
+}
+
+// historyRecord is a sample as stored on disk.
+type historyRecord struct {
+	Time   time.Time          `json:"time"`
+	Source string             `json:"source,omitempty"`
+	Values map[string]float64 `json:"values"`
+}
+
+// HistoryPoint is a sample, or the samples of one step when downsampled:
+// Values are then their means, with Min and Max.
+type HistoryPoint struct {
+	Time    time.Time          `json:"time"`
+	Samples int                `json:"samples"`
+	Values  map[string]float64 `json:"values"`
+	Min     map[string]float64 `json:"min,omitempty"`
+	Max     map[string]float64 `json:"max,omitempty"`
+}
+
+// historyStore keeps the tracking and source samples of the last
+// retention period in memory, sorted by time, and appends them to one
+// JSON-lines file per UTC day in dir. Files older than the retention
+// period are deleted. An empty dir keeps the history in memory only.
+//
+// Samples are kept sorted by inserting them in place rather than assuming
+// they arrive in order: a step of the system clock can give a collection
+// an earlier time than the one before.
+type historyStore struct {
+	dir       string
+	retention time.Duration
+
+	mu      sync.Mutex
+	samples []historySample
+	// partial holds the day files that end in an incomplete line, left by
+	// a write that was cut short, so the next write starts a new line
+	partial map[string]bool
+}
+
+// openHistoryStore loads the samples within retention from dir, creating
+// it if needed. Lines, or whole files, that cannot be read are logged and
+// skipped.
+func openHistoryStore(dir string, retention time.Duration) (*historyStore, error) {
+	h := &historyStore{dir: dir, retention: retention, partial: make(map[string]bool)}
+	if dir == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h.pruneFiles(time.Now().UTC())
+	files, err := filepath.Glob(filepath.Join(dir, "history-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	// The names sort by day
+	sort.Strings(files)
+	cutoff := time.Now().Add(-retention)
+	for _, path := range files {
+		if err := h.load(path, cutoff); err != nil {
+			log.Printf("Skipping the rest of history file %s: %v", path, err)
+		}
+	}
+	sort.SliceStable(h.samples, func(i, j int) bool {
+		return h.samples[i].Time.Before(h.samples[j].Time)
+	})
+	return h, nil
+}
+
+// load appends the samples of the file at path taken after cutoff.
+func (h *historyStore) load(path string, cutoff time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			h.partial[path] = true
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping history sample %s:%d: %v", path, line, err)
+			continue
+		}
+		if rec.Time.Before(cutoff) {
+			continue
+		}
+		fields := historyFields(rec.Source)
+		values := make([]float64, len(fields))
+		for i, name := range fields {
+			values[i] = rec.Values[name]
+		}
+		h.samples = append(h.samples, historySample{Time: rec.Time, Source: rec.Source, Values: values})
+	}
+	return scanner.Err()
+}
+
+func historyFields(source string) []string {
+	if source == "" {
+		return trackingHistoryFields
+	}
+	return sourceHistoryFields
+}
+
+// Record adds the tracking report and sources of snap. Sections chronyd
+// could not provide leave a gap.
+func (h *historyStore) Record(snap *Snapshot) {
+	var samples []historySample
+	if t, ok := snap.Tracking.(*Tracking); ok {
+		samples = append(samples, historySample{Time: snap.Time, Values: []float64{
+			t.SystemTime, t.LastOffset, t.RMSOffset,
+			t.Frequency, t.ResidualFrequency, t.Skew,
+			t.RootDelay, t.RootDispersion, float64(t.Stratum), boolValue(t.LeapStatus != LeapNotSynchronised),
+		}})
+	}
+	if sources, ok := snap.Sources.([]Source); ok {
+		for i := range sources {
+			s := &sources[i]
+			samples = append(samples, historySample{Time: snap.Time, Source: s.Name, Values: []float64{
+				s.Offset, s.Error, s.ReachRatio, s.PollInterval,
+			}})
+		}
+	}
+	if len(samples) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.insert(samples)
+	h.pruneMemory(snap.Time)
+	if h.dir == "" {
+		return
+	}
+	if err := h.append(samples); err != nil {
+		log.Printf("Failed to write history: %v", err)
+	}
+}
+
+// insert adds samples, which share one time, after the samples taken at
+// or before it. Callers hold h.mu.
+func (h *historyStore) insert(samples []historySample) {
+	t := samples[0].Time
+	i := sort.Search(len(h.samples), func(i int) bool {
+		return h.samples[i].Time.After(t)
+	})
+	n := len(h.samples)
+	h.samples = append(h.samples, samples...)
+	if i < n {
+		copy(h.samples[i+len(samples):], h.samples[i:n])
+		copy(h.samples[i:], samples)
+	}
+}
+
+// append writes samples to the file of their day. Callers hold h.mu.
+func (h *historyStore) append(samples []historySample) error {
+	day := samples[0].Time.UTC().Format("2006-01-02")
+	path := filepath.Join(h.dir, "history-"+day+".jsonl")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// First samples of a new day
+		h.pruneFiles(samples[0].Time.UTC())
+	}
+	var buf bytes.Buffer
+	for _, s := range samples {
+		fields := historyFields(s.Source)
+		rec := historyRecord{Time: s.Time, Source: s.Source, Values: make(map[string]float64, len(fields))}
+		for i, name := range fields {
+			rec.Values[name] = s.Values[i]
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if h.partial[path] {
+		data = append([]byte{'\n'}, data...)
+	}
+	if _, err := f.Write(data); err != nil {
+		h.partial[path] = true
+		f.Close()
+		return err
+	}
+	delete(h.partial, path)
+	return f.Close()
+}
+
+// pruneMemory drops the samples older than the retention period, an hour
+// at a time to avoid copying on every collection. Callers hold h.mu.
+func (h *historyStore) pruneMemory(now time.Time) {
+	if len(h.samples) == 0 || now.Sub(h.samples[0].Time) < h.retention+time.Hour {
+		return
+	}
+	cutoff := now.Add(-h.retention)
+	i := sort.Search(len(h.samples), func(i int) bool {
+		return !h.samples[i].Time.Before(cutoff)
+	})
+	h.samples = append([]historySample(nil), h.samples[i:]...)
+}
+
+// pruneFiles deletes the day files that end before the retention period.
+func (h *historyStore) pruneFiles(now time.Time) {
+	files, err := filepath.Glob(filepath.Join(h.dir, "history-*.jsonl"))
+	if err != nil {
+		return
+	}
+	cutoff := now.Add(-h.retention)
+	for _, path := range files {
+		day, err := time.Parse("2006-01-02", strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "history-"), ".jsonl"))
+		if err != nil || !day.Add(24*time.Hour).Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove expired history: %v", err)
+		}
+	}
+}
+
+// HasSource reports whether any sample of source is kept.
+func (h *historyStore) HasSource(source string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.samples) - 1; i >= 0; i-- {
+		if h.samples[i].Source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the samples of source ("" for tracking) in [from, to).
+// A step of 0 returns each sample, unless there would be more than
+// historyMaxPoints; the samples are then averaged per step. It returns
+// the step it used.
+func (h *historyStore) Query(source string, from, to time.Time, step time.Duration) ([]HistoryPoint, time.Duration) {
+	h.mu.Lock()
+	var samples []historySample
+	start := sort.Search(len(h.samples), func(i int) bool {
+		return !h.samples[i].Time.Before(from)
+	})
+	for i := start; i < len(h.samples) && h.samples[i].Time.Before(to); i++ {
+		if h.samples[i].Source == source {
+			samples = append(samples, h.samples[i])
+		}
+	}
+	h.mu.Unlock()
+
+	fields := historyFields(source)
+	if step == 0 && len(samples) > historyMaxPoints {
+		step = to.Sub(from) / historyMaxPoints
+		step = step.Truncate(time.Second) + time.Second
+	}
+	points := []HistoryPoint{}
+	if step == 0 {
+		for _, s := range samples {
+			points = append(points, HistoryPoint{Time: s.Time, Samples: 1, Values: namedValues(fields, s.Values)})
+		}
+		return points, 0
+	}
+
+	for i := 0; i < len(samples); {
+		bucket := samples[i].Time.Truncate(step)
+		sum := make([]float64, len(fields))
+		min := append([]float64(nil), samples[i].Values...)
+		max := append([]float64(nil), samples[i].Values...)
+		n := 0
+		for ; i < len(samples) && samples[i].Time.Truncate(step).Equal(bucket); i++ {
+			for j, v := range samples[i].Values {
+				sum[j] += v
+				min[j] = math.Min(min[j], v)
+				max[j] = math.Max(max[j], v)
+			}
+			n++
+		}
+		for j := range sum {
+			sum[j] /= float64(n)
+		}
+		points = append(points, HistoryPoint{
+			Time:    bucket,
+			Samples: n,
+			Values:  namedValues(fields, sum),
+			Min:     namedValues(fields, min),
+			Max:     namedValues(fields, max),
+		})
+	}
+	return points, step
+}
+
+func namedValues(fields []string, values []float64) map[string]float64 {
+	m := make(map[string]float64, len(fields))
+	for i, name := range fields {
+		m[name] = values[i]
+	}
+	return m
+}
+
+// parseHistoryTime parses a query time: RFC 3339, Unix seconds, or a
+// duration relative to now such as "-24h". Empty gives def.
+func parseHistoryTime(s string, now, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339, Unix seconds or a duration such as -24h", s)
+}
+
+// parseHistoryStep parses a step given as a duration or in seconds.
+func parseHistoryStep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.Atoi(s)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid step %q: use a duration such as 5m or seconds", s)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("step must be at least 1s")
+	}
+	return d, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func trackingSnapshot(at time.Time, offset float64) *Snapshot {
+	return &Snapshot{Time: at, Tracking: &Tracking{SystemTime: offset}, Sources: []Source{}}
+}
+
+func TestHistoryLoadSkipsMalformedLines(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+	path := filepath.Join(dir, "history-"+now.Format("2006-01-02")+".jsonl")
+	first := now.Add(-2 * time.Minute).Format(time.RFC3339)
+	second := now.Add(-time.Minute).Format(time.RFC3339)
+	content := `{"time":"` + first + `","values":{"system_time_seconds":0.001}}` + "\n" +
+		"{not json}\n" +
+		`{"time":"` + second + `","values":{"system_time_seconds":0.002}}` + "\n" +
+		`{"time":"` + second + `","sour`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openHistoryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("openHistoryStore: %v", err)
+	}
+	points, _ := h.Query("", now.Add(-time.Hour), now.Add(time.Hour), 0)
+	if len(points) != 2 || points[1].Values["system_time_seconds"] != 0.002 {
+		t.Fatalf("points = %+v, want the two valid samples", points)
+	}
+
+	h.Record(trackingSnapshot(now, 0.003))
+	reopened, err := openHistoryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	if points, _ := reopened.Query("", now.Add(-time.Hour), now.Add(time.Hour), 0); len(points) != 3 {
+		t.Errorf("after reopening got %d points, want 3: the new sample must not join the cut line", len(points))
+	}
+}
+
+func TestHistoryKeepsTimeOrderAcrossClockSteps(t *testing.T) {
+	h, _ := openHistoryStore("", time.Hour)
+	base := time.Date(2024, 3, 18, 10, 0, 0, 0, time.UTC)
+	// The clock steps back two minutes after the third collection
+	for i, at := range []time.Time{
+		base, base.Add(time.Minute), base.Add(2 * time.Minute),
+		base.Add(30 * time.Second), base.Add(90 * time.Second),
+	} {
+		h.Record(trackingSnapshot(at, float64(i)))
+	}
+
+	points, _ := h.Query("", base.Add(45*time.Second), base.Add(time.Hour), 0)
+	var got []float64
+	for _, p := range points {
+		got = append(got, p.Values["system_time_seconds"])
+	}
+	want := []float64{1, 4, 2}
+	if len(got) != len(want) {
+		t.Fatalf("offsets from 10:00:45 = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("offsets from 10:00:45 = %v, want %v", got, want)
+		}
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].Time.Before(points[i-1].Time) {
+			t.Errorf("points out of order: %v after %v", points[i].Time, points[i-1].Time)
+		}
+	}
+
+	downsampled, _ := h.Query("", base, base.Add(time.Hour), time.Minute)
+	if len(downsampled) != 3 || downsampled[0].Samples != 2 || downsampled[1].Samples != 2 {
+		t.Errorf("per-minute points = %+v, want 2, 2 and 1 samples", downsampled)
+	}
+}
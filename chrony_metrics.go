@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpDurationBuckets are the upper bounds, in seconds, of the request
+// latency histogram. Configuration changes wait for chronyd to restart,
+// so the slow end matters.
+var httpDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// family starts a metric family with its HELP and TYPE lines.
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels are name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	io.WriteString(m.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabelValue(labels[i+1])+`"`)
+		}
+		io.WriteString(m.w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	io.WriteString(m.w, " "+formatMetricValue(value)+"\n")
+}
+
+// gauge writes a family with a single unlabelled sample.
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help)
+	m.sample(name, value)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes the chrony metrics from the latest snapshot, then
+// the API's own request metrics. A section that cannot be read has
+// chrony_section_up 0 and no samples.
+func (a *App) writeMetrics(m *metricsWriter) {
+	snap := a.collector.Snapshot()
+	tracking, trackingOK := snap.Tracking.(*Tracking)
+	sources, sourcesOK := snap.Sources.([]Source)
+	activity, activityOK := snap.Activity.(*Activity)
+	clients, clientsOK := snap.Clients.([]Client)
+
+	m.gauge("chrony_snapshot_age_seconds", "Time since the status snapshot was collected.", snap.Age().Seconds())
+	m.family("chrony_section_up", "gauge", "Whether chronyd answered the last query for the section.")
+	m.sample("chrony_section_up", boolValue(trackingOK), "section", "tracking")
+	m.sample("chrony_section_up", boolValue(sourcesOK), "section", "sources")
+	m.sample("chrony_section_up", boolValue(activityOK), "section", "activity")
+	m.sample("chrony_section_up", boolValue(clientsOK), "section", "clients")
+
+	if trackingOK {
+		writeTrackingMetrics(m, tracking)
+	}
+	if sourcesOK {
+		writeSourceMetrics(m, sources)
+	}
+	if activityOK {
+		writeActivityMetrics(m, activity)
+	}
+	if clientsOK {
+		writeClientMetrics(m, clients, a.clientMetricsLimit)
+	}
+	a.metrics.write(m)
+}
+
+func writeTrackingMetrics(m *metricsWriter, t *Tracking) {
+	m.family("chrony_tracking_info", "gauge", "The current reference of chronyd, always 1.")
+	m.sample("chrony_tracking_info", 1, "reference_id", t.ReferenceID, "reference_name", t.ReferenceName)
+	m.gauge("chrony_tracking_system_time_offset_seconds", "Offset of the system clock from NTP time, positive when it is ahead.", t.SystemTime)
+	m.gauge("chrony_tracking_last_offset_seconds", "Offset measured at the last clock update.", t.LastOffset)
+	m.gauge("chrony_tracking_rms_offset_seconds", "Long-term average of the offset.", t.RMSOffset)
+	m.gauge("chrony_tracking_frequency_ppm", "Frequency error of the system clock, positive when it runs fast.", t.Frequency)
+	m.gauge("chrony_tracking_residual_frequency_ppm", "Residual frequency of the selected reference.", t.ResidualFrequency)
+	m.gauge("chrony_tracking_skew_ppm", "Estimated error bound of the frequency.", t.Skew)
+	m.gauge("chrony_tracking_root_delay_seconds", "Total network path delay to the stratum-1 computer.", t.RootDelay)
+	m.gauge("chrony_tracking_root_dispersion_seconds", "Total dispersion accumulated up to the stratum-1 computer.", t.RootDispersion)
+	m.gauge("chrony_tracking_update_interval_seconds", "Interval between the last two clock updates.", t.UpdateInterval)
+	m.gauge("chrony_tracking_stratum", "Stratum of this host.", float64(t.Stratum))
+	m.family("chrony_tracking_leap_status", "gauge", "The leap status, 1 for the current one.")
+	for _, status := range []LeapStatus{LeapNormal, LeapInsertSecond, LeapDeleteSecond, LeapNotSynchronised} {
+		m.sample("chrony_tracking_leap_status", boolValue(t.LeapStatus == status), "status", status.String())
+	}
+}
+
+func writeSourceMetrics(m *metricsWriter, sources []Source) {
+	gauges := []struct {
+		name, help string
+		value      func(s *Source) float64
+	}{
+		{"chrony_source_reach", "Reach register of the source, the last 8 polls as bits.", func(s *Source) float64 { return float64(s.Reach) }},
+		{"chrony_source_reach_ratio", "Fraction of the last 8 polls the source answered.", func(s *Source) float64 { return s.ReachRatio }},
+		{"chrony_source_offset_seconds", "Offset of the source, adjusted for frequency changes since the measurement.", func(s *Source) float64 { return s.Offset }},
+		{"chrony_source_error_seconds", "Error bound of the source offset.", func(s *Source) float64 { return s.Error }},
+		{"chrony_source_stratum", "Stratum of the source.", func(s *Source) float64 { return float64(s.Stratum) }},
+		{"chrony_source_poll_interval_seconds", "Polling interval of the source.", func(s *Source) float64 { return s.PollInterval }},
+	}
+	for _, g := range gauges {
+		m.family(g.name, "gauge", g.help)
+		for i := range sources {
+			m.sample(g.name, g.value(&sources[i]), "source", sources[i].Name, "address", sources[i].Address)
+		}
+	}
+	m.family("chrony_source_state", "gauge", "Selection state of the source, 1 for the current one.")
+	for i := range sources {
+		for _, e := range sourceStates {
+			m.sample("chrony_source_state", boolValue(sources[i].State == e.state),
+				"source", sources[i].Name, "address", sources[i].Address, "mode", sources[i].Mode.String(), "state", e.name)
+		}
+	}
+}
+
+func writeActivityMetrics(m *metricsWriter, a *Activity) {
+	m.family("chrony_activity_sources", "gauge", "Number of sources in each state.")
+	m.sample("chrony_activity_sources", float64(a.Online), "state", "online")
+	m.sample("chrony_activity_sources", float64(a.Offline), "state", "offline")
+	m.sample("chrony_activity_sources", float64(a.BurstOnline), "state", "burst_online")
+	m.sample("chrony_activity_sources", float64(a.BurstOffline), "state", "burst_offline")
+	m.sample("chrony_activity_sources", float64(a.Unresolved), "state", "unresolved")
+}
+
+// writeClientMetrics writes totals over the clients chronyd keeps track
+// of, and counters for the top clients by NTP packets. The client table
+// holds any address that sent a packet, so exporting every client would
+// give unbounded label values. The totals are gauges because clients drop
+// out of the table.
+func writeClientMetrics(m *metricsWriter, clients []Client, top int) {
+	m.gauge("chrony_clients", "Number of clients chronyd keeps track of.", float64(len(clients)))
+	counters := []struct {
+		name, help string
+		value      func(c *Client) uint64
+	}{
+		{"ntp_packets", "NTP packets received from", func(c *Client) uint64 { return c.NTPPackets }},
+		{"ntp_dropped", "NTP packets dropped by rate limiting of", func(c *Client) uint64 { return c.NTPDropped }},
+		{"cmd_packets", "Command packets received from", func(c *Client) uint64 { return c.CmdPackets }},
+		{"cmd_dropped", "Command packets dropped by rate limiting of", func(c *Client) uint64 { return c.CmdDropped }},
+	}
+	for _, c := range counters {
+		var total uint64
+		for i := range clients {
+			total += c.value(&clients[i])
+		}
+		m.gauge("chrony_clients_"+c.name, c.help+" the tracked clients.", float64(total))
+	}
+	if top <= 0 {
+		return
+	}
+	busiest := ClientQuery{Sort: "ntp_packets", Limit: top}.Apply(clients)
+	for _, c := range counters {
+		name := "chrony_client_" + c.name + "_total"
+		m.family(name, "counter", c.help+" the client, for the busiest clients.")
+		for i := range busiest {
+			m.sample(name, float64(c.value(&busiest[i])), "address", busiest[i].Address)
+		}
+	}
+}
+
+// httpMetrics counts the API's requests and their latency per handler,
+// the route pattern the request matched.
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[httpRequestKey]uint64
+	durations map[string]*histogram
+}
+
+type httpRequestKey struct {
+	handler, method string
+	code            int
+}
+
+// histogram keeps non-cumulative bucket counts for httpDurationBuckets;
+// the last count is for the +Inf bucket.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[httpRequestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// instrument wraps h to record its requests and their latency under
+// handler.
+func (hm *httpMetrics) instrument(handler string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		hm.count(handler, r.Method, rec.status)
+		hm.observe(handler, time.Since(start).Seconds())
+	})
+}
+
+// instrumentStream wraps a streaming handler, such as Server-Sent Events
+// or a WebSocket, to count its requests. Its latency is not recorded:
+// the request lasts as long as the client stays connected.
+func (hm *httpMetrics) instrumentStream(handler string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		hm.count(handler, r.Method, rec.status)
+	})
+}
+
+func (hm *httpMetrics) count(handler, method string, code int) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hm.requests[httpRequestKey{handler, method, code}]++
+}
+
+func (hm *httpMetrics) observe(handler string, seconds float64) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	h := hm.durations[handler]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(httpDurationBuckets)+1)}
+		hm.durations[handler] = h
+	}
+	h.counts[sort.SearchFloat64s(httpDurationBuckets, seconds)]++
+	h.count++
+	h.sum += seconds
+}
+
+func (hm *httpMetrics) write(m *metricsWriter) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	keys := make([]httpRequestKey, 0, len(hm.requests))
+	for k := range hm.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	m.family("brick_clock_http_requests_total", "counter", "API requests by handler, method and status code.")
+	for _, k := range keys {
+		m.sample("brick_clock_http_requests_total", float64(hm.requests[k]),
+			"handler", k.handler, "method", k.method, "code", strconv.Itoa(k.code))
+	}
+
+	handlers := make([]string, 0, len(hm.durations))
+	for handler := range hm.durations {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	m.family("brick_clock_http_request_duration_seconds", "histogram", "API request latency by handler.")
+	for _, handler := range handlers {
+		h := hm.durations[handler]
+		var cumulative uint64
+		for i, le := range httpDurationBuckets {
+			cumulative += h.counts[i]
+			m.sample("brick_clock_http_request_duration_seconds_bucket", float64(cumulative),
+				"handler", handler, "le", formatMetricValue(le))
+		}
+		m.sample("brick_clock_http_request_duration_seconds_bucket", float64(h.count), "handler", handler, "le", "+Inf")
+		m.sample("brick_clock_http_request_duration_seconds_sum", h.sum, "handler", handler)
+		m.sample("brick_clock_http_request_duration_seconds_count", float64(h.count), "handler", handler)
+	}
+}
+
+// statusRecorder remembers the status code a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Hijack counts a hijacked connection, i.e. a WebSocket, as switching
+// protocols.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// handleMetrics serves the metrics for Prometheus to scrape.
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	var buf bytes.Buffer
+	a.writeMetrics(&metricsWriter{w: &buf})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, app *App) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsSeriesAreUnique(t *testing.T) {
+	app, backend := newTestApp(t)
+	app.clientMetricsLimit = 1
+	backend.SourcesReply = append(backend.SourcesReply,
+		Source{Mode: SourceModeServer, Name: "192.0.2.1", Address: "192.0.2.1"},
+		Source{Mode: SourceModeServer, Name: "192.0.2.2", Address: "192.0.2.2"},
+		Source{Mode: SourceModeRefclock, Name: "PPS0"})
+	backend.ClientsReply = []Client{
+		{Address: "198.51.100.1", NTPPackets: 10, NTPDropped: 1},
+		{Address: "198.51.100.2", NTPPackets: 5, CmdPackets: 2},
+	}
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(scrape(t, app), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series := line[:strings.LastIndex(line, " ")]
+		if seen[series] {
+			t.Errorf("duplicate series %s", series)
+		}
+		seen[series] = true
+	}
+	for _, series := range []string{
+		`chrony_source_offset_seconds{source="192.0.2.2",address="192.0.2.2"}`,
+		`chrony_source_reach{source="PPS0",address=""}`,
+		`chrony_clients_ntp_packets`,
+		`chrony_client_ntp_packets_total{address="198.51.100.1"}`,
+		`chrony_client_cmd_dropped_total{address="198.51.100.1"}`,
+	} {
+		if !seen[series] {
+			t.Errorf("missing series %s", series)
+		}
+	}
+	for series := range seen {
+		if strings.Contains(series, "198.51.100.2") {
+			t.Errorf("series of a client beyond the busiest %d: %s", CLIENT_METRICS_LIMIT, series)
+		}
+	}
+	if body := scrape(t, app); !strings.Contains(body, "\nchrony_clients_ntp_packets 15\n") ||
+		!strings.Contains(body, "\nchrony_clients_cmd_packets 2\n") {
+		t.Errorf("client totals missing from:\n%s", body)
+	}
+}
+
+func TestClientMetricsLimit(t *testing.T) {
+	app, backend := newTestApp(t)
+	for i := 1; i <= 30; i++ {
+		backend.ClientsReply = append(backend.ClientsReply,
+			Client{Address: fmt.Sprintf("198.51.100.%d", i), NTPPackets: uint64(i)})
+	}
+
+	body := scrape(t, app)
+	if n := strings.Count(body, "\nchrony_client_ntp_packets_total{"); n != CLIENT_METRICS_LIMIT {
+		t.Errorf("%d per-client series, want %d", n, CLIENT_METRICS_LIMIT)
+	}
+	if !strings.Contains(body, `chrony_client_ntp_packets_total{address="198.51.100.30"} 30`) ||
+		strings.Contains(body, `chrony_client_ntp_packets_total{address="198.51.100.10"}`) {
+		t.Errorf("per-client series are not the busiest clients:\n%s", body)
+	}
+
+	app.clientMetricsLimit = 0
+	body = scrape(t, app)
+	if strings.Contains(body, "chrony_client_") || !strings.Contains(body, "\nchrony_clients_ntp_packets 465\n") {
+		t.Errorf("with the limit at 0, want only the totals:\n%s", body)
+	}
+}
+
+func TestMetricsLeaveStreamsOutOfLatency(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.Handler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/status/stream", nil).WithContext(ctx)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status", nil))
+
+	body := scrape(t, app)
+	if !strings.Contains(body, `brick_clock_http_requests_total{handler="/status/stream",method="GET",code="200"} 1`) {
+		t.Errorf("stream request not counted:\n%s", body)
+	}
+	if strings.Contains(body, `brick_clock_http_request_duration_seconds_count{handler="/status/stream"}`) {
+		t.Errorf("stream in the latency histogram:\n%s", body)
+	}
+	if !strings.Contains(body, `brick_clock_http_request_duration_seconds_count{handler="/status"} 1`) {
+		t.Errorf("/status missing from the latency histogram:\n%s", body)
+	}
+}
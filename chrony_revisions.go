@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigRevision is one version of chrony.conf written through the API:
+// who wrote it (the JWT subject), with which request and why.
+type ConfigRevision struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Subject string    `json:"subject"`
+	Action  string    `json:"action"`
+	Reason  string    `json:"reason"`
+	Content string    `json:"content,omitempty"`
+}
+
+// configChange describes the change a config cycle makes, for the
+// revision it records.
+type configChange struct {
+	Subject string
+	Action  string
+	Reason  string
+}
+
+// configChangeFromRequest describes a change made by r, with the reason
+// taken from ?reason=. claims may be nil for unauthenticated routes.
+func configChangeFromRequest(r *http.Request, claims map[string]interface{}) configChange {
+	subject, _ := claims["sub"].(string)
+	return configChange{
+		Subject: subject,
+		Action:  r.Method + " " + r.URL.Path,
+		Reason:  r.URL.Query().Get("reason"),
+	}
+}
+
+// revisionStore keeps the numbered revisions of chrony.conf, as one JSON
+// file per revision in dir, or only in memory when dir is empty.
+type revisionStore struct {
+	dir string
+
+	mu        sync.Mutex
+	revisions []ConfigRevision
+}
+
+// openRevisionStore loads the revisions saved in dir, creating it if
+// needed. An empty dir gives an in-memory store.
+func openRevisionStore(dir string) (*revisionStore, error) {
+	s := &revisionStore{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var rev ConfigRevision
+		if err := json.Unmarshal(data, &rev); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		s.revisions = append(s.revisions, rev)
+	}
+	sort.Slice(s.revisions, func(i, j int) bool {
+		return s.revisions[i].ID < s.revisions[j].ID
+	})
+	return s, nil
+}
+
+// Add stores rev as the next revision and returns it with its ID and
+// time set.
+func (s *revisionStore) Add(rev ConfigRevision) (ConfigRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rev.ID = 1
+	if n := len(s.revisions); n > 0 {
+		rev.ID = s.revisions[n-1].ID + 1
+	}
+	rev.Time = time.Now().UTC()
+	if s.dir != "" {
+		data, err := json.MarshalIndent(rev, "", "  ")
+		if err != nil {
+			return rev, err
+		}
+		path := filepath.Join(s.dir, fmt.Sprintf("%06d.json", rev.ID))
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return rev, err
+		}
+	}
+	s.revisions = append(s.revisions, rev)
+	return rev, nil
+}
+
+// Latest returns the newest revision, or nil if there is none.
+func (s *revisionStore) Latest() *ConfigRevision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.revisions) == 0 {
+		return nil
+	}
+	rev := s.revisions[len(s.revisions)-1]
+	return &rev
+}
+
+// List returns every revision, newest first, without content.
+func (s *revisionStore) List() []ConfigRevision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ConfigRevision, 0, len(s.revisions))
+	for i := len(s.revisions) - 1; i >= 0; i-- {
+		rev := s.revisions[i]
+		rev.Content = ""
+		list = append(list, rev)
+	}
+	return list
+}
+
+// Get returns the revision id and the one before it, which is nil for
+// the first revision. It returns nil, nil if id is unknown.
+func (s *revisionStore) Get(id int) (rev, previous *ConfigRevision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.revisions {
+		if s.revisions[i].ID != id {
+			continue
+		}
+		found := s.revisions[i]
+		if i == 0 {
+			return &found, nil
+		}
+		before := s.revisions[i-1]
+		return &found, &before
+	}
+	return nil, nil
+}
+
+// revisionPath splits /config/revisions/{id}[/action] into the id and
+// the action.
+func revisionPath(path string) (id int, action string, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/config/revisions/"), "/")
+	if len(parts) > 2 {
+		return 0, "", fmt.Errorf("unknown path %s", path)
+	}
+	id, err = strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		return 0, "", fmt.Errorf("invalid revision id %q", parts[0])
+	}
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	return id, action, nil
+}
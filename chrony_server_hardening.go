@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"el/brick-clock/chronyconf"
+)
+
+// RateLimit is chrony's "ratelimit" directive: responses to each client
+// are limited to an average of one per 2^Interval seconds, with bursts of
+// up to Burst, and one in 2^Leak of the dropped requests still answered.
+// Nil fields are left to chronyd's defaults (3, 8 and 2).
+type RateLimit struct {
+	Interval *int `json:"interval,omitempty"`
+	Burst    *int `json:"burst,omitempty"`
+	Leak     *int `json:"leak,omitempty"`
+}
+
+// Validate checks the values against the ranges chronyd accepts.
+func (l *RateLimit) Validate() error {
+	if l.Interval != nil && (*l.Interval < -19 || *l.Interval > 12) {
+		return fmt.Errorf("interval must be between -19 and 12")
+	}
+	if l.Burst != nil && (*l.Burst < 1 || *l.Burst > 255) {
+		return fmt.Errorf("burst must be between 1 and 255")
+	}
+	if l.Leak != nil && (*l.Leak < 0 || *l.Leak > 4) {
+		return fmt.Errorf("leak must be between 0 and 4")
+	}
+	return nil
+}
+
+// Directive returns the ratelimit directive.
+func (l *RateLimit) Directive() *chronyconf.Directive {
+	args := []string{}
+	for _, opt := range []struct {
+		name  string
+		value *int
+	}{{"interval", l.Interval}, {"burst", l.Burst}, {"leak", l.Leak}} {
+		if opt.value != nil {
+			args = append(args, opt.name, strconv.Itoa(*opt.value))
+		}
+	}
+	return chronyconf.NewDirective("ratelimit", args...)
+}
+
+// rateLimitFromDirective reads a ratelimit directive, skipping options it
+// cannot parse.
+func rateLimitFromDirective(d *chronyconf.Directive) *RateLimit {
+	l := &RateLimit{}
+	for i := 0; i+1 < len(d.Args); i += 2 {
+		n, err := strconv.Atoi(d.Args[i+1])
+		if err != nil {
+			continue
+		}
+		switch d.Args[i] {
+		case "interval":
+			l.Interval = &n
+		case "burst":
+			l.Burst = &n
+		case "leak":
+			l.Leak = &n
+		}
+	}
+	return l
+}
+
+// ServerHardening holds the chrony.conf settings that protect the NTP
+// server: client rate limiting, the memory chronyd may use to track
+// clients (clientloglimit, in bytes), whether it tracks them at all
+// (noclientlog) and the addresses it listens on (bindaddress).
+type ServerHardening struct {
+	RateLimit      *RateLimit `json:"ratelimit"`
+	ClientLogLimit *int       `json:"clientloglimit"`
+	NoClientLog    bool       `json:"noclientlog"`
+	BindAddress    []string   `json:"bindaddress"`
+}
+
+// serverHardening reads the hardening settings of conf. The last
+// directive wins, as in chronyd.
+func serverHardening(conf *chronyconf.File) ServerHardening {
+	h := ServerHardening{BindAddress: []string{}}
+	for _, d := range conf.Directives("ratelimit") {
+		h.RateLimit = rateLimitFromDirective(d)
+	}
+	for _, d := range conf.Directives("clientloglimit") {
+		if len(d.Args) == 1 {
+			if n, err := strconv.Atoi(d.Args[0]); err == nil {
+				h.ClientLogLimit = &n
+			}
+		}
+	}
+	h.NoClientLog = len(conf.Directives("noclientlog")) > 0
+	for _, d := range conf.Directives("bindaddress") {
+		if len(d.Args) > 0 {
+			h.BindAddress = append(h.BindAddress, d.Args[0])
+		}
+	}
+	return h
+}
+
+// hardeningFields records which hardening fields a request set, so that
+// an explicit null can remove a directive while an omitted field leaves
+// it unchanged.
+type hardeningFields struct {
+	rateLimit      bool
+	clientLogLimit bool
+	noClientLog    bool
+	bindAddress    bool
+}
+
+func (f hardeningFields) any() bool {
+	return f.rateLimit || f.clientLogLimit || f.noClientLog || f.bindAddress
+}
+
+func hardeningFieldsOf(data []byte) (hardeningFields, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return hardeningFields{}, err
+	}
+	has := func(name string) bool {
+		_, ok := raw[name]
+		return ok
+	}
+	return hardeningFields{
+		rateLimit:      has("ratelimit"),
+		clientLogLimit: has("clientloglimit"),
+		noClientLog:    has("noclientlog"),
+		bindAddress:    has("bindaddress"),
+	}, nil
+}
+
+// validateHardening checks the hardening fields of a request.
+func validateHardening(h *ServerHardening) error {
+	if h.RateLimit != nil {
+		if err := h.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("ratelimit: %v", err)
+		}
+	}
+	if h.ClientLogLimit != nil && *h.ClientLogLimit <= 0 {
+		return fmt.Errorf("clientloglimit must be a positive number of bytes")
+	}
+	var v4, v6 int
+	for _, addr := range h.BindAddress {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("bindaddress: invalid address %q", addr)
+		}
+		if ip.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	if v4 > 1 || v6 > 1 {
+		return fmt.Errorf("bindaddress: at most one IPv4 and one IPv6 address")
+	}
+	return nil
+}
+
+// editHardening applies the fields of h that set marks to conf.
+func editHardening(conf *chronyconf.File, h *ServerHardening, set hardeningFields) {
+	if set.rateLimit {
+		var ds []*chronyconf.Directive
+		if h.RateLimit != nil {
+			ds = append(ds, h.RateLimit.Directive())
+		}
+		conf.Replace(ds, "ratelimit")
+	}
+	if set.clientLogLimit {
+		var ds []*chronyconf.Directive
+		if h.ClientLogLimit != nil {
+			ds = append(ds, chronyconf.NewDirective("clientloglimit", strconv.Itoa(*h.ClientLogLimit)))
+		}
+		conf.Replace(ds, "clientloglimit")
+	}
+	if set.noClientLog {
+		var ds []*chronyconf.Directive
+		if h.NoClientLog {
+			ds = append(ds, chronyconf.NewDirective("noclientlog"))
+		}
+		conf.Replace(ds, "noclientlog")
+	}
+	if set.bindAddress {
+		var ds []*chronyconf.Directive
+		for _, addr := range h.BindAddress {
+			ds = append(ds, chronyconf.NewDirective("bindaddress", addr))
+		}
+		conf.Replace(ds, "bindaddress")
+	}
+}
+
+// UnmarshalJSON decodes the request and records which hardening fields it
+// set.
+func (r *SetServerModeRequest) UnmarshalJSON(data []byte) error {
+	type plain SetServerModeRequest
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	set, err := hardeningFieldsOf(data)
+	if err != nil {
+		return err
+	}
+	*r = SetServerModeRequest(p)
+	r.set = set
+	return nil
+}
+
+// Validate checks the request changes something, and that its rules and
+// hardening settings are valid.
+func (r *SetServerModeRequest) Validate() error {
+	switch {
+	case r.Enabled == nil && r.Rules == nil && !r.set.any():
+		return fmt.Errorf("enabled, rules or a hardening setting is required")
+	case r.Enabled != nil && !*r.Enabled && r.Rules != nil:
+		return fmt.Errorf("rules cannot be combined with enabled=false")
+	}
+	for i := range r.Rules {
+		if err := r.Rules[i].Validate(); err != nil {
+			return &fieldError{Field: fmt.Sprintf("rules[%d]", i), Err: err}
+		}
+	}
+	return validateHardening(&r.ServerHardening)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const hardenedConfig = "server time.example.com iburst\n" +
+	"allow 192.0.2.0/24\n" +
+	"ratelimit interval 4 burst 16\n" +
+	"clientloglimit 1048576\n" +
+	"bindaddress 192.0.2.1\n"
+
+func TestServerHardeningNullRemovesOmittedKeeps(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Config = []byte(hardenedConfig)
+	token := testToken(t, "clock/server_mode")
+
+	// An omitted field leaves its directive alone
+	code, response := request(t, app, "PUT", "/server-mode", token, `{"clientloglimit": 4194304}`)
+	if code != http.StatusOK || response["clientloglimit"] != 4194304.0 {
+		t.Fatalf("PUT /server-mode = %d %v", code, response)
+	}
+	want := strings.Replace(hardenedConfig, "clientloglimit 1048576", "clientloglimit 4194304", 1)
+	if string(backend.Config) != want {
+		t.Errorf("chrony.conf =\n%s\nwant\n%s", backend.Config, want)
+	}
+	if rl, _ := response["ratelimit"].(map[string]interface{}); rl["interval"] != 4.0 || rl["burst"] != 16.0 {
+		t.Errorf("ratelimit = %v, want it unchanged", response["ratelimit"])
+	}
+
+	// null removes it
+	code, response = request(t, app, "PUT", "/server-mode", token, `{"ratelimit": null}`)
+	if code != http.StatusOK || response["ratelimit"] != nil {
+		t.Fatalf("PUT /server-mode with ratelimit null = %d %v", code, response)
+	}
+	want = strings.Replace(want, "ratelimit interval 4 burst 16\n", "", 1)
+	if string(backend.Config) != want {
+		t.Errorf("chrony.conf =\n%s\nwant\n%s", backend.Config, want)
+	}
+
+	// as it does for the other fields, and an empty list clears bindaddress
+	code, response = request(t, app, "PUT", "/server-mode", token, `{"clientloglimit": null, "bindaddress": []}`)
+	if code != http.StatusOK || response["clientloglimit"] != nil {
+		t.Fatalf("PUT /server-mode clearing clientloglimit and bindaddress = %d %v", code, response)
+	}
+	if want := "server time.example.com iburst\nallow 192.0.2.0/24\n"; string(backend.Config) != want {
+		t.Errorf("chrony.conf =\n%s\nwant\n%s", backend.Config, want)
+	}
+}
+
+func TestServerHardeningSet(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Config = []byte("server time.example.com iburst\n")
+	token := testToken(t, "clock/server_mode")
+
+	code, response := request(t, app, "PUT", "/server-mode", token,
+		`{"enabled": true, "ratelimit": {"interval": 1, "leak": 3}, "noclientlog": true, "bindaddress": ["192.0.2.1", "2001:db8::1"]}`)
+	if code != http.StatusOK || response["server_mode_enabled"] != true || response["noclientlog"] != true {
+		t.Fatalf("PUT /server-mode = %d %v", code, response)
+	}
+	conf := string(backend.Config)
+	for _, line := range []string{"allow 0.0.0.0/0\n", "ratelimit interval 1 leak 3\n", "noclientlog\n",
+		"bindaddress 192.0.2.1\n", "bindaddress 2001:db8::1\n"} {
+		if !strings.Contains(conf, line) {
+			t.Errorf("chrony.conf is missing %q:\n%s", line, conf)
+		}
+	}
+	if addrs, _ := response["bindaddress"].([]interface{}); len(addrs) != 2 {
+		t.Errorf("bindaddress = %v", response["bindaddress"])
+	}
+}
+
+func TestServerHardeningRejected(t *testing.T) {
+	app, backend := newTestApp(t)
+	backend.Config = []byte(hardenedConfig)
+	token := testToken(t, "clock/server_mode")
+
+	for _, body := range []string{
+		`{"bindaddress": ["192.0.2.1", "192.0.2.2"]}`,
+		`{"bindaddress": ["2001:db8::1", "2001:db8::2"]}`,
+		`{"bindaddress": ["ntp.example.com"]}`,
+		`{"ratelimit": {"interval": 13}}`,
+		`{"ratelimit": {"burst": 0}}`,
+		`{"ratelimit": {"leak": 5}}`,
+		`{"clientloglimit": 0}`,
+	} {
+		code, response := request(t, app, "PUT", "/server-mode", token, body)
+		if code != http.StatusBadRequest || errorCode(response) != ERR_INVALID_REQUEST {
+			t.Errorf("%s: PUT /server-mode = %d %v", body, code, response)
+		}
+	}
+	if string(backend.Config) != hardenedConfig || backend.Restarts != 0 {
+		t.Errorf("rejected requests changed chrony.conf to %q or restarted chronyd", backend.Config)
+	}
+}
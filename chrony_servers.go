@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"el/brick-clock/chronyconf"
+	"el/brick-clock/cmdmon"
+)
+
+// ServerConfig is one server, pool or peer directive of chrony.conf as
+// the servers API reads and writes it. Options the API does not model
+// are kept verbatim in ExtraOptions, e.g. "maxdelay 0.3".
+type ServerConfig struct {
+	Type         string   `json:"type"`
+	Host         string   `json:"host"`
+	IBurst       bool     `json:"iburst"`
+	Prefer       bool     `json:"prefer"`
+	NoSelect     bool     `json:"noselect"`
+	Trust        bool     `json:"trust"`
+	Require      bool     `json:"require"`
+	MinPoll      *int     `json:"minpoll,omitempty"`
+	MaxPoll      *int     `json:"maxpoll,omitempty"`
+	MaxSources   *int     `json:"maxsources,omitempty"`
+	Key          *uint32  `json:"key,omitempty"`
+	NTS          bool     `json:"nts"`
+	ExtraOptions []string `json:"extra_options,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare hostname, the original request
+// format, which means "server <host> iburst".
+func (s *ServerConfig) UnmarshalJSON(data []byte) error {
+	var host string
+	if err := json.Unmarshal(data, &host); err == nil {
+		*s = ServerConfig{Type: "server", Host: host, IBurst: true}
+		return nil
+	}
+	type plain ServerConfig
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*s = ServerConfig(p)
+	if s.Type == "" {
+		s.Type = "server"
+	}
+	return nil
+}
+
+var hostnameRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+// Validate checks the entry against what chronyd accepts.
+func (s *ServerConfig) Validate() error {
+	switch s.Type {
+	case "server", "pool", "peer":
+	default:
+		return fmt.Errorf("type must be server, pool or peer, not %q", s.Type)
+	}
+	if net.ParseIP(s.Host) == nil && !hostnameRegex.MatchString(s.Host) {
+		return fmt.Errorf("invalid host %q", s.Host)
+	}
+	for name, poll := range map[string]*int{"minpoll": s.MinPoll, "maxpoll": s.MaxPoll} {
+		if poll != nil && (*poll < -6 || *poll > 24) {
+			return fmt.Errorf("%s must be between -6 and 24", name)
+		}
+	}
+	if s.MinPoll != nil && s.MaxPoll != nil && *s.MinPoll > *s.MaxPoll {
+		return fmt.Errorf("minpoll must not be greater than maxpoll")
+	}
+	if s.MaxSources != nil {
+		if s.Type != "pool" {
+			return fmt.Errorf("maxsources only applies to pool")
+		}
+		if *s.MaxSources < 1 || *s.MaxSources > 16 {
+			return fmt.Errorf("maxsources must be between 1 and 16")
+		}
+	}
+	if s.Key != nil && *s.Key == 0 {
+		return fmt.Errorf("key must be a non-zero key ID")
+	}
+	if s.NTS && s.Key != nil {
+		return fmt.Errorf("nts and key cannot be used together")
+	}
+	if s.NTS && s.Type == "peer" {
+		return fmt.Errorf("nts is not supported for peers")
+	}
+	for _, opt := range s.ExtraOptions {
+		if strings.ContainsAny(opt, "\r\n") || strings.TrimSpace(opt) == "" {
+			return fmt.Errorf("invalid option %q", opt)
+		}
+	}
+	return nil
+}
+
+// Validate checks the request has at least one valid entry.
+func (r *SetServersRequest) Validate() error {
+	if len(r.Servers) == 0 {
+		return fmt.Errorf("servers must be a non-empty list")
+	}
+	for i := range r.Servers {
+		if err := r.Servers[i].Validate(); err != nil {
+			return &fieldError{Field: fmt.Sprintf("servers[%d]", i), Err: err}
+		}
+	}
+	return nil
+}
+
+// Directive renders the entry as a chrony.conf directive
+func (s *ServerConfig) Directive() *chronyconf.Directive {
+	var opts []chronyconf.Option
+	flag := func(set bool, name string) {
+		if set {
+			opts = append(opts, chronyconf.Option{Name: name})
+		}
+	}
+	value := func(v *int, name string) {
+		if v != nil {
+			opts = append(opts, chronyconf.Option{Name: name, Value: strconv.Itoa(*v)})
+		}
+	}
+	flag(s.IBurst, "iburst")
+	flag(s.Prefer, "prefer")
+	flag(s.NoSelect, "noselect")
+	flag(s.Trust, "trust")
+	flag(s.Require, "require")
+	value(s.MinPoll, "minpoll")
+	value(s.MaxPoll, "maxpoll")
+	value(s.MaxSources, "maxsources")
+	if s.Key != nil {
+		opts = append(opts, chronyconf.Option{Name: "key", Value: strconv.FormatUint(uint64(*s.Key), 10)})
+	}
+	flag(s.NTS, "nts")
+	d := chronyconf.NewSource(s.Type, s.Host, opts)
+	for _, opt := range s.ExtraOptions {
+		d.Args = append(d.Args, strings.Fields(opt)...)
+	}
+	return d
+}
+
+// serverConfigFromDirective reads a server, pool or peer directive
+func serverConfigFromDirective(d *chronyconf.Directive) ServerConfig {
+	s := ServerConfig{Type: d.Name, Host: d.Host()}
+	intValue := func(opt chronyconf.Option) (*int, bool) {
+		v, err := strconv.Atoi(opt.Value)
+		if err != nil {
+			return nil, false
+		}
+		return &v, true
+	}
+	for _, opt := range d.Options() {
+		ok := true
+		switch opt.Name {
+		case "iburst":
+			s.IBurst = true
+		case "prefer":
+			s.Prefer = true
+		case "noselect":
+			s.NoSelect = true
+		case "trust":
+			s.Trust = true
+		case "require":
+			s.Require = true
+		case "nts":
+			s.NTS = true
+		case "minpoll":
+			s.MinPoll, ok = intValue(opt)
+		case "maxpoll":
+			s.MaxPoll, ok = intValue(opt)
+		case "maxsources":
+			s.MaxSources, ok = intValue(opt)
+		case "key":
+			key, err := strconv.ParseUint(opt.Value, 10, 32)
+			if ok = err == nil; ok {
+				k := uint32(key)
+				s.Key = &k
+			}
+		default:
+			ok = false
+		}
+		if !ok {
+			s.ExtraOptions = append(s.ExtraOptions, strings.TrimSpace(opt.Name+" "+opt.Value))
+		}
+	}
+	return s
+}
+
+// ntpSourceFromDirective builds the cmdmon add source request for a
+// server, pool or peer directive. Options cmdmon cannot carry are an
+// error, so the caller can fall back to restarting chronyd.
+func ntpSourceFromDirective(d *chronyconf.Directive) (*cmdmon.NTPSource, error) {
+	types := map[string]uint32{
+		"server": cmdmon.AddSourceServer,
+		"pool":   cmdmon.AddSourcePool,
+		"peer":   cmdmon.AddSourcePeer,
+	}
+	typ, ok := types[d.Name]
+	if !ok || d.Host() == "" {
+		return nil, fmt.Errorf("not a source directive: %s", d)
+	}
+	src := cmdmon.NewNTPSource(typ, d.Host())
+	flags := map[string]uint32{
+		"auto_offline": cmdmon.AddSourceAutoOffline,
+		"burst":        cmdmon.AddSourceBurst,
+		"copy":         cmdmon.AddSourceCopy,
+		"iburst":       cmdmon.AddSourceIBurst,
+		"noselect":     cmdmon.AddSourceNoselect,
+		"nts":          cmdmon.AddSourceNTS,
+		"prefer":       cmdmon.AddSourcePrefer,
+		"require":      cmdmon.AddSourceRequire,
+		"trust":        cmdmon.AddSourceTrust,
+		"xleave":       cmdmon.AddSourceInterleaved,
+	}
+	ints := map[string]interface{}{
+		"certset":    &src.CertSet,
+		"filter":     &src.FilterLength,
+		"key":        &src.AuthKey,
+		"maxpoll":    &src.MaxPoll,
+		"maxsamples": &src.MaxSamples,
+		"maxsources": &src.MaxSources,
+		"minpoll":    &src.MinPoll,
+		"minsamples": &src.MinSamples,
+		"minstratum": &src.MinStratum,
+		"ntsport":    &src.NTSPort,
+		"polltarget": &src.PollTarget,
+		"port":       &src.Port,
+		"presend":    &src.Presend,
+		"version":    &src.Version,
+	}
+	floats := map[string]*float64{
+		"asymmetry":        &src.Asymmetry,
+		"maxdelay":         &src.MaxDelay,
+		"maxdelaydevratio": &src.MaxDelayDevRatio,
+		"maxdelayquant":    &src.MaxDelayQuant,
+		"maxdelayratio":    &src.MaxDelayRatio,
+		"mindelay":         &src.MinDelay,
+		"offset":           &src.Offset,
+	}
+	for _, opt := range d.Options() {
+		if flag, ok := flags[opt.Name]; ok {
+			src.Flags |= flag
+			continue
+		}
+		if opt.Name == "offline" {
+			src.Flags &^= cmdmon.AddSourceOnline
+			continue
+		}
+		var err error
+		switch p := ints[opt.Name].(type) {
+		case *int32:
+			var v int64
+			v, err = strconv.ParseInt(opt.Value, 10, 32)
+			*p = int32(v)
+		case *uint32:
+			var v uint64
+			v, err = strconv.ParseUint(opt.Value, 10, 32)
+			*p = uint32(v)
+		default:
+			fp, ok := floats[opt.Name]
+			if !ok {
+				return nil, fmt.Errorf("option %q cannot be added at runtime", opt.Name)
+			}
+			*fp, err = strconv.ParseFloat(opt.Value, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("option %s: invalid value %q", opt.Name, opt.Value)
+		}
+	}
+	return src, nil
+}
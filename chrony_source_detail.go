@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"el/brick-clock/cmdmon"
+)
+
+// NTPData is the typed form of "chronyc ntpdata" for one source: the last
+// valid packet received from it and the packet counters. Delays,
+// dispersions and offsets are in seconds.
+type NTPData struct {
+	RemoteAddress   string     `json:"remote_address"`
+	RemotePort      int        `json:"remote_port"`
+	LocalAddress    string     `json:"local_address"`
+	LeapStatus      LeapStatus `json:"leap_status"`
+	Version         int        `json:"version"`
+	Mode            string     `json:"mode"`
+	Stratum         int        `json:"stratum"`
+	Poll            int        `json:"poll"`
+	Precision       int        `json:"precision"`
+	RootDelay       float64    `json:"root_delay_seconds"`
+	RootDispersion  float64    `json:"root_dispersion_seconds"`
+	ReferenceID     string     `json:"reference_id"`
+	RefTime         time.Time  `json:"ref_time"`
+	Offset          float64    `json:"offset_seconds"`
+	PeerDelay       float64    `json:"peer_delay_seconds"`
+	PeerDispersion  float64    `json:"peer_dispersion_seconds"`
+	ResponseTime    float64    `json:"response_time_seconds"`
+	JitterAsymmetry float64    `json:"jitter_asymmetry"`
+	Tests           string     `json:"ntp_tests"`
+	Interleaved     bool       `json:"interleaved"`
+	Authenticated   bool       `json:"authenticated"`
+	TxTimestamping  string     `json:"tx_timestamping"`
+	RxTimestamping  string     `json:"rx_timestamping"`
+	TotalTx         uint64     `json:"total_tx"`
+	TotalRx         uint64     `json:"total_rx"`
+	TotalValidRx    uint64     `json:"total_valid_rx"`
+}
+
+// NTP association modes (RFC 5905) as chronyc names them
+var ntpModeNames = map[uint8]string{
+	1: "symmetric_active",
+	2: "symmetric_passive",
+	3: "client",
+	4: "server",
+	5: "broadcast",
+}
+
+// Timestamping sources reported for the last packets
+var timestampingNames = map[uint8]string{
+	'D': "daemon",
+	'K': "kernel",
+	'H': "hardware",
+}
+
+// parseNTPData parses "chronyc ntpdata <source>" output
+func parseNTPData(output string) (*NTPData, error) {
+	n := &NTPData{}
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "Remote address":
+			// "203.0.113.10 (CB00710A)"
+			n.RemoteAddress = fields[0]
+		case "Remote port":
+			n.RemotePort, err = strconv.Atoi(fields[0])
+		case "Local address":
+			n.LocalAddress = fields[0]
+		case "Leap status":
+			n.LeapStatus, err = parseLeapStatus(value)
+		case "Version":
+			n.Version, err = strconv.Atoi(fields[0])
+		case "Mode":
+			n.Mode = strings.ReplaceAll(strings.ToLower(value), " ", "_")
+		case "Stratum":
+			n.Stratum, err = strconv.Atoi(fields[0])
+		case "Poll interval":
+			// "6 (64 seconds)"
+			n.Poll, err = strconv.Atoi(fields[0])
+		case "Precision":
+			n.Precision, err = strconv.Atoi(fields[0])
+		case "Root delay":
+			n.RootDelay, err = strconv.ParseFloat(fields[0], 64)
+		case "Root dispersion":
+			n.RootDispersion, err = strconv.ParseFloat(fields[0], 64)
+		case "Reference ID":
+			n.ReferenceID = fields[0]
+		case "Reference time":
+			n.RefTime, err = parseChronycTime(value)
+		case "Offset":
+			n.Offset, err = strconv.ParseFloat(fields[0], 64)
+		case "Peer delay":
+			n.PeerDelay, err = strconv.ParseFloat(fields[0], 64)
+		case "Peer dispersion":
+			n.PeerDispersion, err = strconv.ParseFloat(fields[0], 64)
+		case "Response time":
+			n.ResponseTime, err = strconv.ParseFloat(fields[0], 64)
+		case "Jitter asymmetry":
+			n.JitterAsymmetry, err = strconv.ParseFloat(fields[0], 64)
+		case "NTP tests":
+			n.Tests = value
+		case "Interleaved":
+			n.Interleaved = value == "Yes"
+		case "Authenticated":
+			n.Authenticated = value == "Yes"
+		case "TX timestamping":
+			n.TxTimestamping = strings.ToLower(value)
+		case "RX timestamping":
+			n.RxTimestamping = strings.ToLower(value)
+		case "Total TX":
+			n.TotalTx, err = strconv.ParseUint(fields[0], 10, 64)
+		case "Total RX":
+			n.TotalRx, err = strconv.ParseUint(fields[0], 10, 64)
+		case "Total valid RX":
+			n.TotalValidRx, err = strconv.ParseUint(fields[0], 10, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ntpdata %s: %v", key, err)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no ntpdata in chronyc output")
+	}
+	return n, nil
+}
+
+// ntpDataFromCmdmon converts a cmdmon NTP data reply.
+func ntpDataFromCmdmon(r *cmdmon.NTPData) *NTPData {
+	n := &NTPData{
+		RemotePort:      int(r.RemotePort),
+		LeapStatus:      LeapStatus(r.Leap),
+		Version:         int(r.Version),
+		Mode:            ntpModeNames[r.Mode],
+		Stratum:         int(r.Stratum),
+		Poll:            int(r.Poll),
+		Precision:       int(r.Precision),
+		RootDelay:       r.RootDelay,
+		RootDispersion:  r.RootDispersion,
+		ReferenceID:     fmt.Sprintf("%08X", r.RefID),
+		RefTime:         r.RefTime,
+		Offset:          r.Offset,
+		PeerDelay:       r.PeerDelay,
+		PeerDispersion:  r.PeerDispersion,
+		ResponseTime:    r.ResponseTime,
+		JitterAsymmetry: r.JitterAsymmetry,
+		Interleaved:     r.Flags&cmdmon.NTPFlagInterleaved != 0,
+		Authenticated:   r.Flags&cmdmon.NTPFlagAuthenticated != 0,
+		TxTimestamping:  timestampingNames[r.TxTssChar],
+		RxTimestamping:  timestampingNames[r.RxTssChar],
+		TotalTx:         uint64(r.TotalTxCount),
+		TotalRx:         uint64(r.TotalRxCount),
+		TotalValidRx:    uint64(r.TotalValidCount),
+	}
+	if n.Mode == "" {
+		n.Mode = "invalid"
+	}
+	if r.RemoteAddr != nil {
+		n.RemoteAddress = r.RemoteAddr.String()
+	}
+	if r.LocalAddr != nil {
+		n.LocalAddress = r.LocalAddr.String()
+	}
+	if n.RefTime.Unix() == 0 {
+		n.RefTime = time.Time{}
+	}
+	// chronyc prints the ten test bits from the highest, grouped 3-3-4
+	var tests strings.Builder
+	for bit := 9; bit >= 0; bit-- {
+		tests.WriteByte('0' + byte(r.Flags>>uint(bit)&1))
+		if bit == 7 || bit == 4 {
+			tests.WriteByte(' ')
+		}
+	}
+	n.Tests = tests.String()
+	return n
+}
+
+// SelectOptions are the selection options of a source (noselect, prefer,
+// trust, require), as configured or as in effect.
+type SelectOptions struct {
+	NoSelect bool `json:"noselect"`
+	Prefer   bool `json:"prefer"`
+	Trust    bool `json:"trust"`
+	Require  bool `json:"require"`
+}
+
+func selectOptionsFromFlags(flags uint16) SelectOptions {
+	return SelectOptions{
+		NoSelect: flags&cmdmon.SourceFlagNoselect != 0,
+		Prefer:   flags&cmdmon.SourceFlagPrefer != 0,
+		Trust:    flags&cmdmon.SourceFlagTrust != 0,
+		Require:  flags&cmdmon.SourceFlagRequire != 0,
+	}
+}
+
+// parseSelectOptions parses chronyc's option column, e.g. "-P--" or
+// "N---"
+func parseSelectOptions(s string) SelectOptions {
+	return SelectOptions{
+		NoSelect: strings.ContainsRune(s, 'N'),
+		Prefer:   strings.ContainsRune(s, 'P'),
+		Trust:    strings.ContainsRune(s, 'T'),
+		Require:  strings.ContainsRune(s, 'R'),
+	}
+}
+
+// SelectData is the typed form of one row of "chronyc selectdata": why
+// the source was or was not selected the last time selection ran.
+// LowLimit and HighLimit bound the interval containing the true time, in
+// seconds relative to the local clock.
+type SelectData struct {
+	Name              string        `json:"name"`
+	Status            string        `json:"status"`
+	StatusName        string        `json:"status_name"`
+	Authenticated     bool          `json:"authenticated"`
+	ConfiguredOptions SelectOptions `json:"configured_options"`
+	EffectiveOptions  SelectOptions `json:"effective_options"`
+	LastSampleAgo     *int64        `json:"last_sample_ago_seconds"`
+	Score             float64       `json:"score"`
+	LowLimit          float64       `json:"low_limit_seconds"`
+	HighLimit         float64       `json:"high_limit_seconds"`
+	LeapStatus        LeapStatus    `json:"leap_status"`
+}
+
+// Selection status letters from "chronyc selectdata"
+var selectStatusNames = map[byte]string{
+	'N': "noselect",
+	's': "unsynchronised",
+	'M': "missing_samples",
+	'd': "bad_distance",
+	'~': "jittery",
+	'w': "waits_for_others",
+	'W': "waits_for_required",
+	'S': "stale",
+	'O': "orphan",
+	'T': "untrusted",
+	'x': "falseticker",
+	'P': "not_preferred",
+	'U': "waits_for_update",
+	'D': "distant",
+	'-': "not_combined",
+	'+': "combined",
+	'*': "selected",
+}
+
+func (s *SelectData) setStatus(c byte) {
+	s.Status = string([]byte{c})
+	s.StatusName = selectStatusNames[c]
+	if s.StatusName == "" {
+		s.StatusName = "unknown"
+	}
+}
+
+// Leap column of "chronyc selectdata"
+var selectLeapStatus = map[string]LeapStatus{
+	"N": LeapNormal,
+	"+": LeapInsertSecond,
+	"-": LeapDeleteSecond,
+	"?": LeapNotSynchronised,
+}
+
+// parseSelectData parses "chronyc selectdata" output
+func parseSelectData(output string) ([]SelectData, error) {
+	selects := []SelectData{}
+	for _, line := range chronycTableRows(output) {
+		// Example line: * 203.0.113.10             N -P--- -P---   11   1.0   -20us   +50us  N
+		fields := strings.Fields(line)
+		if len(fields) != 10 || len(fields[0]) != 1 {
+			return nil, fmt.Errorf("unrecognised selectdata line %q", line)
+		}
+		s := SelectData{
+			Name:              fields[1],
+			Authenticated:     fields[2] == "Y",
+			ConfiguredOptions: parseSelectOptions(fields[3]),
+			EffectiveOptions:  parseSelectOptions(fields[4]),
+		}
+		s.setStatus(fields[0][0])
+		var err error
+		if fields[5] != "-" {
+			ago, err := parseChronycInterval(fields[5])
+			if err != nil {
+				return nil, fmt.Errorf("selectdata %s last: %v", s.Name, err)
+			}
+			s.LastSampleAgo = &ago
+		}
+		if s.Score, err = strconv.ParseFloat(fields[6], 64); err != nil {
+			return nil, fmt.Errorf("selectdata %s score: %v", s.Name, err)
+		}
+		if s.LowLimit, err = parseChronycSeconds(fields[7]); err != nil {
+			return nil, fmt.Errorf("selectdata %s interval: %v", s.Name, err)
+		}
+		if s.HighLimit, err = parseChronycSeconds(fields[8]); err != nil {
+			return nil, fmt.Errorf("selectdata %s interval: %v", s.Name, err)
+		}
+		leap, ok := selectLeapStatus[fields[9]]
+		if !ok {
+			return nil, fmt.Errorf("selectdata %s: unknown leap %q", s.Name, fields[9])
+		}
+		s.LeapStatus = leap
+		selects = append(selects, s)
+	}
+	return selects, nil
+}
+
+// selectDataFromCmdmon converts a cmdmon select data reply.
+func selectDataFromCmdmon(r *cmdmon.SelectData) SelectData {
+	s := SelectData{
+		Name:              r.Name,
+		Authenticated:     r.Authentication != 0,
+		ConfiguredOptions: selectOptionsFromFlags(r.ConfOptions),
+		EffectiveOptions:  selectOptionsFromFlags(r.EffOptions),
+		Score:             r.Score,
+		LowLimit:          r.LoLimit,
+		HighLimit:         r.HiLimit,
+		LeapStatus:        LeapStatus(r.Leap),
+	}
+	if s.Name == "" && r.IPAddr != nil {
+		s.Name = r.IPAddr.String()
+	}
+	s.setStatus(r.StateChar)
+	if r.LastSampleAgo != ^uint32(0) {
+		ago := int64(r.LastSampleAgo)
+		s.LastSampleAgo = &ago
+	}
+	return s
+}
+
+// SourceDetail is everything chronyd reports about one source. Sections
+// chronyd could not provide are nil with the reason in the matching
+// *Error field; reference clocks have no NTP data.
+type SourceDetail struct {
+	Source           interface{}  `json:"source"`
+	SourceStats      *SourceStats `json:"sourcestats"`
+	SourceStatsError string       `json:"sourcestats_error,omitempty"`
+	NTPData          *NTPData     `json:"ntpdata"`
+	NTPDataError     string       `json:"ntpdata_error,omitempty"`
+	SelectData       *SelectData  `json:"selectdata"`
+	SelectDataError  string       `json:"selectdata_error,omitempty"`
+}
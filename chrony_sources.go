@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"el/brick-clock/cmdmon"
+)
+
+// SourceMode is how chronyd uses a source, the first column of
+// "chronyc sources".
+type SourceMode int
+
+const (
+	SourceModeServer   SourceMode = iota // ^
+	SourceModePeer                       // =
+	SourceModeRefclock                   // #
+)
+
+var sourceModes = []struct {
+	mode SourceMode
+	char byte
+	name string
+}{
+	{SourceModeServer, '^', "server"},
+	{SourceModePeer, '=', "peer"},
+	{SourceModeRefclock, '#', "refclock"},
+}
+
+func (m SourceMode) String() string {
+	for _, e := range sourceModes {
+		if e.mode == m {
+			return e.name
+		}
+	}
+	return "unknown"
+}
+
+func (m SourceMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m SourceMode) char() byte {
+	for _, e := range sourceModes {
+		if e.mode == m {
+			return e.char
+		}
+	}
+	return ' '
+}
+
+// SourceState is the selection state of a source, the second column of
+// "chronyc sources".
+type SourceState int
+
+const (
+	SourceStateSelected    SourceState = iota // * synchronised to
+	SourceStateCombined                       // + combined with the selected source
+	SourceStateNotCombined                    // - acceptable but not combined
+	SourceStateUnreachable                    // ? unreachable or not usable
+	SourceStateFalseticker                    // x disagrees with the majority
+	SourceStateTooVariable                    // ~ too much variance
+)
+
+var sourceStates = []struct {
+	state SourceState
+	char  byte
+	name  string
+}{
+	{SourceStateSelected, '*', "selected"},
+	{SourceStateCombined, '+', "combined"},
+	{SourceStateNotCombined, '-', "not_combined"},
+	{SourceStateUnreachable, '?', "unreachable"},
+	{SourceStateFalseticker, 'x', "falseticker"},
+	{SourceStateTooVariable, '~', "too_variable"},
+}
+
+func (s SourceState) String() string {
+	for _, e := range sourceStates {
+		if e.state == s {
+			return e.name
+		}
+	}
+	return "unknown"
+}
+
+func (s SourceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s SourceState) char() byte {
+	for _, e := range sourceStates {
+		if e.state == s {
+			return e.char
+		}
+	}
+	return ' '
+}
+
+// Source is the typed form of one row of "chronyc sources". Offset is the
+// offset adjusted for frequency changes since the measurement,
+// MeasuredOffset the offset as measured and Error the +/- bound, all in
+// seconds. LastRx is nil when no sample has been received.
+//
+// Name is the name the source was configured with, or its Address when
+// several sources share that name, like the members of a pool. Reference
+// clocks are named by their reference ID and have no Address.
+type Source struct {
+	Mode           SourceMode  `json:"mode"`
+	State          SourceState `json:"state"`
+	Name           string      `json:"name"`
+	Address        string      `json:"address,omitempty"`
+	Stratum        int         `json:"stratum"`
+	Poll           int         `json:"poll"`
+	PollInterval   float64     `json:"poll_interval_seconds"`
+	Reach          uint8       `json:"reach"`
+	ReachRatio     float64     `json:"reach_ratio"`
+	LastRx         *int64      `json:"last_rx_seconds"`
+	Offset         float64     `json:"offset_seconds"`
+	MeasuredOffset float64     `json:"measured_offset_seconds"`
+	Error          float64     `json:"error_seconds"`
+
+	raw string
+}
+
+// setReach fills Reach and ReachRatio from the 8-bit reach register
+func (s *Source) setReach(reach uint8) {
+	s.Reach = reach
+	s.ReachRatio = float64(bits.OnesCount8(reach)) / 8
+}
+
+func (s *Source) setPoll(poll int) {
+	s.Poll = poll
+	s.PollInterval = math.Ldexp(1, poll)
+}
+
+// chronycTableRows returns the data rows of a chronyc table: the lines
+// after the ===== separator below the column headings.
+func chronycTableRows(output string) []string {
+	var rows []string
+	headerFound := false
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		separator := trimmed != "" && strings.Trim(trimmed, "=") == ""
+		if !headerFound {
+			headerFound = separator
+			continue
+		}
+		if trimmed == "" || separator {
+			continue
+		}
+		rows = append(rows, line)
+	}
+	return rows
+}
+
+// Example line: ^* 202.118.1.130                 2   6   377    19   +625ms[ -117ms] +/-   25ms
+var sourcesLineRegex = regexp.MustCompile(
+	`^([\^=#])([*+\-?x~ ])\s+(\S+)\s+(\d+)\s+(-?\d+)\s+([0-7]+)\s+(\S+)\s+` +
+		`([+-]?[\d.]+[a-zA-Z]+)\s*\[\s*([+-]?[\d.]+[a-zA-Z]+)\s*\]\s*\+/-\s*([\d.]+[a-zA-Z]+)\s*$`)
+
+// parseSources parses "chronyc sources" output. A row that cannot be
+// parsed is logged and skipped so that one source chronyc prints in an
+// unexpected way does not hide all the others; only when no row at all
+// can be parsed is the output rejected.
+func parseSources(output string) ([]Source, error) {
+	sources := []Source{}
+	rows := chronycTableRows(output)
+	var firstErr error
+	for _, line := range rows {
+		s, err := parseSourceLine(line)
+		if err != nil {
+			log.Printf("Skipping sources line: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sources = append(sources, s)
+	}
+	if len(sources) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return sources, nil
+}
+
+// parseSourceLine parses one row of "chronyc sources"
+func parseSourceLine(line string) (Source, error) {
+	m := sourcesLineRegex.FindStringSubmatch(strings.TrimRight(line, " "))
+	if m == nil {
+		return Source{}, fmt.Errorf("unrecognised sources line %q", line)
+	}
+	s := Source{Name: m[3], raw: line}
+	for _, e := range sourceModes {
+		if e.char == m[1][0] {
+			s.Mode = e.mode
+		}
+	}
+	s.State = SourceStateUnreachable
+	for _, e := range sourceStates {
+		if e.char == m[2][0] {
+			s.State = e.state
+		}
+	}
+	s.Stratum, _ = strconv.Atoi(m[4])
+	poll, _ := strconv.Atoi(m[5])
+	s.setPoll(poll)
+	reach, err := strconv.ParseUint(m[6], 8, 8)
+	if err != nil {
+		return Source{}, fmt.Errorf("source %s reach %q: %v", s.Name, m[6], err)
+	}
+	s.setReach(uint8(reach))
+	if m[7] != "-" {
+		lastRx, err := parseChronycInterval(m[7])
+		if err != nil {
+			return Source{}, fmt.Errorf("source %s last rx: %v", s.Name, err)
+		}
+		s.LastRx = &lastRx
+	}
+	if s.Offset, err = parseChronycSeconds(m[8]); err != nil {
+		return Source{}, fmt.Errorf("source %s offset: %v", s.Name, err)
+	}
+	if s.MeasuredOffset, err = parseChronycSeconds(m[9]); err != nil {
+		return Source{}, fmt.Errorf("source %s measured offset: %v", s.Name, err)
+	}
+	if s.Error, err = parseChronycSeconds(m[10]); err != nil {
+		return Source{}, fmt.Errorf("source %s error: %v", s.Name, err)
+	}
+	return s, nil
+}
+
+// uniqueSourceNames replaces names shared by several NTP sources with the
+// sources' addresses, which are empty for reference clocks. chronyd
+// gives every member of a pool the pool's name.
+func uniqueSourceNames(names, addrs []string) {
+	count := make(map[string]int, len(names))
+	for _, name := range names {
+		count[name]++
+	}
+	for i, name := range names {
+		if count[name] > 1 && addrs[i] != "" {
+			names[i] = addrs[i]
+		}
+	}
+}
+
+// Units chronyc uses when printing offsets and errors, as the number of
+// units per second
+var chronycSecondUnits = map[string]float64{
+	"ns": 1e9,
+	"us": 1e6,
+	"ms": 1e3,
+	"s":  1,
+}
+
+// parseChronycSeconds parses a value like "+625us" or "25ms" into seconds
+func parseChronycSeconds(s string) (float64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+	})
+	if i <= 0 {
+		return 0, fmt.Errorf("missing unit in %q", s)
+	}
+	perSecond, ok := chronycSecondUnits[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in %q", s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	return v / perSecond, nil
+}
+
+// Suffixes chronyc uses for long intervals like LastRx
+var chronycIntervalUnits = map[byte]int64{
+	'm': 60,
+	'h': 3600,
+	'd': 86400,
+	'y': 365 * 86400,
+}
+
+// parseChronycInterval parses an interval like "19", "35m" or "2h" into
+// whole seconds
+func parseChronycInterval(s string) (int64, error) {
+	scale := int64(1)
+	if n := len(s); n > 0 {
+		if u, ok := chronycIntervalUnits[s[n-1]]; ok {
+			scale = u
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return v * scale, nil
+}
+
+// formatChronycInterval prints an interval the way chronyc does in the
+// LastRx column
+func formatChronycInterval(s int64) string {
+	switch {
+	case s < 1200:
+		return strconv.FormatInt(s, 10)
+	case s < 36000:
+		return fmt.Sprintf("%dm", s/60)
+	case s < 345600:
+		return fmt.Sprintf("%dh", s/3600)
+	case s/86400 <= 999:
+		return fmt.Sprintf("%dd", s/86400)
+	default:
+		return fmt.Sprintf("%dy", s/86400/365)
+	}
+}
+
+// formatChronycSeconds prints a signed offset the way chronyc does in the
+// sources table, picking the unit that keeps four significant digits.
+func formatChronycSeconds(v float64) string {
+	a := abs(v)
+	var scaled float64
+	var unit string
+	switch {
+	case a < 9999.5e-9:
+		scaled, unit = v*1e9, "ns"
+	case a < 9999.5e-6:
+		scaled, unit = v*1e6, "us"
+	case a < 9999.5e-3:
+		scaled, unit = v*1e3, "ms"
+	default:
+		scaled, unit = v, "s"
+	}
+	return fmt.Sprintf("%+.0f%s", scaled, unit)
+}
+
+// sourceFromCmdmon converts a cmdmon source reply.
+func sourceFromCmdmon(r *cmdmon.SourceData) Source {
+	s := Source{
+		Name:           r.Name,
+		Stratum:        int(r.Stratum),
+		Offset:         r.LatestMeas,
+		MeasuredOffset: r.OrigLatestMeas,
+		Error:          r.LatestMeasErr,
+	}
+	if r.Mode != cmdmon.SourceModeRefclock && r.IPAddr != nil {
+		s.Address = r.IPAddr.String()
+	}
+	if s.Name == "" {
+		s.Name = s.Address
+	}
+	switch r.Mode {
+	case cmdmon.SourceModePeer:
+		s.Mode = SourceModePeer
+	case cmdmon.SourceModeRefclock:
+		s.Mode = SourceModeRefclock
+	default:
+		s.Mode = SourceModeServer
+	}
+	switch r.State {
+	case cmdmon.SourceStateSelected:
+		s.State = SourceStateSelected
+	case cmdmon.SourceStateUnselected:
+		s.State = SourceStateCombined
+	case cmdmon.SourceStateSelectable:
+		s.State = SourceStateNotCombined
+	case cmdmon.SourceStateFalseticker:
+		s.State = SourceStateFalseticker
+	case cmdmon.SourceStateJittery:
+		s.State = SourceStateTooVariable
+	default:
+		s.State = SourceStateUnreachable
+	}
+	s.setPoll(int(r.Poll))
+	s.setReach(uint8(r.Reachability))
+	// chronyd reports the age of a source that never replied as the
+	// largest value it can hold; chronyc prints it as "-".
+	if r.SinceSample != math.MaxUint32 {
+		lastRx := int64(r.SinceSample)
+		s.LastRx = &lastRx
+	}
+	return s
+}
+
+// legacyMap renders the source in the v1 shape.
+func (s *Source) legacyMap() map[string]string {
+	lastRx := "-"
+	if s.LastRx != nil {
+		lastRx = formatChronycInterval(*s.LastRx)
+	}
+	m := map[string]string{
+		"state":   string([]byte{s.Mode.char(), s.State.char()}),
+		"name":    s.Name,
+		"stratum": strconv.Itoa(s.Stratum),
+		"poll":    strconv.Itoa(s.Poll),
+		"reach":   strconv.FormatUint(uint64(s.Reach), 8),
+		"lastrx":  lastRx,
+		"offset":  formatChronycSeconds(s.Offset),
+	}
+	if s.raw != "" {
+		m["raw"] = s.raw
+	}
+	return m
+}
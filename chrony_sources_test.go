@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// checkGolden compares got, as indented JSON, with testdata/name, or
+// rewrites the file with -update.
+func checkGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+	data, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("%s differs from the golden file:\n%s", name, data)
+	}
+}
+
+func int64p(v int64) *int64 { return &v }
+
+func TestParseSources(t *testing.T) {
+	sources, err := parseSources(readTestdata(t, "sources.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mode                   SourceMode
+		state                  SourceState
+		name                   string
+		stratum, poll          int
+		reach                  uint8
+		lastRx                 *int64
+		offset, measured, errs float64
+	}{
+		{SourceModeRefclock, SourceStateSelected, "PPS0", 0, 4, 0377, int64p(15), -120e-9, -150e-9, 210e-9},
+		{SourceModeRefclock, SourceStateNotCombined, "GPS", 0, 4, 0377, int64p(14), 34e-3, 34e-3, 201e-3},
+		{SourceModeServer, SourceStateCombined, "time.cloudflare.com", 3, 6, 0377, int64p(19), 625e-6, 637e-6, 25e-3},
+		{SourceModeServer, SourceStateNotCombined, "ntp.example.org", 2, 10, 0377, int64p(52 * 60), -1234e-6, -1300e-6, 48e-3},
+		{SourceModeServer, SourceStateFalseticker, "falseticker.example.net", 2, 8, 0377, int64p(215), 2381e-3, 2381e-3, 12e-3},
+		{SourceModeServer, SourceStateTooVariable, "jitter.example.net", 2, 6, 0177, int64p(26), 4521e-6, 4521e-6, 132e-3},
+		{SourceModePeer, SourceStateUnreachable, "peer.example.com", 2, 7, 0377, int64p(10 * 3600), -12, -12, 15e-3},
+		{SourceModeServer, SourceStateUnreachable, "2001:db8::123", 0, 6, 0, nil, 0, 0, 0},
+		{SourceModeServer, SourceStateNotCombined, "old.example.com", 2, 10, 017, int64p(12 * 86400), 11e-3, 11e-3, 36e-3},
+	}
+	if len(sources) != len(tests) {
+		t.Fatalf("parsed %d sources, want %d", len(sources), len(tests))
+	}
+	for i, tt := range tests {
+		s := sources[i]
+		if s.Mode != tt.mode || s.State != tt.state || s.Name != tt.name || s.Stratum != tt.stratum ||
+			s.Poll != tt.poll || s.Reach != tt.reach {
+			t.Errorf("source %d = %v %v %q stratum %d poll %d reach %o, want %v %v %q stratum %d poll %d reach %o",
+				i, s.Mode, s.State, s.Name, s.Stratum, s.Poll, s.Reach,
+				tt.mode, tt.state, tt.name, tt.stratum, tt.poll, tt.reach)
+		}
+		if (s.LastRx == nil) != (tt.lastRx == nil) || (s.LastRx != nil && *s.LastRx != *tt.lastRx) {
+			t.Errorf("source %s last rx = %v, want %v", s.Name, s.LastRx, tt.lastRx)
+		}
+		if !closeTo(s.Offset, tt.offset) || !closeTo(s.MeasuredOffset, tt.measured) || !closeTo(s.Error, tt.errs) {
+			t.Errorf("source %s = %g [%g] +/- %g, want %g [%g] +/- %g", s.Name,
+				s.Offset, s.MeasuredOffset, s.Error, tt.offset, tt.measured, tt.errs)
+		}
+	}
+	if sources[3].PollInterval != 1024 || sources[5].ReachRatio != 7.0/8 {
+		t.Errorf("poll interval %v, reach ratio %v", sources[3].PollInterval, sources[5].ReachRatio)
+	}
+}
+
+// closeTo allows for the rounding of unit conversions
+func closeTo(got, want float64) bool {
+	return abs(got-want) <= 1e-12+1e-9*abs(want)
+}
+
+func TestParseSourcesByAddress(t *testing.T) {
+	sources, err := parseSources(readTestdata(t, "sources-n.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PPS0", "GPS", "162.159.200.1", "192.0.2.10", "198.51.100.7",
+		"203.0.113.26", "2001:db8:100::7", "2001:db8::123", "192.0.2.99"}
+	if len(sources) != len(want) {
+		t.Fatalf("parsed %d sources, want %d", len(sources), len(want))
+	}
+	for i := range want {
+		if sources[i].Name != want[i] {
+			t.Errorf("source %d name = %q, want %q", i, sources[i].Name, want[i])
+		}
+	}
+}
+
+func TestParseSourcesSkipsUnrecognisedLines(t *testing.T) {
+	sources, err := parseSources(readTestdata(t, "sources-unrecognised.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0].Name != "time.cloudflare.com" || sources[1].Name != "ntp.example.org" {
+		t.Errorf("sources = %+v, want the two recognised rows", sources)
+	}
+
+	garbage := "MS Name/IP address\n=====\nsomething else entirely\n"
+	if _, err := parseSources(garbage); err == nil {
+		t.Error("parsed a table without a single recognised row")
+	}
+	header := strings.SplitAfterN(readTestdata(t, "sources.txt"), "\n", 3)
+	if sources, err := parseSources(header[0] + header[1]); err != nil || len(sources) != 0 {
+		t.Errorf("table without rows = %v, %v; want no sources", sources, err)
+	}
+}
+
+func TestSourcesLegacyMap(t *testing.T) {
+	sources, err := parseSources(readTestdata(t, "sources.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := make([]map[string]string, 0, len(sources))
+	for i := range sources {
+		legacy = append(legacy, sources[i].legacyMap())
+	}
+	checkGolden(t, "sources.legacy.json", legacy)
+
+	// v1 clients compare the state and offset with what chronyc prints
+	for i, m := range legacy {
+		row := sourcesLineRegex.FindStringSubmatch(m["raw"])
+		if m["state"] != row[1]+row[2] || m["offset"] != row[8] || m["lastrx"] != row[7] {
+			t.Errorf("source %d: state %q offset %q lastrx %q, chronyc printed %q %q %q",
+				i, m["state"], m["offset"], m["lastrx"], row[1]+row[2], row[8], row[7])
+		}
+	}
+
+	// Typed sources, from cmdmon, have no raw line
+	if _, ok := (&Source{Mode: SourceModeServer}).legacyMap()["raw"]; ok {
+		t.Error("legacy map of a source without a raw line has raw")
+	}
+}
+
+func TestChronycUnits(t *testing.T) {
+	seconds := []struct {
+		in   string
+		want float64
+	}{
+		{"+120ns", 120e-9},
+		{"-625us", -625e-6},
+		{"25ms", 25e-3},
+		{"+12s", 12},
+		{"-0.5s", -0.5},
+	}
+	for _, tt := range seconds {
+		got, err := parseChronycSeconds(tt.in)
+		if err != nil || !closeTo(got, tt.want) {
+			t.Errorf("parseChronycSeconds(%q) = %g, %v; want %g", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"25", "ms", "25min", "+-3us"} {
+		if _, err := parseChronycSeconds(in); err == nil {
+			t.Errorf("parseChronycSeconds(%q) succeeded", in)
+		}
+	}
+
+	intervals := []struct {
+		in   string
+		want int64
+	}{
+		{"19", 19},
+		{"35m", 35 * 60},
+		{"10h", 10 * 3600},
+		{"12d", 12 * 86400},
+		{"3y", 3 * 365 * 86400},
+	}
+	for _, tt := range intervals {
+		got, err := parseChronycInterval(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseChronycInterval(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+		if back := formatChronycInterval(tt.want); back != tt.in {
+			t.Errorf("formatChronycInterval(%d) = %q, want %q", tt.want, back, tt.in)
+		}
+	}
+}
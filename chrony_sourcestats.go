@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"el/brick-clock/cmdmon"
+)
+
+// SourceStats is the typed form of one row of "chronyc sourcestats": the
+// regression chronyd keeps for each source. Frequency is the residual
+// frequency of the source relative to the local clock; Offset and StdDev
+// are in seconds, frequencies in ppm.
+type SourceStats struct {
+	Name          string  `json:"name"`
+	Samples       int     `json:"samples"`
+	Runs          int     `json:"runs"`
+	Span          int64   `json:"span_seconds"`
+	Frequency     float64 `json:"frequency_ppm"`
+	FrequencySkew float64 `json:"frequency_skew_ppm"`
+	Offset        float64 `json:"offset_seconds"`
+	StdDev        float64 `json:"std_dev_seconds"`
+}
+
+// parseSourceStats parses "chronyc sourcestats" output
+func parseSourceStats(output string) ([]SourceStats, error) {
+	stats := []SourceStats{}
+	for _, line := range chronycTableRows(output) {
+		// Example line: time.cloudflare.com        20  11   39m     -0.004      0.016   -14us    18us
+		fields := strings.Fields(line)
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unrecognised sourcestats line %q", line)
+		}
+		s := SourceStats{Name: fields[0]}
+		var err error
+		if s.Samples, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("sourcestats %s NP: %v", s.Name, err)
+		}
+		if s.Runs, err = strconv.Atoi(fields[2]); err != nil {
+			return nil, fmt.Errorf("sourcestats %s NR: %v", s.Name, err)
+		}
+		if s.Span, err = parseChronycInterval(fields[3]); err != nil {
+			return nil, fmt.Errorf("sourcestats %s span: %v", s.Name, err)
+		}
+		if s.Frequency, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return nil, fmt.Errorf("sourcestats %s frequency: %v", s.Name, err)
+		}
+		if s.FrequencySkew, err = strconv.ParseFloat(fields[5], 64); err != nil {
+			return nil, fmt.Errorf("sourcestats %s freq skew: %v", s.Name, err)
+		}
+		if s.Offset, err = parseChronycSeconds(fields[6]); err != nil {
+			return nil, fmt.Errorf("sourcestats %s offset: %v", s.Name, err)
+		}
+		if s.StdDev, err = parseChronycSeconds(fields[7]); err != nil {
+			return nil, fmt.Errorf("sourcestats %s std dev: %v", s.Name, err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// sourceStatsFromCmdmon converts a cmdmon sourcestats reply.
+func sourceStatsFromCmdmon(r *cmdmon.SourceStats) SourceStats {
+	s := SourceStats{
+		Name:          r.Name,
+		Samples:       int(r.NSamples),
+		Runs:          int(r.NRuns),
+		Span:          int64(r.SpanSeconds),
+		Frequency:     r.ResidFreqPPM,
+		FrequencySkew: r.SkewPPM,
+		Offset:        r.EstOffset,
+		StdDev:        r.SD,
+	}
+	if s.Name == "" && r.IPAddr != nil {
+		s.Name = r.IPAddr.String()
+	}
+	return s
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"el/brick-clock/cmdmon"
+)
+
+const (
+	// chronydStopTimeout bounds how long chronyd gets to exit after
+	// SIGTERM before it is killed.
+	chronydStopTimeout = 5 * time.Second
+	// chronydStartTimeout bounds how long Restart waits for the command
+	// socket of the new chronyd.
+	chronydStartTimeout = 10 * time.Second
+
+	// Crash restarts wait chronydMinBackoff, doubling up to
+	// chronydMaxBackoff while chronyd keeps exiting within
+	// chronydStableRun of being started.
+	chronydMinBackoff = time.Second
+	chronydMaxBackoff = time.Minute
+	chronydStableRun  = time.Minute
+)
+
+// DaemonStatus describes the chronyd process the API supervises.
+type DaemonStatus struct {
+	// Supervised is false when chronyd is managed outside the API
+	// (CHRONYD_SUPERVISE=off); the other fields are then unset.
+	Supervised    bool       `json:"supervised"`
+	Running       bool       `json:"running"`
+	PID           int        `json:"pid,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	UptimeSeconds float64    `json:"uptime_seconds"`
+	// Restarts counts every start after the first, requested or not;
+	// Crashes counts the unexpected exits among them.
+	Restarts int    `json:"restarts"`
+	Crashes  int    `json:"crashes"`
+	LastExit string `json:"last_exit,omitempty"`
+}
+
+var errNotSupervised = errors.New("chronyd is not supervised (CHRONYD_SUPERVISE=off), restart it externally")
+
+// chronydSupervisor runs chronyd in the foreground as a child of the API
+// process. It logs chronyd's output, restarts it with backoff when it
+// exits on its own, and stops it with SIGTERM.
+type chronydSupervisor struct {
+	confPath   string
+	socketPath string
+
+	// ops serializes Start, Restart and Stop.
+	ops sync.Mutex
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	startedAt time.Time
+	backoff   time.Duration
+	restarts  int
+	crashes   int
+	lastExit  string
+	started   bool
+	stopping  bool
+}
+
+// newChronydSupervisorFromEnv returns a supervisor for chronyd with
+// confPath, or nil when CHRONYD_SUPERVISE is "off". Readiness is checked
+// on the command socket named by CHRONY_CMDMON_ADDR when it is a path.
+func newChronydSupervisorFromEnv(confPath string) *chronydSupervisor {
+	if os.Getenv("CHRONYD_SUPERVISE") == "off" {
+		log.Println("chronyd is not supervised; it must be started and restarted externally")
+		return nil
+	}
+	socketPath := cmdmon.DefaultSocketPath
+	if addr := os.Getenv("CHRONY_CMDMON_ADDR"); strings.HasPrefix(addr, "/") {
+		socketPath = addr
+	}
+	return &chronydSupervisor{
+		confPath:   confPath,
+		socketPath: socketPath,
+		backoff:    chronydMinBackoff,
+	}
+}
+
+// Start starts chronyd. If it cannot be started, it is retried with
+// backoff in the background.
+func (s *chronydSupervisor) Start() error {
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.start()
+	if err != nil {
+		s.scheduleRestart()
+	}
+	return err
+}
+
+// Restart stops chronyd gracefully, starts it again and waits until it
+// answers on its command socket.
+func (s *chronydSupervisor) Restart() error {
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	s.stop()
+
+	s.mu.Lock()
+	err := s.start()
+	exited := s.exited
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.waitReady(exited)
+}
+
+// Stop stops chronyd for good, when the API shuts down.
+func (s *chronydSupervisor) Stop() {
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+	s.stop()
+}
+
+// Status reports on the current chronyd process.
+func (s *chronydSupervisor) Status() *DaemonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &DaemonStatus{
+		Supervised: true,
+		Restarts:   s.restarts,
+		Crashes:    s.crashes,
+		LastExit:   s.lastExit,
+	}
+	if s.cmd != nil {
+		startedAt := s.startedAt
+		status.Running = true
+		status.PID = s.cmd.Process.Pid
+		status.StartedAt = &startedAt
+		status.UptimeSeconds = time.Since(startedAt).Seconds()
+	}
+	return status
+}
+
+// start starts a chronyd process. Callers hold s.mu.
+func (s *chronydSupervisor) start() error {
+	if s.cmd != nil || s.stopping {
+		return nil
+	}
+	// -d keeps chronyd in the foreground, logging to stderr
+	cmd := exec.Command("chronyd", "-d", "-f", s.confPath)
+	out := &logWriter{prefix: "chronyd: "}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start chronyd: %v", err)
+	}
+	if s.started {
+		s.restarts++
+	}
+	s.started = true
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+	s.startedAt = time.Now()
+	log.Printf("chronyd started with PID %d", cmd.Process.Pid)
+	go s.wait(cmd, s.exited)
+	return nil
+}
+
+// wait reaps cmd and, unless it was stopped on purpose, schedules a
+// restart.
+func (s *chronydSupervisor) wait(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastExit = "exited"
+	if err != nil {
+		s.lastExit = err.Error()
+	}
+	close(exited)
+	if s.cmd != cmd {
+		// stop cleared s.cmd before signalling the process
+		return
+	}
+	s.cmd = nil
+	s.crashes++
+	if time.Since(s.startedAt) >= chronydStableRun {
+		s.backoff = chronydMinBackoff
+	}
+	log.Printf("chronyd (PID %d) %s", cmd.Process.Pid, s.lastExit)
+	s.scheduleRestart()
+}
+
+// scheduleRestart starts chronyd again after the current backoff, and
+// doubles the backoff. Callers hold s.mu.
+func (s *chronydSupervisor) scheduleRestart() {
+	delay := s.backoff
+	s.backoff *= 2
+	if s.backoff > chronydMaxBackoff {
+		s.backoff = chronydMaxBackoff
+	}
+	log.Printf("Restarting chronyd in %v", delay)
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cmd != nil || s.stopping {
+			return
+		}
+		if err := s.start(); err != nil {
+			log.Printf("%v", err)
+			s.scheduleRestart()
+		}
+	})
+}
+
+// stop sends chronyd SIGTERM and waits for it to exit, killing it after
+// chronydStopTimeout.
+func (s *chronydSupervisor) stop() {
+	s.mu.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.cmd = nil
+	s.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	log.Printf("Stopping chronyd (PID %d)", cmd.Process.Pid)
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(chronydStopTimeout):
+		log.Printf("chronyd did not exit within %v, killing it", chronydStopTimeout)
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// waitReady waits until chronyd answers a null request on its command
+// socket, failing early if the process exits.
+func (s *chronydSupervisor) waitReady(exited chan struct{}) error {
+	deadline := time.Now().Add(chronydStartTimeout)
+	for {
+		select {
+		case <-exited:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return fmt.Errorf("chronyd %s", s.lastExit)
+		default:
+		}
+		err := pingChronyd(s.socketPath)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("chronyd command socket not ready after %v: %v", chronydStartTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func pingChronyd(socketPath string) error {
+	client, err := cmdmon.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.Timeout = 200 * time.Millisecond
+	client.Retries = 0
+	return client.Ping()
+}
+
+// logWriter logs what is written to it line by line.
+type logWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("%s%s", w.prefix, w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
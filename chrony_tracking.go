@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"el/brick-clock/cmdmon"
+)
+
+// LeapStatus is the leap second state chronyd reports.
+type LeapStatus int
+
+const (
+	LeapNormal LeapStatus = iota
+	LeapInsertSecond
+	LeapDeleteSecond
+	LeapNotSynchronised
+)
+
+var leapStatusNames = map[LeapStatus]string{
+	LeapNormal:          "normal",
+	LeapInsertSecond:    "insert_second",
+	LeapDeleteSecond:    "delete_second",
+	LeapNotSynchronised: "not_synchronised",
+}
+
+// chronyc's wording, used by the v1 tracking map.
+var leapStatusChronyc = map[LeapStatus]string{
+	LeapNormal:          "Normal",
+	LeapInsertSecond:    "Insert second",
+	LeapDeleteSecond:    "Delete second",
+	LeapNotSynchronised: "Not synchronised",
+}
+
+func (l LeapStatus) String() string {
+	if name, ok := leapStatusNames[l]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (l LeapStatus) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *LeapStatus) UnmarshalText(text []byte) error {
+	for status, name := range leapStatusNames {
+		if name == string(text) {
+			*l = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown leap status %q", text)
+}
+
+// Tracking is the typed form of "chronyc tracking". Offsets, delays and
+// intervals are in seconds, frequencies in ppm. SystemTime and Frequency
+// are positive when the system clock is ahead of NTP time / running fast.
+type Tracking struct {
+	ReferenceID       string     `json:"reference_id"`
+	ReferenceName     string     `json:"reference_name"`
+	Stratum           int        `json:"stratum"`
+	RefTime           time.Time  `json:"ref_time"`
+	SystemTime        float64    `json:"system_time_seconds"`
+	LastOffset        float64    `json:"last_offset_seconds"`
+	RMSOffset         float64    `json:"rms_offset_seconds"`
+	Frequency         float64    `json:"frequency_ppm"`
+	ResidualFrequency float64    `json:"residual_frequency_ppm"`
+	Skew              float64    `json:"skew_ppm"`
+	RootDelay         float64    `json:"root_delay_seconds"`
+	RootDispersion    float64    `json:"root_dispersion_seconds"`
+	UpdateInterval    float64    `json:"update_interval_seconds"`
+	LeapStatus        LeapStatus `json:"leap_status"`
+}
+
+// chronyc prints reference times as "%a %b %d %H:%M:%S %Y" in UTC
+const chronycTimeLayout = "Mon Jan 02 15:04:05 2006"
+
+// parseTracking parses "chronyc tracking" output
+func parseTracking(output string) (*Tracking, error) {
+	t := &Tracking{}
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "Reference ID":
+			// "CB00710A (203.0.113.10)"
+			t.ReferenceID = fields[0]
+			if len(fields) > 1 {
+				t.ReferenceName = strings.Trim(fields[1], "()")
+			}
+		case "Stratum":
+			t.Stratum, err = strconv.Atoi(fields[0])
+		case "Ref time (UTC)":
+			t.RefTime, err = parseChronycTime(value)
+		case "System time":
+			// "0.000012345 seconds fast of NTP time"
+			t.SystemTime, err = parseDirectional(fields, "fast", "slow")
+		case "Last offset":
+			t.LastOffset, err = strconv.ParseFloat(fields[0], 64)
+		case "RMS offset":
+			t.RMSOffset, err = strconv.ParseFloat(fields[0], 64)
+		case "Frequency":
+			// "1.234 ppm slow"
+			t.Frequency, err = parseDirectional(fields, "fast", "slow")
+		case "Residual freq":
+			t.ResidualFrequency, err = strconv.ParseFloat(fields[0], 64)
+		case "Skew":
+			t.Skew, err = strconv.ParseFloat(fields[0], 64)
+		case "Root delay":
+			t.RootDelay, err = strconv.ParseFloat(fields[0], 64)
+		case "Root dispersion":
+			t.RootDispersion, err = strconv.ParseFloat(fields[0], 64)
+		case "Update interval":
+			t.UpdateInterval, err = strconv.ParseFloat(fields[0], 64)
+		case "Leap status":
+			t.LeapStatus, err = parseLeapStatus(value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tracking %s: %v", key, err)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no tracking data in chronyc output")
+	}
+	return t, nil
+}
+
+func parseChronycTime(value string) (time.Time, error) {
+	t, err := time.Parse(chronycTimeLayout, value)
+	if err != nil {
+		t, err = time.Parse("Mon Jan _2 15:04:05 2006", value)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.Unix() == 0 {
+		// chronyd reports the epoch before the first update
+		return time.Time{}, nil
+	}
+	return t, nil
+}
+
+// parseDirectional parses "<magnitude> <unit> <word>" where positive is
+// the word and negative the opposite one.
+func parseDirectional(fields []string, positive, negative string) (float64, error) {
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 3 {
+		return v, nil
+	}
+	switch fields[2] {
+	case positive:
+		return v, nil
+	case negative:
+		if v == 0 {
+			return 0, nil
+		}
+		return -v, nil
+	}
+	return 0, fmt.Errorf("unexpected direction %q", fields[2])
+}
+
+func parseLeapStatus(value string) (LeapStatus, error) {
+	for status, name := range leapStatusChronyc {
+		if strings.EqualFold(name, value) {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown leap status %q", value)
+}
+
+// trackingFromCmdmon converts a cmdmon tracking reply.
+func trackingFromCmdmon(r *cmdmon.Tracking) *Tracking {
+	t := &Tracking{
+		ReferenceID:       fmt.Sprintf("%08X", r.RefID),
+		Stratum:           int(r.Stratum),
+		RefTime:           r.RefTime,
+		SystemTime:        -r.CurrentCorrection,
+		LastOffset:        r.LastOffset,
+		RMSOffset:         r.RMSOffset,
+		Frequency:         r.FreqPPM,
+		ResidualFrequency: r.ResidFreqPPM,
+		Skew:              r.SkewPPM,
+		RootDelay:         r.RootDelay,
+		RootDispersion:    r.RootDispersion,
+		UpdateInterval:    r.LastUpdateInterval,
+		LeapStatus:        LeapStatus(r.LeapStatus),
+	}
+	if r.IPAddr != nil {
+		t.ReferenceName = r.IPAddr.String()
+	}
+	if t.RefTime.Unix() == 0 {
+		t.RefTime = time.Time{}
+	}
+	return t
+}
+
+// legacyMap renders the tracking report in the v1 shape: chronyc's
+// labels and text values, with ReferenceID, UpdateRate and LeapStatus
+// kept for the frontend.
+func (t *Tracking) legacyMap() map[string]string {
+	systemDir := "fast"
+	if t.SystemTime < 0 {
+		systemDir = "slow"
+	}
+	freqDir := "fast"
+	if t.Frequency < 0 {
+		freqDir = "slow"
+	}
+	refTime := time.Unix(0, 0).UTC()
+	if !t.RefTime.IsZero() {
+		refTime = t.RefTime.UTC()
+	}
+	leap := leapStatusChronyc[t.LeapStatus]
+	update := fmt.Sprintf("%.1f seconds", t.UpdateInterval)
+	return map[string]string{
+		"ReferenceID":     fmt.Sprintf("%s (%s)", t.ReferenceID, t.ReferenceName),
+		"Stratum":         strconv.Itoa(t.Stratum),
+		"Ref time (UTC)":  refTime.Format(chronycTimeLayout),
+		"System time":     fmt.Sprintf("%.9f seconds %s of NTP time", abs(t.SystemTime), systemDir),
+		"Last offset":     fmt.Sprintf("%+.9f seconds", t.LastOffset),
+		"RMS offset":      fmt.Sprintf("%.9f seconds", t.RMSOffset),
+		"Frequency":       fmt.Sprintf("%.3f ppm %s", abs(t.Frequency), freqDir),
+		"Residual freq":   fmt.Sprintf("%+.3f ppm", t.ResidualFrequency),
+		"Skew":            fmt.Sprintf("%.3f ppm", t.Skew),
+		"Root delay":      fmt.Sprintf("%.9f seconds", t.RootDelay),
+		"Root dispersion": fmt.Sprintf("%.9f seconds", t.RootDispersion),
+		"Update interval": update,
+		"UpdateRate":      update,
+		"Leap status":     leap,
+		"LeapStatus":      leap,
+	}
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
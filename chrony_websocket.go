@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// wsMaxMessageSize bounds a message from a client.
+	wsMaxMessageSize = 64 << 10
+	// wsPingInterval is how often clients are pinged. A client that sends
+	// nothing, not even a pong, for wsReadTimeout is dropped.
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 2 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+	// wsCommandQueue is how many commands of a connection may wait while
+	// one runs.
+	wsCommandQueue = 8
+	// wsBearerProtocol is the subprotocol a browser offers before its
+	// token.
+	wsBearerProtocol = "bearer"
+)
+
+// wsTopics are the status topics a WebSocket client can subscribe to, in
+// the order their updates are sent.
+var wsTopics = []string{"tracking", "sources", "clients", "server-mode"}
+
+// wsCommandPermissions maps each WebSocket command to the permission it
+// needs, the same as its REST endpoint.
+var wsCommandPermissions = map[string]string{
+	"set_servers":     "clock/servers",
+	"set_server_mode": "clock/server_mode",
+	"burst":           daemonActionPermissions["burst"],
+}
+
+// wsRequest is a message from a client. Commands take the body of the
+// matching REST request in Data.
+type wsRequest struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Topics []string        `json:"topics"`
+	Reason string          `json:"reason"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// wsResponse answers the request with the same ID, with its result or an
+// error.
+type wsResponse struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *APIError   `json:"error,omitempty"`
+}
+
+// wsUpdate carries a subscribed topic. Error replaces Data when chronyd
+// could not provide the section.
+type wsUpdate struct {
+	Type  string      `json:"type"`
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+	Error *APIError   `json:"error,omitempty"`
+}
+
+// wsSession is one WebSocket client: the claims of the token it connected
+// with, and the topics it subscribed to.
+type wsSession struct {
+	app       *App
+	conn      *wsConn
+	claims    map[string]interface{}
+	requestID string
+	// topics is only used by the goroutine running the session
+	topics map[string]bool
+}
+
+// handleWebSocket serves the WebSocket API: GET /ws. The origin and the
+// token are checked when the connection opens. Browsers cannot set the
+// Authorization header on a WebSocket, so they offer the subprotocols
+// "bearer" and the token instead. The token is never taken from the URL,
+// which ends up in access logs and browser history.
+func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	if !a.wsOriginAllowed(r) {
+		writeError(w, http.StatusForbidden, ERR_FORBIDDEN, "Forbidden: origin not allowed",
+			map[string]string{"origin": r.Header.Get("Origin")})
+		return
+	}
+	claims, err := getClaimsFromRequest(r)
+	protocol := ""
+	if token := wsProtocolToken(r.Header); err != nil && token != "" {
+		claims, err = parseToken(token)
+		protocol = wsBearerProtocol
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED, "Unauthorized: "+err.Error(), nil)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r, protocol)
+	if err != nil {
+		// upgradeWebSocket has responded
+		return
+	}
+	s := &wsSession{
+		app:       a,
+		conn:      conn,
+		claims:    claims,
+		requestID: w.Header().Get(requestIDHeader),
+		topics:    make(map[string]bool),
+	}
+	s.run()
+}
+
+// wsOriginAllowed reports whether the page r comes from may open a
+// WebSocket: its own origin, or one of WS_ALLOWED_ORIGINS. Requests
+// without an Origin header do not come from a browser, and are allowed.
+func (a *App) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range a.wsOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsProtocolToken returns the token of the subprotocols "bearer, <token>",
+// or "" if the client did not offer them.
+func wsProtocolToken(h http.Header) string {
+	var protocols []string
+	for _, value := range h.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+	if len(protocols) != 2 || protocols[0] != wsBearerProtocol {
+		return ""
+	}
+	return protocols[1]
+}
+
+// run serves the session until the client goes away. Subscriptions are
+// handled right away; commands run one at a time in the background, so
+// that updates keep flowing while chronyd restarts.
+func (s *wsSession) run() {
+	defer s.conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	requests := make(chan wsRequest)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			message, err := s.conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			var req wsRequest
+			if err := json.Unmarshal(message, &req); err != nil {
+				s.sendError("", &APIError{Code: ERR_INVALID_JSON, Message: "Invalid JSON", Details: err.Error()})
+				continue
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	commands := make(chan wsRequest, wsCommandQueue)
+	defer close(commands)
+	go func() {
+		for req := range commands {
+			s.runCommand(req)
+		}
+	}()
+
+	changed := s.app.events.notify()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case req := <-requests:
+			switch {
+			case req.Type == "subscribe" || req.Type == "unsubscribe":
+				s.subscribe(req)
+			case wsCommandPermissions[req.Type] != "":
+				select {
+				case commands <- req:
+				default:
+					s.sendError(req.ID, &APIError{Code: ERR_TOO_MANY_REQUESTS, Message: "Too many commands in progress"})
+				}
+			default:
+				s.sendError(req.ID, &APIError{
+					Code:    ERR_INVALID_REQUEST,
+					Message: "Unknown message type: " + req.Type,
+					Details: map[string]interface{}{"types": wsMessageTypes()},
+				})
+			}
+		case <-changed:
+			changed = s.app.events.notify()
+			s.sendUpdates(s.app.collector.Snapshot(), s.topics)
+		case <-ping.C:
+			if err := s.conn.Ping(); err != nil {
+				return
+			}
+		case <-readErr:
+			return
+		}
+	}
+}
+
+// wsMessageTypes returns the message types a client can send, sorted.
+func wsMessageTypes() []string {
+	types := []string{"subscribe", "unsubscribe"}
+	for name := range wsCommandPermissions {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// subscribe adds or removes the topics of req, and sends the current
+// state of the topics it adds.
+func (s *wsSession) subscribe(req wsRequest) {
+	if len(req.Topics) == 0 {
+		s.sendError(req.ID, &APIError{Code: ERR_INVALID_REQUEST, Message: "topics must be a non-empty list"})
+		return
+	}
+	for _, topic := range req.Topics {
+		if !isWSTopic(topic) {
+			s.sendError(req.ID, &APIError{
+				Code:    ERR_INVALID_REQUEST,
+				Message: "Unknown topic: " + topic,
+				Details: map[string]interface{}{"topics": wsTopics},
+			})
+			return
+		}
+	}
+	added := make(map[string]bool)
+	for _, topic := range req.Topics {
+		if req.Type == "unsubscribe" {
+			delete(s.topics, topic)
+		} else if !s.topics[topic] {
+			s.topics[topic] = true
+			added[topic] = true
+		}
+	}
+	subscribed := []string{}
+	for _, topic := range wsTopics {
+		if s.topics[topic] {
+			subscribed = append(subscribed, topic)
+		}
+	}
+	s.send(wsResponse{Type: "result", ID: req.ID, Data: map[string]interface{}{"topics": subscribed}})
+	if len(added) > 0 {
+		s.sendUpdates(s.app.collector.Snapshot(), added)
+	}
+}
+
+func isWSTopic(topic string) bool {
+	for _, t := range wsTopics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// sendUpdates sends the topics of snap.
+func (s *wsSession) sendUpdates(snap *Snapshot, topics map[string]bool) {
+	for _, topic := range wsTopics {
+		if !topics[topic] {
+			continue
+		}
+		var section interface{}
+		switch topic {
+		case "tracking":
+			section = snap.Tracking
+		case "sources":
+			section = snap.Sources
+		case "clients":
+			section = snap.Clients
+		case "server-mode":
+			section = snap.ServerMode
+		}
+		update := wsUpdate{Type: "update", Topic: topic, Time: snap.Time}
+		if err, ok := section.(error); ok {
+			update.Error = &APIError{Code: ERR_CHRONYD, Message: "Failed to get " + topic + ": " + err.Error(), RequestID: s.requestID}
+		} else {
+			update.Data = section
+		}
+		s.send(update)
+	}
+}
+
+// runCommand checks the token and the permission of a command, runs it
+// and sends the result.
+func (s *wsSession) runCommand(req wsRequest) {
+	// The token was valid when the connection opened
+	if !jwt.MapClaims(s.claims).VerifyExpiresAt(time.Now().Unix(), false) {
+		s.sendError(req.ID, &APIError{Code: ERR_UNAUTHORIZED, Message: "Unauthorized: token has expired"})
+		return
+	}
+	perm := wsCommandPermissions[req.Type]
+	if permissionCheckEnabled && !hasPermission(s.claims, perm) {
+		s.sendError(req.ID, &APIError{
+			Code:    ERR_FORBIDDEN,
+			Message: "Forbidden: insufficient permissions",
+			Details: map[string]string{"permission": perm},
+		})
+		return
+	}
+	subject, _ := s.claims["sub"].(string)
+	change := configChange{
+		Subject: subject,
+		Action:  "WS " + req.Type,
+		Reason:  req.Reason,
+	}
+
+	var result interface{}
+	var apiErr *APIError
+	switch req.Type {
+	case "set_servers":
+		result, apiErr = s.app.wsSetServers(change, req.Data)
+	case "set_server_mode":
+		result, apiErr = s.app.wsSetServerMode(change, req.Data)
+	case "burst":
+		result, apiErr = s.app.wsBurst(change, req.Data)
+	}
+	if apiErr != nil {
+		if apiErr.Code == ERR_CONFIG || apiErr.Code == ERR_CHRONYD {
+			log.Printf("Request %s failed: %s", s.requestID, apiErr.Message)
+		}
+		s.sendError(req.ID, apiErr)
+		return
+	}
+	s.send(wsResponse{Type: "result", ID: req.ID, Data: result})
+}
+
+func (s *wsSession) send(v interface{}) {
+	// A failed write ends the session through the reader
+	s.conn.WriteJSON(v)
+}
+
+func (s *wsSession) sendError(id string, apiErr *APIError) {
+	apiErr.RequestID = s.requestID
+	s.send(wsResponse{Type: "error", ID: id, Error: apiErr})
+}
+
+// wsSetServers replaces the configured servers, like PUT /servers.
+func (a *App) wsSetServers(change configChange, data json.RawMessage) (interface{}, *APIError) {
+	var req SetServersRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, &APIError{Code: ERR_INVALID_JSON, Message: "Invalid JSON", Details: err.Error()}
+	}
+	if err := req.Validate(); err != nil {
+		return nil, &APIError{Code: ERR_INVALID_REQUEST, Message: err.Error(), Details: fieldDetails(err)}
+	}
+	restarted, restartSuccess, err := a.setServers(change, req.Servers)
+	if err != nil {
+		return nil, &APIError{Code: ERR_CONFIG, Message: "Failed to update chrony.conf: " + err.Error()}
+	}
+	a.refreshStatus()
+	response := map[string]interface{}{
+		"result":          req.Servers,
+		"restarted":       restarted,
+		"restart_success": restartSuccess,
+	}
+	if !restartSuccess {
+		return nil, &APIError{Code: ERR_CHRONYD, Message: "chronyd did not come up with the new chrony.conf", Details: response}
+	}
+	return response, nil
+}
+
+// wsSetServerMode changes server mode, like PUT /server-mode.
+func (a *App) wsSetServerMode(change configChange, data json.RawMessage) (interface{}, *APIError) {
+	var req SetServerModeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, &APIError{Code: ERR_INVALID_JSON, Message: "Invalid JSON", Details: err.Error()}
+	}
+	if err := req.Validate(); err != nil {
+		return nil, &APIError{Code: ERR_INVALID_REQUEST, Message: err.Error(), Details: fieldDetails(err)}
+	}
+	success, err := a.setServerModeStatus(change, req)
+	if err != nil {
+		return nil, &APIError{Code: ERR_CONFIG, Message: "Failed to update chrony.conf: " + err.Error()}
+	}
+	mode := a.collector.Refresh().ServerMode
+	response := SetServerModeResponse{
+		Success:           success,
+		ServerModeEnabled: mode.ServerModeEnabled,
+		Rules:             mode.Rules,
+		ServerHardening:   mode.ServerHardening,
+	}
+	if !success {
+		return nil, &APIError{Code: ERR_CHRONYD, Message: "chronyd did not come up with the new chrony.conf", Details: response}
+	}
+	return response, nil
+}
+
+// wsBurst runs the burst action, like POST /daemon/actions/burst. Its
+// parameters are optional.
+func (a *App) wsBurst(change configChange, data json.RawMessage) (interface{}, *APIError) {
+	var action DaemonAction
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &action); err != nil {
+			return nil, &APIError{Code: ERR_INVALID_JSON, Message: "Invalid JSON", Details: err.Error()}
+		}
+	}
+	action.Action = "burst"
+	if err := action.Validate(); err != nil {
+		return nil, &APIError{Code: ERR_INVALID_REQUEST, Message: err.Error()}
+	}
+	record, output, err := a.runDaemonAction(change, action)
+	if err != nil {
+		return nil, &APIError{
+			Code:    ERR_CHRONYD,
+			Message: "Failed to run burst: " + err.Error(),
+			Details: map[string]interface{}{"audit_id": record.ID},
+		}
+	}
+	return map[string]interface{}{
+		"action":   action.Action,
+		"output":   output,
+		"audit_id": record.ID,
+	}, nil
+}
+
+// WebSocket opcodes and close codes (RFC 6455)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsCloseTooBig          = 1009
+)
+
+// wsAcceptGUID is appended to the client's key to compute
+// Sec-WebSocket-Accept.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWSClosed = errors.New("websocket: connection closed")
+
+// wsConn is the server side of a WebSocket connection. One goroutine
+// reads; any may write.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// mu serializes writes; closed is set once a close frame is sent
+	mu     sync.Mutex
+	closed bool
+}
+
+// upgradeWebSocket completes the opening handshake of r and takes over
+// its connection, selecting protocol unless it is "". When it fails, it
+// has responded.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, protocol string) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "Expected a WebSocket upgrade request", nil)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, ERR_INVALID_REQUEST, "Unsupported WebSocket version", nil)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid Sec-WebSocket-Key", nil)
+		return nil, errors.New("websocket: invalid key")
+	}
+	id := w.Header().Get(requestIDHeader)
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// Only HTTP/1.x connections can be taken over
+		writeError(w, http.StatusHTTPVersionNotSupported, ERR_INVALID_REQUEST, "WebSocket requires HTTP/1.1", nil)
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"%s: %s\r\n", base64.StdEncoding.EncodeToString(sum[:]), requestIDHeader, id)
+	if protocol != "" {
+		// Browsers fail the connection unless one of the offered
+		// subprotocols is selected
+		fmt.Fprintf(brw, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text message, joining fragments. It
+// answers pings and closes itself. After the client closes, or breaks
+// the protocol, it returns an error and the connection is closing.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	inMessage := false
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText:
+			if inMessage {
+				return nil, c.fail(wsCloseProtocolError, "expected a continuation frame")
+			}
+			inMessage = true
+		case wsOpBinary:
+			return nil, c.fail(wsCloseUnsupportedData, "binary messages are not supported")
+		case wsOpContinuation:
+			if !inMessage {
+				return nil, c.fail(wsCloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return nil, c.fail(wsCloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if !utf8.Valid(message) {
+				return nil, c.fail(wsCloseInvalidPayload, "text message is not valid UTF-8")
+			}
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "client frames must be masked")
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+	}
+	if n > wsMaxMessageSize {
+		return false, 0, nil, c.fail(wsCloseTooBig, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection with code, and returns the error for reason.
+func (c *wsConn) fail(code int, reason string) error {
+	c.writeFrame(wsOpClose, closePayload(code, reason))
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+// writeFrame writes an unfragmented, unmasked frame. Nothing is written
+// after a close frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errWSClosed
+	}
+	if op == wsOpClose {
+		c.closed = true
+	}
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+// WriteJSON sends v as a text message.
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
+
+// Ping sends a ping, which the client answers with a pong.
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// Close sends a normal close, unless one was sent already, and closes the
+// connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, closePayload(wsCloseNormal, ""))
+	return c.conn.Close()
+}
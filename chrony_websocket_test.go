@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestKey and wsTestAccept are the handshake example of RFC 6455.
+const (
+	wsTestKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsTestAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// wsClient is a hand-rolled client, so that tests can send frames a
+// well-behaved client would not.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS sends an opening handshake with header to srv. The client is
+// nil unless the server switched protocols.
+func dialWS(t *testing.T, srv *httptest.Server, path string, header http.Header) (*wsClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", wsTestKey)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp
+	}
+	return &wsClient{t: t, conn: conn, br: br}, resp
+}
+
+func bearerHeader(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// openWS connects to a test server of app with token.
+func openWS(t *testing.T, app *App, token string) *wsClient {
+	t.Helper()
+	srv := httptest.NewServer(app.Handler())
+	t.Cleanup(srv.Close)
+	c, resp := dialWS(t, srv, "/ws", bearerHeader(token))
+	if c == nil {
+		t.Fatalf("handshake = %s", resp.Status)
+	}
+	return c
+}
+
+// wsFrameHeader returns the header of a client frame of n bytes, without
+// its mask.
+func wsFrameHeader(fin bool, op byte, n int, masked bool) []byte {
+	head := op
+	if fin {
+		head |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case n <= 125:
+		return []byte{head, maskBit | byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{head, maskBit | 126}, uint16(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{head, maskBit | 127}, uint64(n))
+	}
+}
+
+// write sends raw bytes. Tests of a bad frame send only as much of it as
+// the server reads: closing with unread data resets the connection, which
+// may discard the close frame before the client reads it.
+func (c *wsClient) write(b []byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// writeFrame sends a masked frame.
+func (c *wsClient) writeFrame(fin bool, op byte, payload []byte) {
+	c.t.Helper()
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := append(wsFrameHeader(fin, op, len(payload), true), mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.write(frame)
+}
+
+func (c *wsClient) writeText(message string) {
+	c.t.Helper()
+	c.writeFrame(true, wsOpText, []byte(message))
+}
+
+// readFrame reads a frame from the server, which must not mask it.
+func (c *wsClient) readFrame() (op byte, payload []byte) {
+	c.t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		c.t.Fatalf("reading a frame: %v", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		c.t.Fatalf("frame header %x: the server fragmented or masked it", head)
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatalf("reading a frame: %v", err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// readJSON decodes the next text message.
+func (c *wsClient) readJSON() map[string]interface{} {
+	c.t.Helper()
+	op, payload := c.readFrame()
+	if op != wsOpText {
+		c.t.Fatalf("got opcode %d %q, want a text message", op, payload)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+// readReply returns the next result or error, skipping updates, which a
+// collection may send at any time.
+func (c *wsClient) readReply() map[string]interface{} {
+	c.t.Helper()
+	for {
+		if v := c.readJSON(); v["type"] != "update" {
+			return v
+		}
+	}
+}
+
+// expectClose reads the close frame of the server, checks its code and
+// that the server then closes the connection.
+func (c *wsClient) expectClose(code int) {
+	c.t.Helper()
+	op, payload := c.readFrame()
+	if op != wsOpClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		c.t.Fatalf("got opcode %d %q, want a close with code %d", op, payload, code)
+	}
+	if n, err := c.br.ReadByte(); err != io.EOF {
+		c.t.Errorf("read %v, %v after the close frame; want EOF", n, err)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	app, _ := newTestApp(t)
+	srv := httptest.NewServer(app.Handler())
+	defer srv.Close()
+
+	c, resp := dialWS(t, srv, "/ws", bearerHeader(testToken(t)))
+	if c == nil {
+		t.Fatalf("handshake = %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsTestAccept || resp.Header.Get(requestIDHeader) == "" {
+		t.Errorf("handshake headers = %v", resp.Header)
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "" {
+		t.Errorf("selected a subprotocol the client did not offer: %v", resp.Header)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"no token", http.Header{}, http.StatusUnauthorized},
+		{"not an upgrade", http.Header{"Upgrade": {"h2c"}}, http.StatusBadRequest},
+		{"old version", http.Header{"Sec-WebSocket-Version": {"8"}}, http.StatusUpgradeRequired},
+		{"short key", http.Header{"Sec-WebSocket-Key": {"c2hvcnQ="}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		header := bearerHeader(testToken(t))
+		if tt.name == "no token" {
+			header = http.Header{}
+		}
+		for name, values := range tt.header {
+			header[name] = values
+		}
+		if c, resp := dialWS(t, srv, "/ws", header); c != nil || resp.StatusCode != tt.status {
+			t.Errorf("%s: handshake = %s, want %d", tt.name, resp.Status, tt.status)
+		} else if tt.status == http.StatusUpgradeRequired && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("%s: Sec-WebSocket-Version = %q", tt.name, resp.Header.Get("Sec-WebSocket-Version"))
+		}
+	}
+}
+
+func TestWebSocketToken(t *testing.T) {
+	app, _ := newTestApp(t)
+	srv := httptest.NewServer(app.Handler())
+	defer srv.Close()
+	token := testToken(t)
+
+	// Browsers offer the token as a subprotocol, which must be selected
+	c, resp := dialWS(t, srv, "/ws", http.Header{"Sec-Websocket-Protocol": {"bearer, " + token}})
+	if c == nil || resp.Header.Get("Sec-WebSocket-Protocol") != "bearer" {
+		t.Errorf("token as subprotocol: handshake = %s %v", resp.Status, resp.Header)
+	}
+
+	// but never in the URL, where access logs would keep it
+	if c, resp := dialWS(t, srv, "/ws?access_token="+token, nil); c != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token in the URL: handshake = %s, want 401", resp.Status)
+	}
+	if c, resp := dialWS(t, srv, "/ws", http.Header{"Sec-Websocket-Protocol": {"bearer, not-a-jwt"}}); c != nil ||
+		resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("invalid token as subprotocol: handshake = %s, want 401", resp.Status)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.wsOrigins = []string{"https://console.example.com"}
+	srv := httptest.NewServer(app.Handler())
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{srv.URL, true},
+		{"https://console.example.com", true},
+		{"https://CONSOLE.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://console.example.com.evil.example.com", false},
+		{"null", false},
+	} {
+		header := bearerHeader(testToken(t))
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		c, resp := dialWS(t, srv, "/ws", header)
+		if tt.allowed && c == nil {
+			t.Errorf("origin %q: handshake = %s, want 101", tt.origin, resp.Status)
+		}
+		if !tt.allowed && (c != nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: handshake = %s, want 403", tt.origin, resp.Status)
+		}
+	}
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	app, _ := newTestApp(t)
+	c := openWS(t, app, testToken(t))
+
+	c.writeText(`{"id": "1", "type": "subscribe", "topics": ["tracking"]}`)
+	result := c.readReply()
+	if result["type"] != "result" || result["id"] != "1" {
+		t.Fatalf("subscribe = %v", result)
+	}
+	if topics := result["data"].(map[string]interface{})["topics"].([]interface{}); len(topics) != 1 || topics[0] != "tracking" {
+		t.Errorf("subscribed topics = %v", topics)
+	}
+	update := c.readJSON()
+	data, _ := update["data"].(map[string]interface{})
+	if update["type"] != "update" || update["topic"] != "tracking" || data["reference_id"] != "CB00710A" {
+		t.Errorf("update = %v", update)
+	}
+
+	c.writeText(`{"id": "2", "type": "subscribe", "topics": ["weather"]}`)
+	if e := c.readReply(); e["type"] != "error" || e["id"] != "2" || errorCode(e) != ERR_INVALID_REQUEST {
+		t.Errorf("unknown topic = %v", e)
+	}
+	c.writeText(`{"id": "3", "type": "reboot"}`)
+	if e := c.readReply(); e["type"] != "error" || errorCode(e) != ERR_INVALID_REQUEST {
+		t.Errorf("unknown type = %v", e)
+	}
+	c.writeText(`{"id": `)
+	if e := c.readReply(); e["type"] != "error" || errorCode(e) != ERR_INVALID_JSON {
+		t.Errorf("invalid JSON = %v", e)
+	}
+}
+
+func TestWebSocketCommand(t *testing.T) {
+	app, backend := newTestApp(t)
+	c := openWS(t, app, testToken(t, "clock/daemon/online"))
+
+	c.writeText(`{"id": "1", "type": "burst"}`)
+	e := c.readReply()
+	details, _ := e["error"].(map[string]interface{})["details"].(map[string]interface{})
+	if errorCode(e) != ERR_FORBIDDEN || details["permission"] != "clock/daemon/burst" || len(backend.Actions) != 0 {
+		t.Errorf("burst without clock/daemon/burst = %v", e)
+	}
+
+	c = openWS(t, app, testToken(t, "clock/daemon/burst"))
+	c.writeText(`{"id": "2", "type": "burst", "reason": "check", "data": {"source": "203.0.113.10"}}`)
+	result := c.readReply()
+	data, _ := result["data"].(map[string]interface{})
+	if result["type"] != "result" || result["id"] != "2" || data["output"] != "200 OK" {
+		t.Fatalf("burst = %v", result)
+	}
+	if audit := app.audit.List(); len(audit) != 1 || audit[0].Subject != "tester" || audit[0].Reason != "check" {
+		t.Errorf("audit = %+v", audit)
+	}
+}
+
+func TestWebSocketFragmentsAndControlFrames(t *testing.T) {
+	app, _ := newTestApp(t)
+	c := openWS(t, app, testToken(t))
+
+	// A ping may come between the fragments of a message
+	message := `{"id": "1", "type": "subscribe", "topics": ["server-mode"]}`
+	c.writeFrame(false, wsOpText, []byte(message[:10]))
+	c.writeFrame(false, wsOpContinuation, []byte(message[10:30]))
+	c.writeFrame(true, wsOpPing, []byte("are you there"))
+	c.writeFrame(true, wsOpContinuation, []byte(message[30:]))
+
+	if op, payload := c.readFrame(); op != wsOpPong || string(payload) != "are you there" {
+		t.Errorf("got opcode %d %q, want the pong", op, payload)
+	}
+	if result := c.readReply(); result["type"] != "result" || result["id"] != "1" {
+		t.Errorf("fragmented subscribe = %v", result)
+	}
+	if update := c.readJSON(); update["topic"] != "server-mode" {
+		t.Errorf("update = %v", update)
+	}
+
+	// Unsolicited pongs are ignored
+	c.writeFrame(true, wsOpPong, nil)
+	c.writeText(`{"id": "2", "type": "unsubscribe", "topics": ["server-mode"]}`)
+	if result := c.readReply(); result["id"] != "2" {
+		t.Errorf("unsubscribe = %v", result)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	app, _ := newTestApp(t)
+	c := openWS(t, app, testToken(t))
+
+	c.writeFrame(true, wsOpClose, closePayload(wsCloseNormal, "bye"))
+	op, payload := c.readFrame()
+	if op != wsOpClose || string(payload) != string(closePayload(wsCloseNormal, "")) {
+		t.Errorf("got opcode %d %q, want the close code echoed", op, payload)
+	}
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after the close handshake: %v", err)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *wsClient)
+		code int
+	}{
+		{"unmasked frame", func(c *wsClient) {
+			c.write(wsFrameHeader(true, wsOpText, 2, false))
+		}, wsCloseProtocolError},
+		{"reserved bits", func(c *wsClient) {
+			c.write(wsFrameHeader(true, wsOpText|0x40, 2, true))
+		}, wsCloseProtocolError},
+		{"unknown opcode", func(c *wsClient) {
+			c.writeFrame(true, 0x3, nil)
+		}, wsCloseProtocolError},
+		{"binary message", func(c *wsClient) {
+			c.writeFrame(true, wsOpBinary, []byte{0, 1})
+		}, wsCloseUnsupportedData},
+		{"invalid UTF-8", func(c *wsClient) {
+			c.writeFrame(true, wsOpText, []byte{'"', 0xff, '"'})
+		}, wsCloseInvalidPayload},
+		{"continuation without a message", func(c *wsClient) {
+			c.writeFrame(true, wsOpContinuation, []byte(`{}`))
+		}, wsCloseProtocolError},
+		{"new message before the last one ended", func(c *wsClient) {
+			c.writeFrame(false, wsOpText, []byte(`{`))
+			c.writeFrame(true, wsOpText, []byte(`{}`))
+		}, wsCloseProtocolError},
+		{"fragmented ping", func(c *wsClient) {
+			c.write(wsFrameHeader(false, wsOpPing, 0, true))
+		}, wsCloseProtocolError},
+		{"long ping", func(c *wsClient) {
+			c.write(wsFrameHeader(true, wsOpPing, 126, true))
+		}, wsCloseProtocolError},
+		{"oversized frame", func(c *wsClient) {
+			c.write(wsFrameHeader(true, wsOpText, wsMaxMessageSize+1, true))
+		}, wsCloseTooBig},
+		{"oversized length", func(c *wsClient) {
+			c.write(wsFrameHeader(true, wsOpText, 1<<40, true))
+		}, wsCloseTooBig},
+		{"oversized message", func(c *wsClient) {
+			fragment := []byte(strings.Repeat(" ", wsMaxMessageSize/2+1))
+			c.writeFrame(false, wsOpText, fragment)
+			c.writeFrame(true, wsOpContinuation, fragment)
+		}, wsCloseTooBig},
+	}
+	app, _ := newTestApp(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := openWS(t, app, testToken(t))
+			tt.send(c)
+			c.expectClose(tt.code)
+		})
+	}
+}
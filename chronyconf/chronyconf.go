@@ -0,0 +1,318 @@
+// Package chronyconf parses and edits chrony.conf.
+//
+// A File is the sequence of lines of the configuration: directives, full
+// line comments and blank lines. Lines that are not modified are written
+// back exactly as they were read, so Parse followed by Bytes returns the
+// input byte for byte, and an edit only touches the lines it changes.
+//
+// chronyd treats a line whose first non-blank character is one of
+// "!;#%" as a comment; there are no trailing comments.
+package chronyconf
+
+import (
+	"strings"
+)
+
+// commentChars start a comment line.
+const commentChars = "!;#%"
+
+// Directive is one configuration directive: its name and the
+// whitespace-separated arguments that follow it.
+type Directive struct {
+	Name string
+	Args []string
+}
+
+// NewDirective returns a directive with the given name and arguments.
+func NewDirective(name string, args ...string) *Directive {
+	return &Directive{Name: name, Args: args}
+}
+
+// String renders the directive the way it is written to a new line.
+func (d *Directive) String() string {
+	return strings.Join(append([]string{d.Name}, d.Args...), " ")
+}
+
+// parseDirective splits a non-comment line into a directive, or returns
+// nil for a blank line.
+func parseDirective(text string) *Directive {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil
+	}
+	return &Directive{Name: strings.ToLower(fields[0]), Args: fields[1:]}
+}
+
+// Line is one line of the file: a directive, a comment or a blank line.
+// Comment holds the text after the comment character of a comment line.
+type Line struct {
+	Directive *Directive
+	Comment   string
+
+	comment     bool
+	commentChar byte
+	indent      string
+	cr          bool
+
+	// raw is the line as read and orig its key at that point; new lines
+	// have fresh set and are always rendered.
+	raw   string
+	orig  string
+	fresh bool
+}
+
+// IsComment reports whether the line is a comment.
+func (l *Line) IsComment() bool {
+	return l.comment
+}
+
+// CommentedDirective parses the text of a comment line as a directive,
+// so that "#allow 0.0.0.0/0" yields allow with argument 0.0.0.0/0. It
+// returns nil for other lines.
+func (l *Line) CommentedDirective() *Directive {
+	if !l.comment {
+		return nil
+	}
+	return parseDirective(l.Comment)
+}
+
+// key identifies the content of the line, to detect modifications.
+func (l *Line) key() string {
+	switch {
+	case l.Directive != nil:
+		return "d " + l.Directive.String()
+	case l.comment:
+		return "c " + l.Comment
+	}
+	return ""
+}
+
+func (l *Line) render() string {
+	if !l.fresh && l.key() == l.orig {
+		return l.raw
+	}
+	s := l.indent
+	switch {
+	case l.Directive != nil:
+		s += l.Directive.String()
+	case l.comment:
+		s += string(l.commentChar) + l.Comment
+	}
+	if l.cr {
+		s += "\r"
+	}
+	return s
+}
+
+func parseLine(raw string) *Line {
+	l := &Line{raw: raw}
+	text := raw
+	if strings.HasSuffix(text, "\r") {
+		l.cr = true
+		text = text[:len(text)-1]
+	}
+	trimmed := strings.TrimLeft(text, " \t")
+	l.indent = text[:len(text)-len(trimmed)]
+	if trimmed != "" && strings.IndexByte(commentChars, trimmed[0]) >= 0 {
+		l.comment = true
+		l.commentChar = trimmed[0]
+		l.Comment = trimmed[1:]
+	} else {
+		l.Directive = parseDirective(text)
+	}
+	l.orig = l.key()
+	return l
+}
+
+// File is a parsed chrony.conf.
+type File struct {
+	Lines []*Line
+
+	finalNewline bool
+}
+
+// Parse parses the contents of a chrony.conf. It does not validate
+// directive names or arguments, so every input can be parsed.
+func Parse(data []byte) *File {
+	f := &File{}
+	content := string(data)
+	if content == "" {
+		return f
+	}
+	if strings.HasSuffix(content, "\n") {
+		f.finalNewline = true
+		content = content[:len(content)-1]
+	}
+	for _, raw := range strings.Split(content, "\n") {
+		f.Lines = append(f.Lines, parseLine(raw))
+	}
+	return f
+}
+
+// Bytes renders the file. Unmodified lines are reproduced exactly;
+// modified and new lines are written with single spaces between fields.
+func (f *File) Bytes() []byte {
+	var b strings.Builder
+	for i, l := range f.Lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(l.render())
+	}
+	if f.finalNewline && len(f.Lines) > 0 {
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// Directives returns the directives named by names (all directives if
+// names is empty) in file order.
+func (f *File) Directives(names ...string) []*Directive {
+	var result []*Directive
+	for _, l := range f.Lines {
+		if l.Directive != nil && matchName(l.Directive.Name, names) {
+			result = append(result, l.Directive)
+		}
+	}
+	return result
+}
+
+// CommentedOut returns the comment lines that hold a directive named by
+// names, such as "#allow 0.0.0.0/0".
+func (f *File) CommentedOut(names ...string) []*Line {
+	var result []*Line
+	for _, l := range f.Lines {
+		if d := l.CommentedDirective(); d != nil && matchName(d.Name, names) {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+func matchName(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *File) index(d *Directive) int {
+	for i, l := range f.Lines {
+		if l.Directive == d {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *File) lineIndex(line *Line) int {
+	for i, l := range f.Lines {
+		if l == line {
+			return i
+		}
+	}
+	return -1
+}
+
+func newLine(d *Directive) *Line {
+	return &Line{Directive: d, fresh: true}
+}
+
+// Append adds d on a new line at the end of the file.
+func (f *File) Append(d *Directive) {
+	f.finalNewline = true
+	f.Lines = append(f.Lines, newLine(d))
+}
+
+// InsertAfter adds d on a new line after ref, or at the end of the file
+// if ref is not in it.
+func (f *File) InsertAfter(ref, d *Directive) {
+	i := f.index(ref)
+	if i < 0 {
+		f.Append(d)
+		return
+	}
+	f.insertAt(i+1, newLine(d))
+}
+
+// InsertBefore adds d on a new line before ref, or at the end of the
+// file if ref is not in it.
+func (f *File) InsertBefore(ref, d *Directive) {
+	i := f.index(ref)
+	if i < 0 {
+		f.Append(d)
+		return
+	}
+	f.insertAt(i, newLine(d))
+}
+
+func (f *File) insertAt(i int, l *Line) {
+	f.Lines = append(f.Lines, nil)
+	copy(f.Lines[i+1:], f.Lines[i:])
+	f.Lines[i] = l
+}
+
+// Remove deletes the line holding d. It reports whether d was found.
+func (f *File) Remove(d *Directive) bool {
+	i := f.index(d)
+	if i < 0 {
+		return false
+	}
+	f.Lines = append(f.Lines[:i], f.Lines[i+1:]...)
+	return true
+}
+
+// CommentOut turns the line holding d into a comment, keeping its text:
+// "allow 0.0.0.0/0" becomes "#allow 0.0.0.0/0". It reports whether d was
+// found.
+func (f *File) CommentOut(d *Directive) bool {
+	i := f.index(d)
+	if i < 0 {
+		return false
+	}
+	l := f.Lines[i]
+	f.Lines[i] = &Line{
+		Comment:     d.String(),
+		comment:     true,
+		commentChar: '#',
+		indent:      l.indent,
+		cr:          l.cr,
+		fresh:       true,
+	}
+	return true
+}
+
+// Uncomment turns a comment line returned by CommentedOut back into a
+// directive and returns it, or returns nil if line is not such a line.
+func (f *File) Uncomment(line *Line) *Directive {
+	i := f.lineIndex(line)
+	d := line.CommentedDirective()
+	if i < 0 || d == nil {
+		return nil
+	}
+	f.Lines[i] = &Line{Directive: d, indent: line.indent, cr: line.cr, fresh: true}
+	return d
+}
+
+// Replace puts ds where the first directive named by names is, or at the
+// end of the file if there is none, and removes every directive named by
+// names. It returns the removed directives.
+func (f *File) Replace(ds []*Directive, names ...string) []*Directive {
+	existing := f.Directives(names...)
+	for _, d := range ds {
+		if len(existing) > 0 {
+			f.InsertBefore(existing[0], d)
+		} else {
+			f.Append(d)
+		}
+	}
+	for _, d := range existing {
+		f.Remove(d)
+	}
+	return existing
+}
@@ -0,0 +1,122 @@
+package chronyconf
+
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"\n",
+		"\n\n\n",
+		"server time.example.com iburst\n",
+		"server time.example.com iburst\r\nallow all\r\n",
+		"server a\r\n\r\n#comment\r\n",
+		"  server a    iburst\n\tpool  b\t maxsources 4\n",
+		"server a\nallow 192.0.2.0/24",
+		"server a\r",
+		"!bang\n;semicolon\n#hash\n%percent\n",
+		"  # indented comment\n\t!tab\n#\n",
+		"#server commented.example.com iburst\n",
+		"SERVER UPPER.example.com\n",
+		"   \n\t\n",
+	} {
+		if got := string(Parse([]byte(in)).Bytes()); got != in {
+			t.Errorf("Parse(%q).Bytes() = %q", in, got)
+		}
+	}
+}
+
+func TestCommentCharacters(t *testing.T) {
+	f := Parse([]byte("!a\n;b\n#c\n%d\n  #e\nserver x #not a comment\n"))
+	for i, want := range []string{"a", "b", "c", "d", "e"} {
+		if l := f.Lines[i]; !l.IsComment() || l.Comment != want {
+			t.Errorf("line %d = %+v, want comment %q", i+1, l, want)
+		}
+	}
+	if d := f.Lines[5].Directive; d == nil || d.Name != "server" || len(d.Args) != 4 {
+		t.Errorf("line 6 = %+v, want a server directive; there are no trailing comments", f.Lines[5])
+	}
+}
+
+// The edits below must leave every other line byte for byte as it was.
+const editInput = "# chrony.conf\r\n" +
+	"  server  a.example.com   iburst\r\n" +
+	"\r\n" +
+	"pool\tpool.example.com maxsources 2\r\n" +
+	";allow 192.0.2.0/24\r\n" +
+	"allow   all\r\n" +
+	"server b.example.com\r\n" +
+	"driftfile /var/lib/chrony/drift"
+
+func TestReplace(t *testing.T) {
+	f := Parse([]byte(editInput))
+	removed := f.Replace([]*Directive{NewDirective("server", "c.example.com", "iburst")}, "server")
+	if len(removed) != 2 {
+		t.Errorf("removed %v, want the two servers", removed)
+	}
+	want := "# chrony.conf\r\n" +
+		"server c.example.com iburst\n" +
+		"\r\n" +
+		"pool\tpool.example.com maxsources 2\r\n" +
+		";allow 192.0.2.0/24\r\n" +
+		"allow   all\r\n" +
+		"driftfile /var/lib/chrony/drift"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("after Replace:\n%q\nwant\n%q", got, want)
+	}
+
+	// Without a directive to replace, the new ones are appended
+	f = Parse([]byte(editInput))
+	f.Replace([]*Directive{NewDirective("ratelimit", "interval", "1")}, "ratelimit")
+	if got := string(f.Bytes()); got != editInput+"\nratelimit interval 1\n" {
+		t.Errorf("after Replace of a missing directive:\n%q", got)
+	}
+}
+
+func TestCommentOutAndUncomment(t *testing.T) {
+	f := Parse([]byte(editInput))
+	if !f.CommentOut(f.Directives("allow")[0]) {
+		t.Fatal("CommentOut did not find allow")
+	}
+	commented := f.CommentedOut("allow")
+	if len(commented) != 2 {
+		t.Fatalf("commented out allow lines = %d, want 2", len(commented))
+	}
+	if d := f.Uncomment(commented[0]); d == nil || d.String() != "allow 192.0.2.0/24" {
+		t.Fatalf("Uncomment = %v", d)
+	}
+	want := "# chrony.conf\r\n" +
+		"  server  a.example.com   iburst\r\n" +
+		"\r\n" +
+		"pool\tpool.example.com maxsources 2\r\n" +
+		"allow 192.0.2.0/24\r\n" +
+		"#allow all\r\n" +
+		"server b.example.com\r\n" +
+		"driftfile /var/lib/chrony/drift"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("after CommentOut and Uncomment:\n%q\nwant\n%q", got, want)
+	}
+
+	if f.Uncomment(f.Lines[1]) != nil {
+		t.Error("uncommented a line that is not a comment")
+	}
+	if f.CommentOut(NewDirective("allow", "all")) {
+		t.Error("commented out a directive that is not in the file")
+	}
+}
+
+func TestModifiedDirectiveIsRerendered(t *testing.T) {
+	f := Parse([]byte(editInput))
+	pool := f.Directives("pool")[0]
+	pool.Args[len(pool.Args)-1] = "4"
+	want := "# chrony.conf\r\n" +
+		"  server  a.example.com   iburst\r\n" +
+		"\r\n" +
+		"pool pool.example.com maxsources 4\r\n" +
+		";allow 192.0.2.0/24\r\n" +
+		"allow   all\r\n" +
+		"server b.example.com\r\n" +
+		"driftfile /var/lib/chrony/drift"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("after editing pool:\n%q\nwant\n%q", got, want)
+	}
+}
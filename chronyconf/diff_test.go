@@ -0,0 +1,58 @@
+package chronyconf
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"nearby hunks are merged",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\nTWO\n3\n4\n5\n6\n7\nEIGHT\n9\n",
+			"--- old\n+++ new\n" +
+				"@@ -1,9 +1,9 @@\n" +
+				" 1\n-2\n+TWO\n 3\n 4\n 5\n 6\n 7\n-8\n+EIGHT\n 9\n",
+		},
+		{
+			"distant hunks are not",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"ONE\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\nTWELVE\n",
+			"--- old\n+++ new\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+ONE\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+TWELVE\n",
+		},
+		{
+			"insertion into an empty file",
+			"",
+			"server a\n",
+			"--- old\n+++ new\n@@ -0,0 +1 @@\n+server a\n",
+		},
+		{
+			"old file without a final newline",
+			"server a\nallow all",
+			"server a\nallow all\n",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n server a\n-allow all\n\\ No newline at end of file\n+allow all\n",
+		},
+		{
+			"new file without a final newline",
+			"server a\nallow all\n",
+			"server b\nallow all",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n-server a\n-allow all\n+server b\n+allow all\n\\ No newline at end of file\n",
+		},
+		{
+			"neither file has a final newline",
+			"server a\nallow all",
+			"server b\nallow all",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n-server a\n+server b\n allow all\n\\ No newline at end of file\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := UnifiedDiff("old", "new", []byte(tt.old), []byte(tt.new)); got != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
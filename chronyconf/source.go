@@ -0,0 +1,94 @@
+package chronyconf
+
+// Source directives name an NTP time source.
+var SourceDirectives = []string{"server", "pool", "peer"}
+
+// Source options that take a value, e.g. "minpoll 6". Every other option
+// is a flag such as iburst.
+var valueOptions = map[string]bool{
+	"asymmetry":        true,
+	"certset":          true,
+	"extfield":         true,
+	"filter":           true,
+	"key":              true,
+	"maxdelay":         true,
+	"maxdelaydevratio": true,
+	"maxdelayquant":    true,
+	"maxdelayratio":    true,
+	"maxpoll":          true,
+	"maxsamples":       true,
+	"maxsources":       true,
+	"mindelay":         true,
+	"minpoll":          true,
+	"minsamples":       true,
+	"minstratum":       true,
+	"ntsport":          true,
+	"offset":           true,
+	"polltarget":       true,
+	"port":             true,
+	"presend":          true,
+	"version":          true,
+}
+
+// TakesValue reports whether the source option name is followed by a
+// value.
+func TakesValue(name string) bool {
+	return valueOptions[name]
+}
+
+// Option is a source option: a flag like iburst, or a keyword with a
+// value like "minpoll 6".
+type Option struct {
+	Name  string
+	Value string
+}
+
+// IsSource reports whether d is a server, pool or peer directive.
+func (d *Directive) IsSource() bool {
+	return matchName(d.Name, SourceDirectives)
+}
+
+// Host returns the address or hostname of a source directive.
+func (d *Directive) Host() string {
+	if len(d.Args) == 0 {
+		return ""
+	}
+	return d.Args[0]
+}
+
+// Options parses the options of a source directive, the arguments after
+// the host.
+func (d *Directive) Options() []Option {
+	if len(d.Args) < 2 {
+		return nil
+	}
+	var opts []Option
+	args := d.Args[1:]
+	for i := 0; i < len(args); i++ {
+		opt := Option{Name: args[i]}
+		if TakesValue(opt.Name) && i+1 < len(args) {
+			i++
+			opt.Value = args[i]
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// NewSource returns a source directive of kind ("server", "pool" or
+// "peer") for host with opts.
+func NewSource(kind, host string, opts []Option) *Directive {
+	args := []string{host}
+	for _, opt := range opts {
+		args = append(args, opt.Name)
+		if opt.Value != "" {
+			args = append(args, opt.Value)
+		}
+	}
+	return NewDirective(kind, args...)
+}
+
+// Sources returns the server, pool and peer directives in file order.
+func (f *File) Sources() []*Directive {
+	return f.Directives(SourceDirectives...)
+}
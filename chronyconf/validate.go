@@ -0,0 +1,179 @@
+package chronyconf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// knownDirectives are the directives chronyd 4.x accepts; it refuses to
+// start on any other. Obsolete directives that chronyd still accepts and
+// ignores (commandkey, dumponexit, generatecommandkey, linux_freq_scale,
+// linux_hz) are included so that older files keep validating.
+var knownDirectives = map[string]bool{
+	"acquisitionport": true, "allow": true, "authselectmode": true,
+	"bindacqaddress": true, "bindacqdevice": true, "bindaddress": true,
+	"bindcmdaddress": true, "bindcmddevice": true, "binddevice": true,
+	"broadcast": true, "clientloglimit": true, "clockprecision": true,
+	"cmdallow": true, "cmddeny": true, "cmdport": true,
+	"cmdratelimit": true, "combinelimit": true, "commandkey": true,
+	"confdir": true, "corrtimeratio": true, "deny": true, "dscp": true,
+	"driftfile": true, "dumpdir": true, "dumponexit": true,
+	"fallbackdrift": true, "generatecommandkey": true,
+	"hwclockfile": true, "hwtimestamp": true, "hwtsinterval": true,
+	"hwtstimeout": true, "include": true, "initstepslew": true,
+	"keyfile": true, "leapseclist": true, "leapsecmode": true,
+	"leapsectz": true, "linux_freq_scale": true, "linux_hz": true,
+	"local": true, "lock_all": true, "log": true, "logbanner": true,
+	"logchange": true, "logdir": true, "mailonchange": true,
+	"makestep": true, "manual": true, "maxchange": true,
+	"maxclockerror": true, "maxdistance": true, "maxdrift": true,
+	"maxjitter": true, "maxntsconnections": true, "maxsamples": true,
+	"maxslewrate": true, "maxupdateskew": true, "minsamples": true,
+	"minsources": true, "nocerttimecheck": true, "noclientlog": true,
+	"nosystemcert": true, "ntpsigndsocket": true, "ntsaeads": true,
+	"ntscachedir": true, "ntsdumpdir": true, "ntsntpserver": true,
+	"ntsport": true, "ntsprocesses": true, "ntsratelimit": true,
+	"ntsrefresh": true, "ntsrotate": true, "ntsservercert": true,
+	"ntsserverkey": true, "ntstrustedcerts": true, "opencommands": true,
+	"peer": true, "pidfile": true, "pool": true, "port": true,
+	"ptpdomain": true, "ptpport": true, "ratelimit": true,
+	"refclock": true, "refresh": true, "reselectdist": true,
+	"rtcautotrim": true, "rtcdevice": true, "rtcfile": true,
+	"rtconutc": true, "rtcsync": true, "sched_priority": true,
+	"server": true, "smoothtime": true, "sourcedir": true,
+	"stratumweight": true, "tempcomp": true, "user": true,
+}
+
+// Source options that are flags, not followed by a value.
+var flagOptions = map[string]bool{
+	"auto_offline": true,
+	"burst":        true,
+	"copy":         true,
+	"iburst":       true,
+	"noselect":     true,
+	"nts":          true,
+	"offline":      true,
+	"prefer":       true,
+	"require":      true,
+	"trust":        true,
+	"xleave":       true,
+}
+
+// integerDirectives take a single integer argument.
+var integerDirectives = map[string]bool{
+	"acquisitionport": true,
+	"clientloglimit":  true,
+	"cmdport":         true,
+	"maxsamples":      true,
+	"minsamples":      true,
+	"minsources":      true,
+	"ntsport":         true,
+	"port":            true,
+	"ptpport":         true,
+}
+
+// accessDirectives take an optional "all" and an optional subnet.
+var accessDirectives = map[string]bool{
+	"allow":    true,
+	"deny":     true,
+	"cmdallow": true,
+	"cmddeny":  true,
+}
+
+var hostnameRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+// ValidationError is a problem Validate found on a line of the file.
+type ValidationError struct {
+	// Line is the 1-based line number.
+	Line int
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Validate checks the directives of f the way chronyd would parse them:
+// that every directive is known, and the arguments of the source, access
+// and integer directives. Other arguments, such as file paths, are not
+// checked.
+func (f *File) Validate() []*ValidationError {
+	var errs []*ValidationError
+	for i, l := range f.Lines {
+		if l.Directive == nil {
+			continue
+		}
+		if err := validateDirective(l.Directive); err != nil {
+			errs = append(errs, &ValidationError{Line: i + 1, Msg: err.Error()})
+		}
+	}
+	return errs
+}
+
+func validateDirective(d *Directive) error {
+	switch {
+	case !knownDirectives[d.Name]:
+		return fmt.Errorf("unknown directive %q", d.Name)
+	case d.IsSource():
+		return validateSource(d)
+	case accessDirectives[d.Name]:
+		return validateAccess(d)
+	case integerDirectives[d.Name]:
+		if len(d.Args) != 1 {
+			return fmt.Errorf("%s takes one argument", d.Name)
+		}
+		if _, err := strconv.Atoi(d.Args[0]); err != nil {
+			return fmt.Errorf("%s: invalid number %q", d.Name, d.Args[0])
+		}
+	}
+	return nil
+}
+
+func validateSource(d *Directive) error {
+	if d.Host() == "" {
+		return fmt.Errorf("%s: missing host", d.Name)
+	}
+	if net.ParseIP(d.Host()) == nil && !hostnameRegex.MatchString(d.Host()) {
+		return fmt.Errorf("%s: invalid host %q", d.Name, d.Host())
+	}
+	for _, opt := range d.Options() {
+		switch {
+		case flagOptions[opt.Name]:
+		case !TakesValue(opt.Name):
+			return fmt.Errorf("%s %s: unknown option %q", d.Name, d.Host(), opt.Name)
+		case opt.Value == "":
+			return fmt.Errorf("%s %s: option %s needs a value", d.Name, d.Host(), opt.Name)
+		case opt.Name == "extfield":
+			if _, err := strconv.ParseUint(opt.Value, 16, 32); err != nil {
+				return fmt.Errorf("%s %s: invalid extfield %q", d.Name, d.Host(), opt.Value)
+			}
+		default:
+			if _, err := strconv.ParseFloat(opt.Value, 64); err != nil {
+				return fmt.Errorf("%s %s: invalid %s %q", d.Name, d.Host(), opt.Name, opt.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func validateAccess(d *Directive) error {
+	args := d.Args
+	if len(args) > 0 && args[0] == "all" {
+		args = args[1:]
+	}
+	switch {
+	case len(args) == 0:
+		return nil
+	case len(args) > 1:
+		return fmt.Errorf("%s: too many arguments", d.Name)
+	}
+	if _, _, err := net.ParseCIDR(args[0]); err == nil {
+		return nil
+	}
+	if net.ParseIP(args[0]) != nil || hostnameRegex.MatchString(args[0]) {
+		return nil
+	}
+	return fmt.Errorf("%s: invalid subnet %q", d.Name, args[0])
+}
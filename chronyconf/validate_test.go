@@ -0,0 +1,37 @@
+package chronyconf
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	valid := []string{
+		"server time.example.com iburst maxdelayquant 0.2 maxdelaydevratio 5",
+		"pool pool.ntp.org iburst maxsources 4",
+		"nosystemcert",
+		"opencommands activity sources tracking",
+		"dumponexit",
+		"linux_hz 100",
+		"linux_freq_scale 0.99",
+		"hwtstimeout 0.01",
+		"allow all 192.0.2.0/24",
+		"port 123",
+	}
+	for _, line := range valid {
+		if errs := Parse([]byte(line + "\n")).Validate(); len(errs) != 0 {
+			t.Errorf("%q: %v", line, errs[0])
+		}
+	}
+
+	invalid := []string{
+		"srever time.example.com",
+		"server time.example.com maxdelayquant",
+		"server time.example.com maxdelayquant fast",
+		"server time.example.com burstiness 3",
+		"allow 192.0.2.0/33",
+		"port http",
+	}
+	for _, line := range invalid {
+		if errs := Parse([]byte(line + "\n")).Validate(); len(errs) != 1 || errs[0].Line != 1 {
+			t.Errorf("%q: got %v, want one error on line 1", line, errs)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package cmdmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultSocketPath is where chronyd listens for commands locally.
+	DefaultSocketPath = "/var/run/chrony/chronyd.sock"
+	// DefaultUDPAddress is chronyd's command port on the loopback address.
+	DefaultUDPAddress = "127.0.0.1:323"
+
+	defaultTimeout = time.Second
+	defaultRetries = 2
+)
+
+var ErrTimeout = errors.New("cmdmon: no reply from chronyd")
+
+var localSocketCounter uint32
+
+// Client sends cmdmon requests to chronyd. It is safe for concurrent use;
+// requests are serialised on the underlying socket.
+//
+// Monitoring requests (tracking, sources, sourcestats, activity) are
+// accepted on both transports. chronyd only accepts client access queries
+// and anything that changes its state on the Unix socket.
+type Client struct {
+	// Timeout is how long to wait for a reply before retransmitting.
+	Timeout time.Duration
+	// Retries is how many times an unanswered request is retransmitted.
+	Retries int
+
+	mu        sync.Mutex
+	conn      net.Conn
+	localPath string
+	seq       uint32
+	buf       []byte
+}
+
+// Dial connects to chronyd. network is "unix" for the command socket at
+// address (for example DefaultSocketPath) or "udp" for a host:port such
+// as DefaultUDPAddress.
+func Dial(network, address string) (*Client, error) {
+	c := &Client{
+		Timeout: defaultTimeout,
+		Retries: defaultRetries,
+		seq:     rand.Uint32(),
+		buf:     make([]byte, 1500),
+	}
+	switch network {
+	case "unix", "unixgram":
+		// chronyd replies to the sender's address, so the client socket
+		// must be bound. Like chronyc, bind next to the server socket.
+		n := atomic.AddUint32(&localSocketCounter, 1)
+		c.localPath = filepath.Join(filepath.Dir(address),
+			fmt.Sprintf("brick-clock.%d.%d.sock", os.Getpid(), n))
+		os.Remove(c.localPath)
+		laddr := &net.UnixAddr{Name: c.localPath, Net: "unixgram"}
+		raddr := &net.UnixAddr{Name: address, Net: "unixgram"}
+		conn, err := net.DialUnix("unixgram", laddr, raddr)
+		if err != nil {
+			os.Remove(c.localPath)
+			return nil, err
+		}
+		c.conn = conn
+	case "udp", "udp4", "udp6":
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	default:
+		return nil, fmt.Errorf("cmdmon: unsupported network %q", network)
+	}
+	return c, nil
+}
+
+// Close closes the connection and removes the client's socket file.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	if c.localPath != "" {
+		os.Remove(c.localPath)
+	}
+	return err
+}
+
+// Do sends a request and waits for the matching reply, retransmitting on
+// timeout. A reply with a non-success status is returned as a
+// *StatusError; a reply of a different type than want as
+// ErrUnexpectedReply.
+func (c *Client) Do(command uint16, data []byte, want uint16) (*Reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	req := &Request{Command: command, Sequence: c.seq, Data: data}
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		req.Attempt = uint16(attempt)
+		pkt, err := req.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.conn.Write(pkt); err != nil {
+			return nil, err
+		}
+		reply, err := c.readReply(req)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if reply.Status != StatusSuccess {
+			return nil, &StatusError{Command: command, Status: reply.Status}
+		}
+		if reply.Reply != want {
+			return nil, ErrUnexpectedReply
+		}
+		return reply, nil
+	}
+	return nil, ErrTimeout
+}
+
+// readReply reads until a reply to req arrives or the timeout expires.
+// Stale replies to earlier attempts of other requests are discarded.
+func (c *Client) readReply(req *Request) (*Reply, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return nil, err
+		}
+		var reply Reply
+		if err := reply.UnmarshalBinary(c.buf[:n]); err != nil {
+			continue
+		}
+		if reply.Sequence != req.Sequence || reply.Command != req.Command {
+			continue
+		}
+		reply.Data = append([]byte(nil), reply.Data...)
+		return &reply, nil
+	}
+}
+
+// Ping sends a null request, which chronyd answers as soon as it is
+// accepting commands.
+func (c *Client) Ping() error {
+	_, err := c.Do(ReqNull, nil, RpyNull)
+	return err
+}
+
+// Tracking returns the system clock tracking report.
+func (c *Client) Tracking() (*Tracking, error) {
+	reply, err := c.Do(ReqTracking, nil, RpyTracking)
+	if err != nil {
+		return nil, err
+	}
+	var t Tracking
+	if err := t.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// NumSources returns the number of sources chronyd knows about.
+func (c *Client) NumSources() (int, error) {
+	reply, err := c.Do(ReqNSources, nil, RpyNSources)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply.Data) < nSourcesLen {
+		return 0, ErrShortPacket
+	}
+	return int(binary.BigEndian.Uint32(reply.Data)), nil
+}
+
+// SourceDataAt returns the source report for the source at index.
+func (c *Client) SourceDataAt(index int) (*SourceData, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(index))
+	reply, err := c.Do(ReqSourceData, data, RpySourceData)
+	if err != nil {
+		return nil, err
+	}
+	var s SourceData
+	if err := s.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SourceStatsAt returns the statistics for the source at index.
+func (c *Client) SourceStatsAt(index int) (*SourceStats, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(index))
+	reply, err := c.Do(ReqSourcestats, data, RpySourcestats)
+	if err != nil {
+		return nil, err
+	}
+	var s SourceStats
+	if err := s.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SourceName returns the name a source was configured with, e.g. the
+// hostname from a server directive.
+func (c *Client) SourceName(ip net.IP) (string, error) {
+	data := make([]byte, ipAddrLen)
+	EncodeIPAddr(data, ip)
+	reply, err := c.Do(ReqNTPSourceName, data, RpyNTPSourceName)
+	if err != nil {
+		return "", err
+	}
+	if len(reply.Data) < sourceNameLen {
+		return "", ErrShortPacket
+	}
+	return decodeName(reply.Data[:sourceNameLen]), nil
+}
+
+// sourceName resolves a display name for a source: the configured name
+// for NTP sources, the reference ID for reference clocks.
+func (c *Client) sourceName(ip net.IP, mode uint16) string {
+	if mode == SourceModeRefclock {
+		if ip4 := ip.To4(); ip4 != nil {
+			return refIDString(binary.BigEndian.Uint32(ip4))
+		}
+		return ""
+	}
+	if ip == nil {
+		return ""
+	}
+	if name, err := c.SourceName(ip); err == nil && name != "" {
+		return name
+	}
+	return ip.String()
+}
+
+// uniqueNames replaces names shared by several NTP sources, as all
+// members of a pool share the pool's name, with the source's address
+// so each source can be told apart. ips holds nil for reference clocks.
+func uniqueNames(names []string, ips []net.IP) {
+	count := make(map[string]int, len(names))
+	for _, name := range names {
+		count[name]++
+	}
+	for i, name := range names {
+		if count[name] > 1 && ips[i] != nil {
+			names[i] = ips[i].String()
+		}
+	}
+}
+
+// Sources returns the report for every source, like "chronyc sources".
+func (c *Client) Sources() ([]SourceData, error) {
+	n, err := c.NumSources()
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]SourceData, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := c.SourceDataAt(i)
+		if err != nil {
+			// Sources can be removed between the count and the lookup.
+			if IsStatus(err, StatusNoSuchSource) {
+				continue
+			}
+			return nil, err
+		}
+		s.Name = c.sourceName(s.IPAddr, s.Mode)
+		sources = append(sources, *s)
+	}
+	names := make([]string, len(sources))
+	ips := make([]net.IP, len(sources))
+	for i, s := range sources {
+		names[i] = s.Name
+		if s.Mode != SourceModeRefclock {
+			ips[i] = s.IPAddr
+		}
+	}
+	uniqueNames(names, ips)
+	for i := range sources {
+		sources[i].Name = names[i]
+	}
+	return sources, nil
+}
+
+// SourceStats returns the statistics for every source, like
+// "chronyc sourcestats".
+func (c *Client) SourceStats() ([]SourceStats, error) {
+	n, err := c.NumSources()
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]SourceStats, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := c.SourceStatsAt(i)
+		if err != nil {
+			if IsStatus(err, StatusNoSuchSource) {
+				continue
+			}
+			return nil, err
+		}
+		mode := SourceModeClient
+		if s.IPAddr == nil {
+			mode = SourceModeRefclock
+			s.Name = refIDString(s.RefID)
+		} else {
+			s.Name = c.sourceName(s.IPAddr, mode)
+		}
+		stats = append(stats, *s)
+	}
+	names := make([]string, len(stats))
+	ips := make([]net.IP, len(stats))
+	for i, s := range stats {
+		names[i], ips[i] = s.Name, s.IPAddr
+	}
+	uniqueNames(names, ips)
+	for i := range stats {
+		stats[i].Name = names[i]
+	}
+	return stats, nil
+}
+
+// NTPData returns the NTP state of the source with address ip, like
+// "chronyc ntpdata". Reference clocks have no NTP data.
+func (c *Client) NTPData(ip net.IP) (*NTPData, error) {
+	data := make([]byte, ipAddrLen)
+	EncodeIPAddr(data, ip)
+	reply, err := c.Do(ReqNTPData, data, RpyNTPData)
+	if err != nil {
+		return nil, err
+	}
+	var n NTPData
+	if err := n.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// SelectDataAt returns the selection data for the source at index.
+func (c *Client) SelectDataAt(index int) (*SelectData, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(index))
+	reply, err := c.Do(ReqSelectData, data, RpySelectData)
+	if err != nil {
+		return nil, err
+	}
+	var s SelectData
+	if err := s.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SelectData returns the selection data for every source, like
+// "chronyc selectdata".
+func (c *Client) SelectData() ([]SelectData, error) {
+	n, err := c.NumSources()
+	if err != nil {
+		return nil, err
+	}
+	selects := make([]SelectData, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := c.SelectDataAt(i)
+		if err != nil {
+			if IsStatus(err, StatusNoSuchSource) {
+				continue
+			}
+			return nil, err
+		}
+		if s.IPAddr == nil {
+			s.Name = refIDString(s.RefID)
+		} else {
+			s.Name = c.sourceName(s.IPAddr, SourceModeClient)
+		}
+		selects = append(selects, *s)
+	}
+	names := make([]string, len(selects))
+	ips := make([]net.IP, len(selects))
+	for i, s := range selects {
+		names[i], ips[i] = s.Name, s.IPAddr
+	}
+	uniqueNames(names, ips)
+	for i := range selects {
+		selects[i].Name = names[i]
+	}
+	return selects, nil
+}
+
+// DeleteSource removes the NTP source with address ip at runtime. The
+// change is not written to chrony.conf.
+func (c *Client) DeleteSource(ip net.IP) error {
+	data := make([]byte, ipAddrLen)
+	EncodeIPAddr(data, ip)
+	_, err := c.Do(ReqDelSource, data, RpyNull)
+	return err
+}
+
+// AddSource adds an NTP source at runtime, like "chronyc add server". The
+// change is not written to chrony.conf.
+func (c *Client) AddSource(s *NTPSource) error {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ReqAddSource, data, RpyNull)
+	return err
+}
+
+// Online tells chronyd that the sources with address ip, or all sources
+// if ip is nil, are reachable again.
+func (c *Client) Online(ip net.IP) error {
+	_, err := c.Do(ReqOnline, encodeSourceMask(ip, 0), RpyNull)
+	return err
+}
+
+// Offline tells chronyd to stop polling the sources with address ip, or
+// all sources if ip is nil.
+func (c *Client) Offline(ip net.IP) error {
+	_, err := c.Do(ReqOffline, encodeSourceMask(ip, 0), RpyNull)
+	return err
+}
+
+// Burst makes the sources with address ip, or all sources if ip is nil,
+// take up to total quick measurements, stopping after good valid ones.
+func (c *Client) Burst(ip net.IP, good, total int) error {
+	data := encodeSourceMask(ip, 8)
+	binary.BigEndian.PutUint32(data[2*ipAddrLen:], uint32(int32(good)))
+	binary.BigEndian.PutUint32(data[2*ipAddrLen+4:], uint32(int32(total)))
+	_, err := c.Do(ReqBurst, data, RpyNull)
+	return err
+}
+
+// encodeSourceMask writes the mask and address that select the sources
+// with address ip, followed by extra zero bytes. A nil ip leaves both
+// unspecified, which selects all sources.
+func encodeSourceMask(ip net.IP, extra int) []byte {
+	data := make([]byte, 2*ipAddrLen+extra)
+	if ip == nil {
+		return data
+	}
+	mask := net.IP(net.CIDRMask(8*net.IPv6len, 8*net.IPv6len))
+	if ip.To4() != nil {
+		mask = net.IP(net.CIDRMask(8*net.IPv4len, 8*net.IPv4len))
+	}
+	EncodeIPAddr(data, mask)
+	EncodeIPAddr(data[ipAddrLen:], ip)
+	return data
+}
+
+// MakeStep makes chronyd step the system clock now by the current
+// offset, instead of slewing it.
+func (c *Client) MakeStep() error {
+	_, err := c.Do(ReqMakeStep, nil, RpyNull)
+	return err
+}
+
+// ModifyMakeStep changes chronyd's makestep setting: the clock is stepped
+// when the offset is larger than threshold seconds, in the first limit
+// clock updates (every update if limit is negative).
+func (c *Client) ModifyMakeStep(threshold float64, limit int) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(int32(limit)))
+	binary.BigEndian.PutUint32(data[4:], encodeFloat(threshold))
+	_, err := c.Do(ReqModifyMakeStep, data, RpyNull)
+	return err
+}
+
+// ReloadSources makes chronyd reread the files in its sourcedir
+// directories.
+func (c *Client) ReloadSources() error {
+	_, err := c.Do(ReqReloadSources, nil, RpyNull)
+	return err
+}
+
+// Rekey makes chronyd reread its key file.
+func (c *Client) Rekey() error {
+	_, err := c.Do(ReqRekey, nil, RpyNull)
+	return err
+}
+
+// CycleLogs makes chronyd close and reopen its log files.
+func (c *Client) CycleLogs() error {
+	_, err := c.Do(ReqCycleLogs, nil, RpyNull)
+	return err
+}
+
+// Dump makes chronyd write its measurement histories to its dumpdir.
+func (c *Client) Dump() error {
+	_, err := c.Do(ReqDump, make([]byte, 4), RpyNull)
+	return err
+}
+
+// Activity returns the online/offline source counts.
+func (c *Client) Activity() (*Activity, error) {
+	reply, err := c.Do(ReqActivity, nil, RpyActivity)
+	if err != nil {
+		return nil, err
+	}
+	var a Activity
+	if err := a.UnmarshalBinary(reply.Data); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Clients returns the whole client access table, like "chronyc clients".
+// It is only answered on the Unix socket.
+func (c *Client) Clients() ([]ClientAccess, error) {
+	var clients []ClientAccess
+	data := make([]byte, 16)
+	index := uint32(0)
+	for {
+		binary.BigEndian.PutUint32(data[0:], index)
+		binary.BigEndian.PutUint32(data[4:], maxClientAccesses)
+		binary.BigEndian.PutUint32(data[8:], 0)  // min hits
+		binary.BigEndian.PutUint32(data[12:], 0) // don't reset
+		reply, err := c.Do(ReqClientAccessesByIndex3, data, RpyClientAccessesByIndex3)
+		if err != nil {
+			return nil, err
+		}
+		var page ClientAccessesByIndex
+		if err := page.UnmarshalBinary(reply.Data); err != nil {
+			return nil, err
+		}
+		clients = append(clients, page.Clients...)
+		if len(page.Clients) == 0 || page.NextIndex <= index || page.NextIndex >= page.NIndices {
+			return clients, nil
+		}
+		index = page.NextIndex
+	}
+}
+
+// refIDString renders a reference ID the way chronyc prints reference
+// clock names: the printable ASCII characters of the ID.
+func refIDString(id uint32) string {
+	b := make([]byte, 0, 4)
+	for shift := 24; shift >= 0; shift -= 8 {
+		ch := byte(id >> uint(shift))
+		if ch < 0x21 || ch > 0x7e {
+			continue
+		}
+		b = append(b, ch)
+	}
+	return string(b)
+}
@@ -0,0 +1,399 @@
+package cmdmon_test
+
+import (
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"el/brick-clock/cmdmon"
+	"el/brick-clock/cmdmon/cmdmontest"
+)
+
+func newServer(t *testing.T, unix bool) (*cmdmontest.Server, *cmdmon.Client) {
+	t.Helper()
+	newServer := cmdmontest.NewUDPServer
+	if unix {
+		newServer = cmdmontest.NewUnixServer
+	}
+	srv, err := newServer()
+	if err != nil {
+		t.Fatalf("starting fake chronyd: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	c, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("dialing fake chronyd: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return srv, c
+}
+
+// approx compares values that went through chrony's 32-bit float
+// encoding, which keeps about 7 significant digits.
+func approx(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-6*math.Abs(want)
+}
+
+func TestTracking(t *testing.T) {
+	srv, c := newServer(t, false)
+	want := cmdmon.Tracking{
+		RefID:              0xCB00710A,
+		IPAddr:             net.ParseIP("203.0.113.10"),
+		Stratum:            3,
+		LeapStatus:         cmdmon.LeapInsertSecond,
+		RefTime:            time.Date(2024, 3, 18, 10, 30, 45, 123456789, time.UTC),
+		CurrentCorrection:  0.000012345,
+		LastOffset:         -0.000023456,
+		RMSOffset:          0.000034567,
+		FreqPPM:            -1.234,
+		ResidFreqPPM:       0.001,
+		SkewPPM:            0.012,
+		RootDelay:          0.012345678,
+		RootDispersion:     0.000456789,
+		LastUpdateInterval: 64.2,
+	}
+	srv.SetTracking(want)
+
+	got, err := c.Tracking()
+	if err != nil {
+		t.Fatalf("Tracking: %v", err)
+	}
+	if got.RefID != want.RefID || !got.IPAddr.Equal(want.IPAddr) || got.Stratum != want.Stratum ||
+		got.LeapStatus != want.LeapStatus || !got.RefTime.Equal(want.RefTime) {
+		t.Errorf("Tracking = %+v, want %+v", got, want)
+	}
+	floats := []struct {
+		name      string
+		got, want float64
+	}{
+		{"CurrentCorrection", got.CurrentCorrection, want.CurrentCorrection},
+		{"LastOffset", got.LastOffset, want.LastOffset},
+		{"RMSOffset", got.RMSOffset, want.RMSOffset},
+		{"FreqPPM", got.FreqPPM, want.FreqPPM},
+		{"ResidFreqPPM", got.ResidFreqPPM, want.ResidFreqPPM},
+		{"SkewPPM", got.SkewPPM, want.SkewPPM},
+		{"RootDelay", got.RootDelay, want.RootDelay},
+		{"RootDispersion", got.RootDispersion, want.RootDispersion},
+		{"LastUpdateInterval", got.LastUpdateInterval, want.LastUpdateInterval},
+	}
+	for _, f := range floats {
+		if !approx(f.got, f.want) {
+			t.Errorf("%s = %g, want %g", f.name, f.got, f.want)
+		}
+	}
+}
+
+var testSources = []cmdmontest.Source{
+	{
+		Name: "time.example.com",
+		Data: cmdmon.SourceData{
+			IPAddr: net.ParseIP("203.0.113.10"), Poll: 6, Stratum: 2,
+			State: cmdmon.SourceStateSelected, Reachability: 0377, SinceSample: 19,
+			OrigLatestMeas: 0.000625, LatestMeas: 0.000617, LatestMeasErr: 0.025,
+		},
+		Stats: cmdmon.SourceStats{
+			IPAddr: net.ParseIP("203.0.113.10"), NSamples: 20, NRuns: 11, SpanSeconds: 2340,
+			SD: 0.000018, ResidFreqPPM: -0.004, SkewPPM: 0.016, EstOffset: -0.000014,
+		},
+	},
+	{
+		Name: "2001:db8::123",
+		Data: cmdmon.SourceData{
+			IPAddr: net.ParseIP("2001:db8::123"), Poll: 10, Stratum: 1,
+			State: cmdmon.SourceStateSelectable, Mode: cmdmon.SourceModePeer,
+			Reachability: 0177, SinceSample: 512,
+		},
+		Stats: cmdmon.SourceStats{IPAddr: net.ParseIP("2001:db8::123"), NSamples: 4},
+	},
+	{
+		// Reference clocks carry their reference ID where the address goes
+		Data: cmdmon.SourceData{
+			IPAddr: net.IPv4(0x50, 0x50, 0x53, 0x30), Poll: 4,
+			State: cmdmon.SourceStateUnselected, Mode: cmdmon.SourceModeRefclock,
+			Reachability: 0377,
+		},
+		Stats: cmdmon.SourceStats{RefID: 0x50505330, NSamples: 8},
+	},
+}
+
+func TestSources(t *testing.T) {
+	srv, c := newServer(t, false)
+	srv.SetSources(testSources)
+
+	sources, err := c.Sources()
+	if err != nil {
+		t.Fatalf("Sources: %v", err)
+	}
+	if len(sources) != len(testSources) {
+		t.Fatalf("got %d sources, want %d", len(sources), len(testSources))
+	}
+	wantNames := []string{"time.example.com", "2001:db8::123", "PPS0"}
+	for i, s := range sources {
+		want := testSources[i].Data
+		if s.Name != wantNames[i] {
+			t.Errorf("source %d name = %q, want %q", i, s.Name, wantNames[i])
+		}
+		if !s.IPAddr.Equal(want.IPAddr) || s.Poll != want.Poll || s.Stratum != want.Stratum ||
+			s.State != want.State || s.Mode != want.Mode || s.Reachability != want.Reachability ||
+			s.SinceSample != want.SinceSample {
+			t.Errorf("source %d = %+v, want %+v", i, s, want)
+		}
+		if !approx(s.LatestMeas, want.LatestMeas) || !approx(s.OrigLatestMeas, want.OrigLatestMeas) ||
+			!approx(s.LatestMeasErr, want.LatestMeasErr) {
+			t.Errorf("source %d offsets = %g [%g] +/- %g, want %g [%g] +/- %g", i,
+				s.LatestMeas, s.OrigLatestMeas, s.LatestMeasErr,
+				want.LatestMeas, want.OrigLatestMeas, want.LatestMeasErr)
+		}
+	}
+}
+
+func TestPoolSourceNames(t *testing.T) {
+	srv, c := newServer(t, false)
+	pool := func(addr string) cmdmontest.Source {
+		ip := net.ParseIP(addr)
+		return cmdmontest.Source{
+			Name:  "pool.example.com",
+			Data:  cmdmon.SourceData{IPAddr: ip},
+			Stats: cmdmon.SourceStats{IPAddr: ip},
+		}
+	}
+	srv.SetSources(append([]cmdmontest.Source{pool("192.0.2.1"), pool("192.0.2.2")}, testSources...))
+
+	want := []string{"192.0.2.1", "192.0.2.2", "time.example.com", "2001:db8::123", "PPS0"}
+	sources, err := c.Sources()
+	if err != nil {
+		t.Fatalf("Sources: %v", err)
+	}
+	stats, err := c.SourceStats()
+	if err != nil {
+		t.Fatalf("SourceStats: %v", err)
+	}
+	if len(sources) != len(want) || len(stats) != len(want) {
+		t.Fatalf("got %d sources and %d sourcestats, want %d", len(sources), len(stats), len(want))
+	}
+	for i := range want {
+		if sources[i].Name != want[i] || stats[i].Name != want[i] {
+			t.Errorf("source %d names = %q, %q; want %q", i, sources[i].Name, stats[i].Name, want[i])
+		}
+	}
+}
+
+func TestSourceStats(t *testing.T) {
+	srv, c := newServer(t, false)
+	srv.SetSources(testSources)
+
+	stats, err := c.SourceStats()
+	if err != nil {
+		t.Fatalf("SourceStats: %v", err)
+	}
+	if len(stats) != len(testSources) {
+		t.Fatalf("got %d sourcestats, want %d", len(stats), len(testSources))
+	}
+	wantNames := []string{"time.example.com", "2001:db8::123", "PPS0"}
+	for i, s := range stats {
+		want := testSources[i].Stats
+		if s.Name != wantNames[i] {
+			t.Errorf("sourcestats %d name = %q, want %q", i, s.Name, wantNames[i])
+		}
+		if s.NSamples != want.NSamples || s.NRuns != want.NRuns || s.SpanSeconds != want.SpanSeconds {
+			t.Errorf("sourcestats %d = %+v, want %+v", i, s, want)
+		}
+		if !approx(s.SD, want.SD) || !approx(s.ResidFreqPPM, want.ResidFreqPPM) ||
+			!approx(s.SkewPPM, want.SkewPPM) || !approx(s.EstOffset, want.EstOffset) {
+			t.Errorf("sourcestats %d = %+v, want %+v", i, s, want)
+		}
+	}
+}
+
+func TestAddDeleteSource(t *testing.T) {
+	srv, c := newServer(t, true)
+	srv.SetSources(testSources[:1])
+
+	if err := c.AddSource(cmdmon.NewNTPSource(cmdmon.AddSourceServer, "192.0.2.1")); err != nil {
+		t.Fatalf("AddSource: %v", err)
+	}
+	err := c.AddSource(cmdmon.NewNTPSource(cmdmon.AddSourceServer, "192.0.2.1"))
+	if !cmdmon.IsStatus(err, cmdmon.StatusSourceAlreadyKnown) {
+		t.Errorf("adding the source again: got %v, want source already known", err)
+	}
+	sources, err := c.Sources()
+	if err != nil {
+		t.Fatalf("Sources: %v", err)
+	}
+	if len(sources) != 2 || sources[1].Name != "192.0.2.1" || sources[1].SinceSample != math.MaxUint32 {
+		t.Fatalf("sources after add = %+v", sources)
+	}
+
+	if err := c.DeleteSource(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatalf("DeleteSource: %v", err)
+	}
+	err = c.DeleteSource(net.ParseIP("192.0.2.1"))
+	if !cmdmon.IsStatus(err, cmdmon.StatusNoSuchSource) {
+		t.Errorf("deleting the source again: got %v, want no such source", err)
+	}
+	if n, err := c.NumSources(); err != nil || n != 1 {
+		t.Errorf("NumSources after delete = %d, %v; want 1", n, err)
+	}
+}
+
+// TestNewNTPSourceDefaults checks that a source added with the default
+// options goes on the wire as chronyc sends "add server 192.0.2.1", so that
+// it behaves like the same line in chrony.conf.
+func TestNewNTPSourceDefaults(t *testing.T) {
+	srv, c := newServer(t, true)
+	if err := c.AddSource(cmdmon.NewNTPSource(cmdmon.AddSourceServer, "192.0.2.1")); err != nil {
+		t.Fatalf("AddSource: %v", err)
+	}
+	added := srv.AddedSources()
+	if len(added) != 1 {
+		t.Fatalf("added sources = %+v", added)
+	}
+	// The defaults of CPS_ParseNTPSourceAdd in chronyc's cmdparse.c
+	want := cmdmon.NTPSource{
+		Type:             cmdmon.AddSourceServer,
+		Name:             "192.0.2.1",
+		Port:             123,
+		MinPoll:          6,
+		MaxPoll:          10,
+		Presend:          100,
+		PollTarget:       8,
+		MaxSources:       4,
+		MinSamples:       -1,
+		MaxSamples:       -1,
+		NTSPort:          4460,
+		MaxDelay:         3,
+		MaxDelayDevRatio: 10,
+		Asymmetry:        1,
+		Flags:            cmdmon.AddSourceOnline,
+	}
+	if added[0] != want {
+		t.Errorf("add source sent\n%+v\nchronyc sends\n%+v", added[0], want)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	srv, c := newServer(t, false)
+
+	srv.SetStatus(cmdmon.ReqTracking, cmdmon.StatusFailed)
+	_, err := c.Tracking()
+	var se *cmdmon.StatusError
+	if !errors.As(err, &se) || se.Command != cmdmon.ReqTracking || se.Status != cmdmon.StatusFailed {
+		t.Errorf("Tracking with a failed status: got %v", err)
+	}
+	srv.SetStatus(cmdmon.ReqTracking, cmdmon.StatusSuccess)
+	if _, err := c.Tracking(); err != nil {
+		t.Errorf("Tracking after clearing the status: %v", err)
+	}
+
+	// chronyd only accepts changes on its Unix socket
+	err = c.DeleteSource(net.ParseIP("192.0.2.1"))
+	if !cmdmon.IsStatus(err, cmdmon.StatusUnauth) {
+		t.Errorf("DeleteSource over UDP: got %v, want not authorised", err)
+	}
+	if _, err := c.SourceDataAt(5); !cmdmon.IsStatus(err, cmdmon.StatusNoSuchSource) {
+		t.Errorf("SourceDataAt out of range: got %v, want no such source", err)
+	}
+	if got := (&cmdmon.StatusError{Command: 33, Status: 99}).Error(); got != "cmdmon: command 33: status 99" {
+		t.Errorf("unknown status text = %q", got)
+	}
+}
+
+func TestShortPackets(t *testing.T) {
+	reports := []struct {
+		name string
+		r    interface{ UnmarshalBinary([]byte) error }
+		n    int
+	}{
+		{"tracking", &cmdmon.Tracking{}, 75},
+		{"source data", &cmdmon.SourceData{}, 47},
+		{"sourcestats", &cmdmon.SourceStats{}, 55},
+		{"activity", &cmdmon.Activity{}, 19},
+		{"ntpdata", &cmdmon.NTPData{}, 123},
+		{"select data", &cmdmon.SelectData{}, 47},
+		{"add source", &cmdmon.NTPSource{}, 351},
+		{"reply", &cmdmon.Reply{}, 27},
+		{"request", &cmdmon.Request{}, 19},
+	}
+	for _, r := range reports {
+		if err := r.r.UnmarshalBinary(make([]byte, r.n)); err != cmdmon.ErrShortPacket {
+			t.Errorf("%s of %d bytes: got %v, want ErrShortPacket", r.name, r.n, err)
+		}
+	}
+
+	// A request cut short is rejected like chronyd rejects it
+	pkt, err := (&cmdmon.Request{Command: cmdmon.ReqSourceData, Data: make([]byte, 4)}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req cmdmon.Request
+	if err := req.UnmarshalBinary(pkt[:len(pkt)-1]); !cmdmon.IsStatus(err, cmdmon.StatusBadPktLength) {
+		t.Errorf("truncated request: got %v, want bad packet length", err)
+	}
+}
+
+// replyWith answers every request with the reply reply returns, on a UDP
+// socket.
+func replyWith(t *testing.T, reply func(req *cmdmon.Request) *cmdmon.Reply) *cmdmon.Client {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req cmdmon.Request
+			if req.UnmarshalBinary(buf[:n]) != nil {
+				continue
+			}
+			if rpy := reply(&req); rpy != nil {
+				pkt, _ := rpy.MarshalBinary()
+				conn.WriteTo(pkt, addr)
+			}
+		}
+	}()
+	c, err := cmdmon.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Timeout = 50 * time.Millisecond
+	c.Retries = 1
+	return c
+}
+
+func TestShortReply(t *testing.T) {
+	c := replyWith(t, func(req *cmdmon.Request) *cmdmon.Reply {
+		return &cmdmon.Reply{Command: req.Command, Reply: cmdmon.RpyNSources,
+			Sequence: req.Sequence, Data: []byte{0, 0}}
+	})
+	if _, err := c.NumSources(); err != cmdmon.ErrShortPacket {
+		t.Errorf("NumSources with a 2-byte body: got %v, want ErrShortPacket", err)
+	}
+	if _, err := c.Tracking(); err != cmdmon.ErrUnexpectedReply {
+		t.Errorf("Tracking answered with a source count: got %v, want ErrUnexpectedReply", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	attempts := make(chan uint16, 4)
+	c := replyWith(t, func(req *cmdmon.Request) *cmdmon.Reply {
+		attempts <- req.Attempt
+		return nil
+	})
+	if err := c.Ping(); err != cmdmon.ErrTimeout {
+		t.Fatalf("Ping without replies: got %v, want ErrTimeout", err)
+	}
+	for want := uint16(0); want <= 1; want++ {
+		if got := <-attempts; got != want {
+			t.Errorf("attempt = %d, want %d", got, want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Package cmdmontest provides a fake chronyd command socket for exercising
+// cmdmon clients without a running daemon, in the spirit of httptest.
+package cmdmontest
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"el/brick-clock/cmdmon"
+)
+
+// Source is one source as the fake daemon reports it.
+type Source struct {
+	// Name is returned for source name requests.
+	Name   string
+	Data   cmdmon.SourceData
+	Stats  cmdmon.SourceStats
+	NTP    cmdmon.NTPData
+	Select cmdmon.SelectData
+}
+
+// Server is a fake chronyd answering cmdmon requests from scripted state.
+type Server struct {
+	// Network and Addr are what cmdmon.Dial needs to reach the server.
+	Network string
+	Addr    string
+
+	conn net.PacketConn
+	dir  string
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	tracking cmdmon.Tracking
+	sources  []Source
+	activity cmdmon.Activity
+	clients  []cmdmon.ClientAccess
+	status   map[uint16]uint16
+	requests []uint16
+	added    []cmdmon.NTPSource
+}
+
+// NewUnixServer starts a fake daemon on a Unix datagram socket in a new
+// temporary directory.
+func NewUnixServer() (*Server, error) {
+	dir, err := os.MkdirTemp("", "cmdmontest")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "chronyd.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := newServer(conn, "unix", path)
+	s.dir = dir
+	return s, nil
+}
+
+// NewUDPServer starts a fake daemon on a UDP port on the loopback address.
+func NewUDPServer() (*Server, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return newServer(conn, "udp", conn.LocalAddr().String()), nil
+}
+
+func newServer(conn net.PacketConn, network, addr string) *Server {
+	s := &Server{
+		Network: network,
+		Addr:    addr,
+		conn:    conn,
+		status:  make(map[uint16]uint16),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Dial returns a client connected to the server.
+func (s *Server) Dial() (*cmdmon.Client, error) {
+	return cmdmon.Dial(s.Network, s.Addr)
+}
+
+// Close stops the server and removes its socket.
+func (s *Server) Close() {
+	s.conn.Close()
+	s.wg.Wait()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// SetTracking sets the tracking report.
+func (s *Server) SetTracking(t cmdmon.Tracking) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracking = t
+}
+
+// SetSources sets the sources reported by sources, sourcestats, ntpdata
+// and selectdata.
+func (s *Server) SetSources(sources []Source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append([]Source(nil), sources...)
+}
+
+// SetActivity sets the activity report.
+func (s *Server) SetActivity(a cmdmon.Activity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activity = a
+}
+
+// SetClients sets the client access table.
+func (s *Server) SetClients(clients []cmdmon.ClientAccess) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = append([]cmdmon.ClientAccess(nil), clients...)
+}
+
+// SetStatus makes every request for command fail with status. Passing
+// cmdmon.StatusSuccess restores normal replies.
+func (s *Server) SetStatus(command, status uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == cmdmon.StatusSuccess {
+		delete(s.status, command)
+		return
+	}
+	s.status[command] = status
+}
+
+// AddedSources returns the sources of the add source requests received
+// so far, as decoded from the wire, in order.
+func (s *Server) AddedSources() []cmdmon.NTPSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]cmdmon.NTPSource(nil), s.added...)
+}
+
+// Requests returns the commands received so far, in order.
+func (s *Server) Requests() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint16(nil), s.requests...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply := s.handle(buf[:n])
+		if reply == nil {
+			continue
+		}
+		pkt, err := reply.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(pkt, addr)
+	}
+}
+
+func (s *Server) handle(pkt []byte) *cmdmon.Reply {
+	var req cmdmon.Request
+	if err := req.UnmarshalBinary(pkt); err != nil {
+		var se *cmdmon.StatusError
+		if !errors.As(err, &se) {
+			return nil
+		}
+		return &cmdmon.Reply{Command: req.Command, Reply: cmdmon.RpyNull,
+			Status: se.Status, Sequence: req.Sequence}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req.Command)
+
+	reply := &cmdmon.Reply{Command: req.Command, Reply: cmdmon.RpyNull,
+		Sequence: req.Sequence}
+	if status, ok := s.status[req.Command]; ok {
+		reply.Status = status
+		return reply
+	}
+
+	var body encoding.BinaryMarshaler
+	switch req.Command {
+	case cmdmon.ReqNull:
+	case cmdmon.ReqTracking:
+		reply.Reply, body = cmdmon.RpyTracking, &s.tracking
+	case cmdmon.ReqNSources:
+		reply.Reply = cmdmon.RpyNSources
+		reply.Data = make([]byte, 4)
+		binary.BigEndian.PutUint32(reply.Data, uint32(len(s.sources)))
+	case cmdmon.ReqSourceData, cmdmon.ReqSourcestats, cmdmon.ReqSelectData:
+		i := int(binary.BigEndian.Uint32(req.Data))
+		if i < 0 || i >= len(s.sources) {
+			reply.Status = cmdmon.StatusNoSuchSource
+			return reply
+		}
+		switch req.Command {
+		case cmdmon.ReqSourceData:
+			reply.Reply, body = cmdmon.RpySourceData, &s.sources[i].Data
+		case cmdmon.ReqSourcestats:
+			reply.Reply, body = cmdmon.RpySourcestats, &s.sources[i].Stats
+		default:
+			reply.Reply, body = cmdmon.RpySelectData, &s.sources[i].Select
+		}
+	case cmdmon.ReqNTPData:
+		src := s.findSource(cmdmon.DecodeIPAddr(req.Data))
+		if src == nil || src.Data.Mode == cmdmon.SourceModeRefclock {
+			reply.Status = cmdmon.StatusNoSuchSource
+			return reply
+		}
+		reply.Reply, body = cmdmon.RpyNTPData, &src.NTP
+	case cmdmon.ReqNTPSourceName:
+		ip := cmdmon.DecodeIPAddr(req.Data)
+		src := s.findSource(ip)
+		if src == nil {
+			reply.Status = cmdmon.StatusNoSuchSource
+			return reply
+		}
+		reply.Reply = cmdmon.RpyNTPSourceName
+		reply.Data = make([]byte, 256)
+		cmdmon.EncodeName(reply.Data, src.Name)
+	case cmdmon.ReqDelSource:
+		if s.Network != "unix" {
+			reply.Status = cmdmon.StatusUnauth
+			return reply
+		}
+		ip := cmdmon.DecodeIPAddr(req.Data)
+		if !s.deleteSource(ip) {
+			reply.Status = cmdmon.StatusNoSuchSource
+		}
+	case cmdmon.ReqAddSource:
+		if s.Network != "unix" {
+			reply.Status = cmdmon.StatusUnauth
+			return reply
+		}
+		var src cmdmon.NTPSource
+		if err := src.UnmarshalBinary(req.Data); err != nil {
+			reply.Status = cmdmon.StatusInvalid
+			return reply
+		}
+		s.added = append(s.added, src)
+		reply.Status = s.addSource(&src)
+	case cmdmon.ReqOnline, cmdmon.ReqOffline, cmdmon.ReqBurst:
+		if s.Network != "unix" {
+			reply.Status = cmdmon.StatusUnauth
+			return reply
+		}
+		// The address follows the 20-byte mask; nil selects all sources
+		if ip := cmdmon.DecodeIPAddr(req.Data[20:]); ip != nil && s.findSource(ip) == nil {
+			reply.Status = cmdmon.StatusNoSuchSource
+		}
+	case cmdmon.ReqDump, cmdmon.ReqRekey, cmdmon.ReqCycleLogs, cmdmon.ReqMakeStep,
+		cmdmon.ReqModifyMakeStep, cmdmon.ReqReloadSources:
+		if s.Network != "unix" {
+			reply.Status = cmdmon.StatusUnauth
+		}
+	case cmdmon.ReqActivity:
+		reply.Reply, body = cmdmon.RpyActivity, &s.activity
+	case cmdmon.ReqClientAccessesByIndex3:
+		if s.Network != "unix" {
+			reply.Status = cmdmon.StatusUnauth
+			return reply
+		}
+		reply.Reply, body = cmdmon.RpyClientAccessesByIndex3, s.clientPage(req.Data)
+	default:
+		reply.Status = cmdmon.StatusInvalid
+		return reply
+	}
+
+	if body != nil {
+		data, err := body.MarshalBinary()
+		if err != nil {
+			reply.Reply = cmdmon.RpyNull
+			reply.Status = cmdmon.StatusFailed
+			return reply
+		}
+		reply.Data = data
+	}
+	return reply
+}
+
+func (s *Server) findSource(ip net.IP) *Source {
+	for i := range s.sources {
+		if s.sources[i].Data.IPAddr.Equal(ip) {
+			return &s.sources[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) deleteSource(ip net.IP) bool {
+	for i := range s.sources {
+		if s.sources[i].Data.IPAddr.Equal(ip) {
+			s.sources = append(s.sources[:i], s.sources[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// addSource adds an unreachable source for src. Names that are not IP
+// addresses are reported as unresolved, with no address.
+func (s *Server) addSource(src *cmdmon.NTPSource) uint16 {
+	if src.Name == "" {
+		return cmdmon.StatusInvalidName
+	}
+	for i := range s.sources {
+		if s.sources[i].Name == src.Name {
+			return cmdmon.StatusSourceAlreadyKnown
+		}
+	}
+	mode := cmdmon.SourceModeClient
+	if src.Type == cmdmon.AddSourcePeer {
+		mode = cmdmon.SourceModePeer
+	}
+	s.sources = append(s.sources, Source{
+		Name: src.Name,
+		Data: cmdmon.SourceData{
+			IPAddr:      net.ParseIP(src.Name),
+			Poll:        int16(src.MinPoll),
+			State:       cmdmon.SourceStateNonselectable,
+			Mode:        mode,
+			SinceSample: 0xffffffff,
+		},
+	})
+	return cmdmon.StatusSuccess
+}
+
+func (s *Server) clientPage(data []byte) *cmdmon.ClientAccessesByIndex {
+	first := binary.BigEndian.Uint32(data[0:])
+	max := binary.BigEndian.Uint32(data[4:])
+	if max > 8 {
+		max = 8
+	}
+	page := &cmdmon.ClientAccessesByIndex{NIndices: uint32(len(s.clients))}
+	i := first
+	for ; i < uint32(len(s.clients)) && uint32(len(page.Clients)) < max; i++ {
+		page.Clients = append(page.Clients, s.clients[i])
+	}
+	page.NextIndex = i
+	return page
+}
@@ -0,0 +1,479 @@
+// Package cmdmon implements chronyd's command and monitoring protocol, the
+// binary request/reply protocol chronyc speaks over chronyd's Unix domain
+// socket and UDP port 323.
+//
+// Packet layouts follow candm.h from chrony 4.x (protocol version 6). All
+// multi-byte fields are big-endian and floating point values use chrony's
+// 32-bit encoding (7-bit exponent, 25-bit coefficient).
+package cmdmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the cmdmon protocol version spoken by chrony 2.2+.
+	ProtocolVersion = 6
+
+	pktTypeCmdRequest = 1
+	pktTypeCmdReply   = 2
+
+	requestHeaderLen = 20
+	replyHeaderLen   = 28
+)
+
+// Request codes (REQ_* in candm.h).
+const (
+	ReqNull                   uint16 = 0
+	ReqOnline                 uint16 = 1
+	ReqOffline                uint16 = 2
+	ReqBurst                  uint16 = 3
+	ReqDump                   uint16 = 6
+	ReqNSources               uint16 = 14
+	ReqSourceData             uint16 = 15
+	ReqRekey                  uint16 = 16
+	ReqDelSource              uint16 = 29
+	ReqTracking               uint16 = 33
+	ReqSourcestats            uint16 = 34
+	ReqCycleLogs              uint16 = 37
+	ReqMakeStep               uint16 = 43
+	ReqActivity               uint16 = 44
+	ReqModifyMakeStep         uint16 = 50
+	ReqNTPData                uint16 = 57
+	ReqAddSource              uint16 = 64
+	ReqNTPSourceName          uint16 = 65
+	ReqClientAccessesByIndex3 uint16 = 68
+	ReqSelectData             uint16 = 69
+	ReqReloadSources          uint16 = 70
+)
+
+// Reply codes (RPY_* in candm.h).
+const (
+	RpyNull                   uint16 = 1
+	RpyNSources               uint16 = 2
+	RpySourceData             uint16 = 3
+	RpyTracking               uint16 = 5
+	RpySourcestats            uint16 = 6
+	RpyActivity               uint16 = 12
+	RpyNTPData                uint16 = 16
+	RpyNTPSourceName          uint16 = 19
+	RpyClientAccessesByIndex3 uint16 = 21
+	RpySelectData             uint16 = 23
+)
+
+// Reply status codes (STT_* in candm.h).
+const (
+	StatusSuccess            uint16 = 0
+	StatusFailed             uint16 = 1
+	StatusUnauth             uint16 = 2
+	StatusInvalid            uint16 = 3
+	StatusNoSuchSource       uint16 = 4
+	StatusInvalidTS          uint16 = 5
+	StatusNotEnabled         uint16 = 6
+	StatusBadSubnet          uint16 = 7
+	StatusAccessAllowed      uint16 = 8
+	StatusAccessDenied       uint16 = 9
+	StatusSourceAlreadyKnown uint16 = 11
+	StatusTooManySources     uint16 = 12
+	StatusNoRTC              uint16 = 13
+	StatusBadRTCFile         uint16 = 14
+	StatusInactive           uint16 = 15
+	StatusBadSample          uint16 = 16
+	StatusInvalidAF          uint16 = 17
+	StatusBadPktVersion      uint16 = 18
+	StatusBadPktLength       uint16 = 19
+	StatusInvalidName        uint16 = 21
+)
+
+var statusText = map[uint16]string{
+	StatusSuccess:            "success",
+	StatusFailed:             "failed",
+	StatusUnauth:             "not authorised",
+	StatusInvalid:            "invalid command",
+	StatusNoSuchSource:       "no such source",
+	StatusInvalidTS:          "bad timestamp",
+	StatusNotEnabled:         "facility not enabled",
+	StatusBadSubnet:          "bad subnet",
+	StatusAccessAllowed:      "access allowed",
+	StatusAccessDenied:       "access denied",
+	StatusSourceAlreadyKnown: "source already known",
+	StatusTooManySources:     "too many sources present",
+	StatusNoRTC:              "no RTC driver",
+	StatusBadRTCFile:         "bad RTC file",
+	StatusInactive:           "inactive",
+	StatusBadSample:          "bad sample",
+	StatusInvalidAF:          "invalid address family",
+	StatusBadPktVersion:      "protocol version mismatch",
+	StatusBadPktLength:       "bad packet length",
+	StatusInvalidName:        "invalid name",
+}
+
+// StatusError is returned when chronyd answers a request with a status
+// other than StatusSuccess.
+type StatusError struct {
+	Command uint16
+	Status  uint16
+}
+
+func (e *StatusError) Error() string {
+	text, ok := statusText[e.Status]
+	if !ok {
+		text = fmt.Sprintf("status %d", e.Status)
+	}
+	return fmt.Sprintf("cmdmon: command %d: %s", e.Command, text)
+}
+
+// IsStatus reports whether err is a StatusError carrying status.
+func IsStatus(err error, status uint16) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Status == status
+}
+
+var (
+	ErrShortPacket     = errors.New("cmdmon: packet too short")
+	ErrBadPacket       = errors.New("cmdmon: malformed packet")
+	ErrUnknownCommand  = errors.New("cmdmon: unknown command")
+	ErrUnexpectedReply = errors.New("cmdmon: unexpected reply type")
+)
+
+// commandLengths holds the request and reply body sizes for each command.
+// chronyd drops requests shorter than the reply they would produce, so
+// requests are padded up to the larger of the two.
+var commandLengths = map[uint16]struct{ request, reply int }{
+	ReqNull:                   {0, 0},
+	ReqOnline:                 {2 * ipAddrLen, 0},
+	ReqOffline:                {2 * ipAddrLen, 0},
+	ReqBurst:                  {2*ipAddrLen + 8, 0},
+	ReqDump:                   {4, 0},
+	ReqNSources:               {0, nSourcesLen},
+	ReqSourceData:             {4, sourceDataLen},
+	ReqRekey:                  {0, 0},
+	ReqDelSource:              {ipAddrLen, 0},
+	ReqTracking:               {0, trackingLen},
+	ReqSourcestats:            {4, sourceStatsLen},
+	ReqCycleLogs:              {0, 0},
+	ReqMakeStep:               {0, 0},
+	ReqActivity:               {0, activityLen},
+	ReqModifyMakeStep:         {8, 0},
+	ReqNTPData:                {ipAddrLen, ntpDataLen},
+	ReqAddSource:              {ntpSourceLen, 0},
+	ReqNTPSourceName:          {ipAddrLen, sourceNameLen},
+	ReqClientAccessesByIndex3: {16, clientAccessesLen},
+	ReqSelectData:             {4, selectDataLen},
+	ReqReloadSources:          {0, 0},
+}
+
+// RequestLength returns the on-wire length of a request for command,
+// including the padding chronyd expects, or 0 if the command is unknown.
+func RequestLength(command uint16) int {
+	l, ok := commandLengths[command]
+	if !ok {
+		return 0
+	}
+	n := requestHeaderLen + l.request
+	if r := replyHeaderLen + l.reply; r > n {
+		n = r
+	}
+	return n
+}
+
+// Request is a cmdmon request packet.
+type Request struct {
+	Command  uint16
+	Attempt  uint16
+	Sequence uint32
+	Data     []byte
+}
+
+// MarshalBinary encodes the request, padding it to RequestLength.
+func (r *Request) MarshalBinary() ([]byte, error) {
+	n := RequestLength(r.Command)
+	if n == 0 {
+		return nil, ErrUnknownCommand
+	}
+	if requestHeaderLen+len(r.Data) > n {
+		return nil, ErrBadPacket
+	}
+	b := make([]byte, n)
+	b[0] = ProtocolVersion
+	b[1] = pktTypeCmdRequest
+	binary.BigEndian.PutUint16(b[4:], r.Command)
+	binary.BigEndian.PutUint16(b[6:], r.Attempt)
+	binary.BigEndian.PutUint32(b[8:], r.Sequence)
+	copy(b[requestHeaderLen:], r.Data)
+	return b, nil
+}
+
+// UnmarshalBinary decodes a request. Data is set to the request body
+// without padding. Packets shorter than RequestLength are rejected the
+// same way chronyd rejects them.
+func (r *Request) UnmarshalBinary(b []byte) error {
+	if len(b) < requestHeaderLen {
+		return ErrShortPacket
+	}
+	if b[1] != pktTypeCmdRequest || b[2] != 0 || b[3] != 0 {
+		return ErrBadPacket
+	}
+	r.Command = binary.BigEndian.Uint16(b[4:])
+	r.Attempt = binary.BigEndian.Uint16(b[6:])
+	r.Sequence = binary.BigEndian.Uint32(b[8:])
+	if b[0] != ProtocolVersion {
+		return &StatusError{Command: r.Command, Status: StatusBadPktVersion}
+	}
+	l, ok := commandLengths[r.Command]
+	if !ok {
+		return &StatusError{Command: r.Command, Status: StatusInvalid}
+	}
+	if len(b) < RequestLength(r.Command) {
+		return &StatusError{Command: r.Command, Status: StatusBadPktLength}
+	}
+	r.Data = b[requestHeaderLen : requestHeaderLen+l.request]
+	return nil
+}
+
+// Reply is a cmdmon reply packet.
+type Reply struct {
+	Command  uint16
+	Reply    uint16
+	Status   uint16
+	Sequence uint32
+	Data     []byte
+}
+
+// MarshalBinary encodes the reply.
+func (r *Reply) MarshalBinary() ([]byte, error) {
+	b := make([]byte, replyHeaderLen+len(r.Data))
+	b[0] = ProtocolVersion
+	b[1] = pktTypeCmdReply
+	binary.BigEndian.PutUint16(b[4:], r.Command)
+	binary.BigEndian.PutUint16(b[6:], r.Reply)
+	binary.BigEndian.PutUint16(b[8:], r.Status)
+	binary.BigEndian.PutUint32(b[16:], r.Sequence)
+	copy(b[replyHeaderLen:], r.Data)
+	return b, nil
+}
+
+// UnmarshalBinary decodes a reply. Data aliases b.
+func (r *Reply) UnmarshalBinary(b []byte) error {
+	if len(b) < replyHeaderLen {
+		return ErrShortPacket
+	}
+	if b[0] != ProtocolVersion || b[1] != pktTypeCmdReply || b[2] != 0 || b[3] != 0 {
+		return ErrBadPacket
+	}
+	r.Command = binary.BigEndian.Uint16(b[4:])
+	r.Reply = binary.BigEndian.Uint16(b[6:])
+	r.Status = binary.BigEndian.Uint16(b[8:])
+	r.Sequence = binary.BigEndian.Uint32(b[16:])
+	r.Data = b[replyHeaderLen:]
+	return nil
+}
+
+// Address families used in IPAddr fields.
+const (
+	ipAddrUnspec = 0
+	ipAddrInet4  = 1
+	ipAddrInet6  = 2
+	ipAddrID     = 3
+
+	ipAddrLen   = 20
+	timespecLen = 12
+)
+
+// EncodeIPAddr writes ip into b as a 20-byte IPAddr. A nil ip is encoded
+// as an unspecified address.
+func EncodeIPAddr(b []byte, ip net.IP) {
+	for i := range b[:ipAddrLen] {
+		b[i] = 0
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+		binary.BigEndian.PutUint16(b[16:], ipAddrInet4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		copy(b, ip16)
+		binary.BigEndian.PutUint16(b[16:], ipAddrInet6)
+	}
+}
+
+// DecodeIPAddr reads a 20-byte IPAddr. Unspecified addresses and source
+// identifiers (used for sources whose name is not resolved yet) decode
+// to nil.
+func DecodeIPAddr(b []byte) net.IP {
+	switch binary.BigEndian.Uint16(b[16:]) {
+	case ipAddrInet4:
+		return net.IPv4(b[0], b[1], b[2], b[3])
+	case ipAddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, b[:16])
+		return ip
+	}
+	return nil
+}
+
+// timespecNoHighSec marks a Timespec whose high seconds word is unused.
+const timespecNoHighSec = 0x7fffffff
+
+func encodeTimespec(b []byte, t time.Time) {
+	if t.IsZero() {
+		for i := range b[:timespecLen] {
+			b[i] = 0
+		}
+		return
+	}
+	sec := uint64(t.Unix())
+	binary.BigEndian.PutUint32(b[0:], uint32(sec>>32))
+	binary.BigEndian.PutUint32(b[4:], uint32(sec))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+}
+
+func decodeTimespec(b []byte) time.Time {
+	high := binary.BigEndian.Uint32(b[0:])
+	low := binary.BigEndian.Uint32(b[4:])
+	nsec := binary.BigEndian.Uint32(b[8:])
+	if high == timespecNoHighSec {
+		high = 0
+	}
+	if high == 0 && low == 0 && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(uint64(high)<<32|uint64(low)), int64(nsec)).UTC()
+}
+
+const (
+	floatExpBits  = 7
+	floatExpMin   = -(1 << (floatExpBits - 1))
+	floatExpMax   = -floatExpMin - 1
+	floatCoefBits = 32 - floatExpBits
+	floatCoefMin  = -(1 << (floatCoefBits - 1))
+	floatCoefMax  = -floatCoefMin - 1
+)
+
+// decodeFloat converts chrony's network float encoding to a float64
+// (UTI_FloatNetworkToHost).
+func decodeFloat(x uint32) float64 {
+	exp := int32(x >> floatCoefBits)
+	if exp >= 1<<(floatExpBits-1) {
+		exp -= 1 << floatExpBits
+	}
+	exp -= floatCoefBits
+
+	coef := int32(x % (1 << floatCoefBits))
+	if coef >= 1<<(floatCoefBits-1) {
+		coef -= 1 << floatCoefBits
+	}
+	return float64(coef) * math.Pow(2, float64(exp))
+}
+
+// encodeFloat converts a float64 to chrony's network float encoding
+// (UTI_FloatHostToNetwork).
+func encodeFloat(x float64) uint32 {
+	var exp, coef int32
+	neg := int32(0)
+	if x < 0 {
+		x = -x
+		neg = 1
+	} else if !(x >= 0) {
+		x = 0 // NaN is sent as zero
+	}
+
+	switch {
+	case x < 1e-100:
+		exp, coef = 0, 0
+	case x > 1e100:
+		exp, coef = floatExpMax, floatCoefMax+neg
+	default:
+		exp = int32(math.Log(x)/math.Log(2)) + 1
+		coef = int32(x*math.Pow(2, float64(-exp+floatCoefBits)) + 0.5)
+		for coef > floatCoefMax+neg {
+			coef >>= 1
+			exp++
+		}
+		if exp > floatExpMax {
+			exp, coef = floatExpMax, floatCoefMax+neg
+		} else if exp < floatExpMin {
+			if exp+floatCoefBits >= floatExpMin {
+				coef >>= uint(floatExpMin - exp)
+				exp = floatExpMin
+			} else {
+				exp, coef = 0, 0
+			}
+		}
+	}
+
+	if neg != 0 {
+		coef = int32(uint32(-coef) << floatExpBits >> floatExpBits)
+	}
+	return uint32(exp)<<floatCoefBits | uint32(coef)
+}
+
+// wire reads and writes fixed-layout fields at increasing offsets.
+type wire struct {
+	b   []byte
+	off int
+}
+
+func (w *wire) skip(n int) { w.off += n }
+
+func (w *wire) u8() uint8 {
+	v := w.b[w.off]
+	w.off++
+	return v
+}
+
+func (w *wire) u16() uint16 {
+	v := binary.BigEndian.Uint16(w.b[w.off:])
+	w.off += 2
+	return v
+}
+
+func (w *wire) u32() uint32 {
+	v := binary.BigEndian.Uint32(w.b[w.off:])
+	w.off += 4
+	return v
+}
+
+func (w *wire) float() float64 { return decodeFloat(w.u32()) }
+
+func (w *wire) ipAddr() net.IP {
+	ip := DecodeIPAddr(w.b[w.off:])
+	w.off += ipAddrLen
+	return ip
+}
+
+func (w *wire) timespec() time.Time {
+	t := decodeTimespec(w.b[w.off:])
+	w.off += timespecLen
+	return t
+}
+
+func (w *wire) putU8(v uint8) {
+	w.b[w.off] = v
+	w.off++
+}
+
+func (w *wire) putU16(v uint16) {
+	binary.BigEndian.PutUint16(w.b[w.off:], v)
+	w.off += 2
+}
+
+func (w *wire) putU32(v uint32) {
+	binary.BigEndian.PutUint32(w.b[w.off:], v)
+	w.off += 4
+}
+
+func (w *wire) putFloat(v float64) { w.putU32(encodeFloat(v)) }
+
+func (w *wire) putIPAddr(ip net.IP) {
+	EncodeIPAddr(w.b[w.off:], ip)
+	w.off += ipAddrLen
+}
+
+func (w *wire) putTimespec(t time.Time) {
+	encodeTimespec(w.b[w.off:], t)
+	w.off += timespecLen
+}
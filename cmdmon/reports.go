@@ -0,0 +1,664 @@
+package cmdmon
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+const (
+	nSourcesLen       = 4
+	sourceDataLen     = 48
+	trackingLen       = 76
+	sourceStatsLen    = 56
+	activityLen       = 20
+	ntpDataLen        = 124
+	selectDataLen     = 48
+	ntpSourceLen      = 352
+	sourceNameLen     = 256
+	clientAccessLen   = 60
+	maxClientAccesses = 8
+	clientAccessesLen = 12 + maxClientAccesses*clientAccessLen
+)
+
+// Leap status values reported in Tracking.LeapStatus.
+const (
+	LeapNormal         uint16 = 0
+	LeapInsertSecond   uint16 = 1
+	LeapDeleteSecond   uint16 = 2
+	LeapUnsynchronised uint16 = 3
+)
+
+// Tracking is the reply to a tracking request. Offsets, delays and
+// intervals are in seconds, frequencies in ppm.
+type Tracking struct {
+	RefID              uint32
+	IPAddr             net.IP
+	Stratum            uint16
+	LeapStatus         uint16
+	RefTime            time.Time
+	CurrentCorrection  float64
+	LastOffset         float64
+	RMSOffset          float64
+	FreqPPM            float64
+	ResidFreqPPM       float64
+	SkewPPM            float64
+	RootDelay          float64
+	RootDispersion     float64
+	LastUpdateInterval float64
+}
+
+func (t *Tracking) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, trackingLen)}
+	w.putU32(t.RefID)
+	w.putIPAddr(t.IPAddr)
+	w.putU16(t.Stratum)
+	w.putU16(t.LeapStatus)
+	w.putTimespec(t.RefTime)
+	w.putFloat(t.CurrentCorrection)
+	w.putFloat(t.LastOffset)
+	w.putFloat(t.RMSOffset)
+	w.putFloat(t.FreqPPM)
+	w.putFloat(t.ResidFreqPPM)
+	w.putFloat(t.SkewPPM)
+	w.putFloat(t.RootDelay)
+	w.putFloat(t.RootDispersion)
+	w.putFloat(t.LastUpdateInterval)
+	return w.b, nil
+}
+
+func (t *Tracking) UnmarshalBinary(b []byte) error {
+	if len(b) < trackingLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	t.RefID = w.u32()
+	t.IPAddr = w.ipAddr()
+	t.Stratum = w.u16()
+	t.LeapStatus = w.u16()
+	t.RefTime = w.timespec()
+	t.CurrentCorrection = w.float()
+	t.LastOffset = w.float()
+	t.RMSOffset = w.float()
+	t.FreqPPM = w.float()
+	t.ResidFreqPPM = w.float()
+	t.SkewPPM = w.float()
+	t.RootDelay = w.float()
+	t.RootDispersion = w.float()
+	t.LastUpdateInterval = w.float()
+	return nil
+}
+
+// Source states reported in SourceData.State.
+const (
+	SourceStateSelected      uint16 = 0
+	SourceStateNonselectable uint16 = 1
+	SourceStateFalseticker   uint16 = 2
+	SourceStateJittery       uint16 = 3
+	SourceStateUnselected    uint16 = 4
+	SourceStateSelectable    uint16 = 5
+)
+
+// Source modes reported in SourceData.Mode.
+const (
+	SourceModeClient   uint16 = 0
+	SourceModePeer     uint16 = 1
+	SourceModeRefclock uint16 = 2
+)
+
+// Source flags reported in SourceData.Flags.
+const (
+	SourceFlagNoselect uint16 = 0x1
+	SourceFlagPrefer   uint16 = 0x2
+	SourceFlagTrust    uint16 = 0x4
+	SourceFlagRequire  uint16 = 0x8
+)
+
+// SourceData is the reply to a source data request, one row of
+// "chronyc sources". LatestMeas is the adjusted offset, OrigLatestMeas the
+// offset as measured and LatestMeasErr the error bound, all in seconds.
+type SourceData struct {
+	IPAddr         net.IP
+	Poll           int16
+	Stratum        uint16
+	State          uint16
+	Mode           uint16
+	Flags          uint16
+	Reachability   uint16
+	SinceSample    uint32
+	OrigLatestMeas float64
+	LatestMeas     float64
+	LatestMeasErr  float64
+
+	// Name is not part of the reply; Client.Sources fills it in from a
+	// source name request, or with the address when several sources share
+	// a name, like the members of a pool.
+	Name string
+}
+
+func (s *SourceData) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, sourceDataLen)}
+	w.putIPAddr(s.IPAddr)
+	w.putU16(uint16(s.Poll))
+	w.putU16(s.Stratum)
+	w.putU16(s.State)
+	w.putU16(s.Mode)
+	w.putU16(s.Flags)
+	w.putU16(s.Reachability)
+	w.putU32(s.SinceSample)
+	w.putFloat(s.OrigLatestMeas)
+	w.putFloat(s.LatestMeas)
+	w.putFloat(s.LatestMeasErr)
+	return w.b, nil
+}
+
+func (s *SourceData) UnmarshalBinary(b []byte) error {
+	if len(b) < sourceDataLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	s.IPAddr = w.ipAddr()
+	s.Poll = int16(w.u16())
+	s.Stratum = w.u16()
+	s.State = w.u16()
+	s.Mode = w.u16()
+	s.Flags = w.u16()
+	s.Reachability = w.u16()
+	s.SinceSample = w.u32()
+	s.OrigLatestMeas = w.float()
+	s.LatestMeas = w.float()
+	s.LatestMeasErr = w.float()
+	return nil
+}
+
+// SourceStats is the reply to a sourcestats request, one row of
+// "chronyc sourcestats".
+type SourceStats struct {
+	RefID        uint32
+	IPAddr       net.IP
+	NSamples     uint32
+	NRuns        uint32
+	SpanSeconds  uint32
+	SD           float64
+	ResidFreqPPM float64
+	SkewPPM      float64
+	EstOffset    float64
+	EstOffsetErr float64
+
+	// Name is filled in by Client.SourceStats, as for SourceData.
+	Name string
+}
+
+func (s *SourceStats) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, sourceStatsLen)}
+	w.putU32(s.RefID)
+	w.putIPAddr(s.IPAddr)
+	w.putU32(s.NSamples)
+	w.putU32(s.NRuns)
+	w.putU32(s.SpanSeconds)
+	w.putFloat(s.SD)
+	w.putFloat(s.ResidFreqPPM)
+	w.putFloat(s.SkewPPM)
+	w.putFloat(s.EstOffset)
+	w.putFloat(s.EstOffsetErr)
+	return w.b, nil
+}
+
+func (s *SourceStats) UnmarshalBinary(b []byte) error {
+	if len(b) < sourceStatsLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	s.RefID = w.u32()
+	s.IPAddr = w.ipAddr()
+	s.NSamples = w.u32()
+	s.NRuns = w.u32()
+	s.SpanSeconds = w.u32()
+	s.SD = w.float()
+	s.ResidFreqPPM = w.float()
+	s.SkewPPM = w.float()
+	s.EstOffset = w.float()
+	s.EstOffsetErr = w.float()
+	return nil
+}
+
+// Activity is the reply to an activity request.
+type Activity struct {
+	Online       int32
+	Offline      int32
+	BurstOnline  int32
+	BurstOffline int32
+	Unresolved   int32
+}
+
+func (a *Activity) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, activityLen)}
+	w.putU32(uint32(a.Online))
+	w.putU32(uint32(a.Offline))
+	w.putU32(uint32(a.BurstOnline))
+	w.putU32(uint32(a.BurstOffline))
+	w.putU32(uint32(a.Unresolved))
+	return w.b, nil
+}
+
+func (a *Activity) UnmarshalBinary(b []byte) error {
+	if len(b) < activityLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	a.Online = int32(w.u32())
+	a.Offline = int32(w.u32())
+	a.BurstOnline = int32(w.u32())
+	a.BurstOffline = int32(w.u32())
+	a.Unresolved = int32(w.u32())
+	return nil
+}
+
+// ClientAccess is one entry of the client access table, one row of
+// "chronyc clients". Intervals are log2 seconds; LastHitAgo values are
+// seconds, with ^uint32(0) meaning never.
+type ClientAccess struct {
+	IPAddr             net.IP
+	NTPHits            uint32
+	NKEHits            uint32
+	CmdHits            uint32
+	NTPDrops           uint32
+	NKEDrops           uint32
+	CmdDrops           uint32
+	NTPInterval        int8
+	NKEInterval        int8
+	CmdInterval        int8
+	NTPTimeoutInterval int8
+	LastNTPHitAgo      uint32
+	LastNKEHitAgo      uint32
+	LastCmdHitAgo      uint32
+}
+
+func (c *ClientAccess) marshal(w *wire) {
+	w.putIPAddr(c.IPAddr)
+	w.putU32(c.NTPHits)
+	w.putU32(c.NKEHits)
+	w.putU32(c.CmdHits)
+	w.putU32(c.NTPDrops)
+	w.putU32(c.NKEDrops)
+	w.putU32(c.CmdDrops)
+	w.putU8(uint8(c.NTPInterval))
+	w.putU8(uint8(c.NKEInterval))
+	w.putU8(uint8(c.CmdInterval))
+	w.putU8(uint8(c.NTPTimeoutInterval))
+	w.putU32(c.LastNTPHitAgo)
+	w.putU32(c.LastNKEHitAgo)
+	w.putU32(c.LastCmdHitAgo)
+}
+
+func (c *ClientAccess) unmarshal(w *wire) {
+	c.IPAddr = w.ipAddr()
+	c.NTPHits = w.u32()
+	c.NKEHits = w.u32()
+	c.CmdHits = w.u32()
+	c.NTPDrops = w.u32()
+	c.NKEDrops = w.u32()
+	c.CmdDrops = w.u32()
+	c.NTPInterval = int8(w.u8())
+	c.NKEInterval = int8(w.u8())
+	c.CmdInterval = int8(w.u8())
+	c.NTPTimeoutInterval = int8(w.u8())
+	c.LastNTPHitAgo = w.u32()
+	c.LastNKEHitAgo = w.u32()
+	c.LastCmdHitAgo = w.u32()
+}
+
+// ClientAccessesByIndex is one page of the client access table.
+// NIndices is the size of the server's table and NextIndex the index to
+// request next.
+type ClientAccessesByIndex struct {
+	NIndices  uint32
+	NextIndex uint32
+	Clients   []ClientAccess
+}
+
+func (c *ClientAccessesByIndex) MarshalBinary() ([]byte, error) {
+	if len(c.Clients) > maxClientAccesses {
+		return nil, ErrBadPacket
+	}
+	w := &wire{b: make([]byte, clientAccessesLen)}
+	w.putU32(c.NIndices)
+	w.putU32(c.NextIndex)
+	w.putU32(uint32(len(c.Clients)))
+	for i := range c.Clients {
+		c.Clients[i].marshal(w)
+	}
+	return w.b, nil
+}
+
+func (c *ClientAccessesByIndex) UnmarshalBinary(b []byte) error {
+	if len(b) < 12 {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	c.NIndices = w.u32()
+	c.NextIndex = w.u32()
+	n := int(w.u32())
+	if n > maxClientAccesses {
+		return ErrBadPacket
+	}
+	if len(b) < 12+n*clientAccessLen {
+		return ErrShortPacket
+	}
+	c.Clients = make([]ClientAccess, n)
+	for i := range c.Clients {
+		c.Clients[i].unmarshal(w)
+	}
+	return nil
+}
+
+// NTP data flags reported in NTPData.Flags. The low ten bits are the
+// results of the packet tests, shown by chronyc as "NTP tests".
+const (
+	NTPFlagTests         uint16 = 0x3ff
+	NTPFlagInterleaved   uint16 = 0x4000
+	NTPFlagAuthenticated uint16 = 0x8000
+)
+
+// NTPData is the reply to an NTP data request, the output of
+// "chronyc ntpdata" for one source. Delays, dispersions and offsets are in
+// seconds. TxTssChar and RxTssChar are the timestamping sources ('D'
+// daemon, 'K' kernel, 'H' hardware).
+type NTPData struct {
+	RemoteAddr      net.IP
+	LocalAddr       net.IP
+	RemotePort      uint16
+	Leap            uint8
+	Version         uint8
+	Mode            uint8
+	Stratum         uint8
+	Poll            int8
+	Precision       int8
+	RootDelay       float64
+	RootDispersion  float64
+	RefID           uint32
+	RefTime         time.Time
+	Offset          float64
+	PeerDelay       float64
+	PeerDispersion  float64
+	ResponseTime    float64
+	JitterAsymmetry float64
+	Flags           uint16
+	TxTssChar       uint8
+	RxTssChar       uint8
+	TotalTxCount    uint32
+	TotalRxCount    uint32
+	TotalValidCount uint32
+}
+
+func (n *NTPData) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, ntpDataLen)}
+	w.putIPAddr(n.RemoteAddr)
+	w.putIPAddr(n.LocalAddr)
+	w.putU16(n.RemotePort)
+	w.putU8(n.Leap)
+	w.putU8(n.Version)
+	w.putU8(n.Mode)
+	w.putU8(n.Stratum)
+	w.putU8(uint8(n.Poll))
+	w.putU8(uint8(n.Precision))
+	w.putFloat(n.RootDelay)
+	w.putFloat(n.RootDispersion)
+	w.putU32(n.RefID)
+	w.putTimespec(n.RefTime)
+	w.putFloat(n.Offset)
+	w.putFloat(n.PeerDelay)
+	w.putFloat(n.PeerDispersion)
+	w.putFloat(n.ResponseTime)
+	w.putFloat(n.JitterAsymmetry)
+	w.putU16(n.Flags)
+	w.putU8(n.TxTssChar)
+	w.putU8(n.RxTssChar)
+	w.putU32(n.TotalTxCount)
+	w.putU32(n.TotalRxCount)
+	w.putU32(n.TotalValidCount)
+	return w.b, nil
+}
+
+func (n *NTPData) UnmarshalBinary(b []byte) error {
+	if len(b) < ntpDataLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	n.RemoteAddr = w.ipAddr()
+	n.LocalAddr = w.ipAddr()
+	n.RemotePort = w.u16()
+	n.Leap = w.u8()
+	n.Version = w.u8()
+	n.Mode = w.u8()
+	n.Stratum = w.u8()
+	n.Poll = int8(w.u8())
+	n.Precision = int8(w.u8())
+	n.RootDelay = w.float()
+	n.RootDispersion = w.float()
+	n.RefID = w.u32()
+	n.RefTime = w.timespec()
+	n.Offset = w.float()
+	n.PeerDelay = w.float()
+	n.PeerDispersion = w.float()
+	n.ResponseTime = w.float()
+	n.JitterAsymmetry = w.float()
+	n.Flags = w.u16()
+	n.TxTssChar = w.u8()
+	n.RxTssChar = w.u8()
+	n.TotalTxCount = w.u32()
+	n.TotalRxCount = w.u32()
+	n.TotalValidCount = w.u32()
+	return nil
+}
+
+// SelectData is the reply to a select data request, one row of
+// "chronyc selectdata". StateChar is the selection status letter and the
+// option fields use the SourceFlag* bits.
+type SelectData struct {
+	RefID          uint32
+	IPAddr         net.IP
+	StateChar      uint8
+	Authentication uint8
+	Leap           uint8
+	ConfOptions    uint16
+	EffOptions     uint16
+	LastSampleAgo  uint32
+	Score          float64
+	LoLimit        float64
+	HiLimit        float64
+
+	// Name is filled in by Client.SelectData, as for SourceData.
+	Name string
+}
+
+func (s *SelectData) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, selectDataLen)}
+	w.putU32(s.RefID)
+	w.putIPAddr(s.IPAddr)
+	w.putU8(s.StateChar)
+	w.putU8(s.Authentication)
+	w.putU8(s.Leap)
+	w.skip(1)
+	w.putU16(s.ConfOptions)
+	w.putU16(s.EffOptions)
+	w.putU32(s.LastSampleAgo)
+	w.putFloat(s.Score)
+	w.putFloat(s.LoLimit)
+	w.putFloat(s.HiLimit)
+	return w.b, nil
+}
+
+func (s *SelectData) UnmarshalBinary(b []byte) error {
+	if len(b) < selectDataLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	s.RefID = w.u32()
+	s.IPAddr = w.ipAddr()
+	s.StateChar = w.u8()
+	s.Authentication = w.u8()
+	s.Leap = w.u8()
+	w.skip(1)
+	s.ConfOptions = w.u16()
+	s.EffOptions = w.u16()
+	s.LastSampleAgo = w.u32()
+	s.Score = w.float()
+	s.LoLimit = w.float()
+	s.HiLimit = w.float()
+	return nil
+}
+
+// Source types for NTPSource.Type.
+const (
+	AddSourceServer uint32 = 1
+	AddSourcePeer   uint32 = 2
+	AddSourcePool   uint32 = 3
+)
+
+// Option flags for NTPSource.Flags.
+const (
+	AddSourceOnline      uint32 = 0x1
+	AddSourceAutoOffline uint32 = 0x2
+	AddSourceIBurst      uint32 = 0x4
+	AddSourcePrefer      uint32 = 0x8
+	AddSourceNoselect    uint32 = 0x10
+	AddSourceTrust       uint32 = 0x20
+	AddSourceRequire     uint32 = 0x40
+	AddSourceInterleaved uint32 = 0x80
+	AddSourceBurst       uint32 = 0x100
+	AddSourceNTS         uint32 = 0x200
+	AddSourceCopy        uint32 = 0x400
+)
+
+// NTPSource is the body of an add source request, the equivalent of a
+// server, peer or pool directive. chronyd does not apply defaults to it,
+// so every field must be set; NewNTPSource returns chrony's defaults.
+// Delays, the asymmetry and the offset are in seconds.
+type NTPSource struct {
+	Type             uint32
+	Name             string
+	Port             uint32
+	MinPoll          int32
+	MaxPoll          int32
+	Presend          int32
+	MinStratum       uint32
+	PollTarget       uint32
+	Version          uint32
+	MaxSources       uint32
+	MinSamples       int32
+	MaxSamples       int32
+	AuthKey          uint32
+	NTSPort          uint32
+	MaxDelay         float64
+	MaxDelayRatio    float64
+	MaxDelayDevRatio float64
+	MinDelay         float64
+	Asymmetry        float64
+	Offset           float64
+	Flags            uint32
+	FilterLength     int32
+	CertSet          uint32
+	MaxDelayQuant    float64
+}
+
+// NewNTPSource returns a source of type typ for name with the option
+// values chronyd uses when a directive does not set them.
+func NewNTPSource(typ uint32, name string) *NTPSource {
+	return &NTPSource{
+		Type:             typ,
+		Name:             name,
+		Port:             123,
+		MinPoll:          6,
+		MaxPoll:          10,
+		Presend:          100,
+		PollTarget:       8,
+		MaxSources:       4,
+		MinSamples:       -1,
+		MaxSamples:       -1,
+		NTSPort:          4460,
+		MaxDelay:         3,
+		MaxDelayDevRatio: 10,
+		Asymmetry:        1,
+		Flags:            AddSourceOnline,
+	}
+}
+
+func (s *NTPSource) MarshalBinary() ([]byte, error) {
+	w := &wire{b: make([]byte, ntpSourceLen)}
+	w.putU32(s.Type)
+	EncodeName(w.b[w.off:w.off+sourceNameLen], s.Name)
+	w.skip(sourceNameLen)
+	w.putU32(s.Port)
+	w.putU32(uint32(s.MinPoll))
+	w.putU32(uint32(s.MaxPoll))
+	w.putU32(uint32(s.Presend))
+	w.putU32(s.MinStratum)
+	w.putU32(s.PollTarget)
+	w.putU32(s.Version)
+	w.putU32(s.MaxSources)
+	w.putU32(uint32(s.MinSamples))
+	w.putU32(uint32(s.MaxSamples))
+	w.putU32(s.AuthKey)
+	w.putU32(s.NTSPort)
+	w.putFloat(s.MaxDelay)
+	w.putFloat(s.MaxDelayRatio)
+	w.putFloat(s.MaxDelayDevRatio)
+	w.putFloat(s.MinDelay)
+	w.putFloat(s.Asymmetry)
+	w.putFloat(s.Offset)
+	w.putU32(s.Flags)
+	w.putU32(uint32(s.FilterLength))
+	w.putU32(s.CertSet)
+	w.putFloat(s.MaxDelayQuant)
+	return w.b, nil
+}
+
+func (s *NTPSource) UnmarshalBinary(b []byte) error {
+	if len(b) < ntpSourceLen {
+		return ErrShortPacket
+	}
+	w := &wire{b: b}
+	s.Type = w.u32()
+	s.Name = decodeName(w.b[w.off : w.off+sourceNameLen])
+	w.skip(sourceNameLen)
+	s.Port = w.u32()
+	s.MinPoll = int32(w.u32())
+	s.MaxPoll = int32(w.u32())
+	s.Presend = int32(w.u32())
+	s.MinStratum = w.u32()
+	s.PollTarget = w.u32()
+	s.Version = w.u32()
+	s.MaxSources = w.u32()
+	s.MinSamples = int32(w.u32())
+	s.MaxSamples = int32(w.u32())
+	s.AuthKey = w.u32()
+	s.NTSPort = w.u32()
+	s.MaxDelay = w.float()
+	s.MaxDelayRatio = w.float()
+	s.MaxDelayDevRatio = w.float()
+	s.MinDelay = w.float()
+	s.Asymmetry = w.float()
+	s.Offset = w.float()
+	s.Flags = w.u32()
+	s.FilterLength = int32(w.u32())
+	s.CertSet = w.u32()
+	s.MaxDelayQuant = w.float()
+	return nil
+}
+
+// decodeName reads a NUL-padded name field.
+func decodeName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// EncodeName writes name into a NUL-padded field of len(b) bytes.
+func EncodeName(b []byte, name string) {
+	n := copy(b[:len(b)-1], name)
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+}
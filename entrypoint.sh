@@ -1,14 +1,12 @@
 #!/bin/sh
-# Start chronyd in the background
-chronyd -f /etc/chrony/chrony.conf &
-
-# Start the API app in the foreground
+# Start the API app in the foreground; it runs and supervises chronyd
 # Check if Go binary exists, otherwise use Python
 if [ -f "/chrony-api-app" ]; then
     echo "Starting Go API server..."
     exec /chrony-api-app
 else
     echo "Starting Python API server (fallback)..."
+    chronyd -f /etc/chrony/chrony.conf &
     exec python3 /chrony_api_app.py
 fi
 